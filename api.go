@@ -22,14 +22,52 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/gorilla/websocket"
 )
 
-func (cr *Cluster) verifyDashBoardToken(token string) bool {
-	return false
+const tokenQueryKey = "_t"
+
+func getRequestToken(req *http.Request) (token string, ok bool) {
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		return strings.CutPrefix(auth, "Bearer ")
+	}
+	// browsers cannot set headers for EventSource and WebSocket
+	if token = req.URL.Query().Get(tokenQueryKey); token != "" {
+		return token, true
+	}
+	return "", false
+}
+
+// apiAuthHandle wraps the handler which requires a valid dashboard token
+func (cr *Cluster) apiAuthHandle(next http.Handler) http.Handler {
+	return (http.HandlerFunc)(func(rw http.ResponseWriter, req *http.Request) {
+		token, ok := getRequestToken(req)
+		if !ok {
+			writeJson(rw, http.StatusUnauthorized, Map{
+				"error": "authorization required",
+			})
+			return
+		}
+		if _, err := cr.verifyDashboardToken(token); err != nil {
+			logDebugf("Invalid dashboard token: %v", err)
+			writeJson(rw, http.StatusUnauthorized, Map{
+				"error": "invalid authorization token",
+			})
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+func (cr *Cluster) apiAuthHandleFunc(next http.HandlerFunc) http.Handler {
+	return cr.apiAuthHandle(next)
 }
 
 func (cr *Cluster) initAPIv0() (mux *http.ServeMux) {
@@ -48,54 +86,288 @@ func (cr *Cluster) initAPIv0() (mux *http.ServeMux) {
 	})
 	mux.HandleFunc("/status", func(rw http.ResponseWriter, req *http.Request) {
 		writeJson(rw, http.StatusOK, Map{
-			"startAt": startTime,
-			"stats":   &cr.stats,
-			"enabled": cr.enabled.Load(),
+			"startAt":     startTime,
+			"stats":       &cr.stats,
+			"enabled":     cr.enabled.Load(),
+			"clientLimit": cr.clientLimiter.Status(),
 		})
 	})
-	mux.HandleFunc("/log", func(rw http.ResponseWriter, req *http.Request) {
-		auth := req.Header.Get("Authorization")
-		tk, ok := strings.CutPrefix(auth, "Bearer ")
-		if !ok || cr.verifyDashBoardToken(tk) {
+	mux.HandleFunc("/login", func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			writeMethodNotAllowed(rw, http.MethodPost)
+			return
+		}
+		var data struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(io.LimitReader(req.Body, 4096)).Decode(&data); err != nil {
+			writeJson(rw, http.StatusBadRequest, Map{
+				"error":   "cannot decode payload",
+				"message": err.Error(),
+			})
+			return
+		}
+		if err := verifyDashboardLogin(data.Username, data.Password); err != nil {
+			if errors.Is(err, ErrDashboardAuthDisabled) {
+				writeJson(rw, http.StatusForbidden, Map{
+					"error": err.Error(),
+				})
+				return
+			}
+			logWarnf("Failed login attempt for %q from %s", data.Username, req.RemoteAddr)
+			// slow down the brute-force attacks
+			time.Sleep(time.Second)
 			writeJson(rw, http.StatusUnauthorized, Map{
-				"error": "invalid authorization token",
+				"error": err.Error(),
 			})
 			return
 		}
-		rw.WriteHeader(http.StatusOK)
-		e := json.NewEncoder(rw)
-		ctx, cancel := context.WithCancel(req.Context())
-		defer cancel()
+		token, expireAt, err := cr.generateDashboardToken(data.Username)
+		if err != nil {
+			writeJson(rw, http.StatusInternalServerError, Map{
+				"error":   "cannot generate token",
+				"message": err.Error(),
+			})
+			return
+		}
+		logInfof("Dashboard user %q logged in from %s", data.Username, req.RemoteAddr)
+		writeJson(rw, http.StatusOK, Map{
+			"token":    token,
+			"expireAt": expireAt,
+		})
+	})
+	mux.Handle("/log", cr.apiAuthHandleFunc(cr.apiV0Log))
+	mux.Handle("/log/stream", cr.apiAuthHandleFunc(cr.apiV0LogStream))
+	mux.Handle("/log/ws", cr.apiAuthHandleFunc(cr.apiV0LogWebSocket))
+	mux.Handle("/storage/health", cr.apiAuthHandleFunc(func(rw http.ResponseWriter, req *http.Request) {
+		writeJson(rw, http.StatusOK, cr.StorageHealthStatus())
+	}))
+	mux.Handle("/admin/sync", cr.apiAuthHandleFunc(cr.apiV0AdminSync))
+	mux.Handle("/admin/gc", cr.apiAuthHandleFunc(cr.apiV0AdminGC))
+	mux.Handle("/admin/drain", cr.apiAuthHandleFunc(cr.apiV0AdminDrain))
+	mux.Handle("/stats/files", cr.apiAuthHandleFunc(cr.apiV0StatsFiles))
+	mux.Handle("/stats/user-agents", cr.apiAuthHandleFunc(cr.apiV0StatsUserAgents))
+	mux.Handle("/stats/status", cr.apiAuthHandleFunc(cr.apiV0StatsStatus))
+	mux.Handle("/stats/hourly", cr.apiAuthHandleFunc(cr.apiV0StatsHourly))
+	mux.Handle("/stats/series", cr.apiAuthHandleFunc(cr.apiV0StatsSeries))
+	mux.Handle("/stats/reset", cr.apiAuthHandleFunc(cr.apiV0StatsReset))
+	return
+}
+
+const (
+	logStreamBufSize    = 64
+	logStreamMaxBacklog = logRingSize
+	logStreamHeartbeat  = time.Second * 15
+)
+
+// parseLogQuery parses the level and backlog options of the log APIs
+func parseLogQuery(req *http.Request, defaultBacklog int) (level LogLevel, backlog int) {
+	query := req.URL.Query()
+	level = LogLevelInfo
+	if lvl, ok := ParseLogLevel(query.Get("level")); ok {
+		level = lvl
+	}
+	backlog = defaultBacklog
+	if v := query.Get("backlog"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			backlog = n
+		}
+	}
+	if backlog < 0 {
+		backlog = 0
+	} else if backlog > logStreamMaxBacklog {
+		backlog = logStreamMaxBacklog
+	}
+	return
+}
 
-		level := LogLevelInfo
-		if strings.ToLower(req.URL.Query().Get("level")) == "debug" {
-			level = LogLevelDebug
+// apiV0Log streams logs in newline-delimited JSON format
+func (cr *Cluster) apiV0Log(rw http.ResponseWriter, req *http.Request) {
+	level, backlog := parseLogQuery(req, 0)
+	sub := SubscribeLogs(level, backlog, 0, logStreamBufSize)
+	defer sub.Close()
+
+	rw.Header().Set("Content-Type", "application/x-ndjson")
+	rw.WriteHeader(http.StatusOK)
+	flusher := http.NewResponseController(rw)
+	e := json.NewEncoder(rw)
+	for i := range sub.Backlog {
+		if err := e.Encode(&sub.Backlog[i]); err != nil {
+			return
 		}
+	}
+	flusher.Flush()
 
-		unregister := RegisterLogMonitor(level, func(ts int64, level LogLevel, log string) {
-			type logObj struct {
-				Time  int64  `json:"time"`
-				Level string `json:"lvl"`
-				Log   string `json:"log"`
+	ctx := req.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case entry := <-sub.C:
+			if err := e.Encode(&entry); err != nil {
+				return
 			}
-			var v = logObj{
-				Time:  ts,
-				Level: level.String(),
-				Log:   log,
+			flusher.Flush()
+		}
+	}
+}
+
+// apiV0LogStream streams logs with Server-Sent Events
+// see <https://html.spec.whatwg.org/multipage/server-sent-events.html>
+func (cr *Cluster) apiV0LogStream(rw http.ResponseWriter, req *http.Request) {
+	level, backlog := parseLogQuery(req, 100)
+	var after uint64
+	if id := req.Header.Get("Last-Event-ID"); id != "" {
+		// the client is reconnecting, only send the missing entries
+		if n, err := strconv.ParseUint(id, 10, 64); err == nil {
+			after = n
+			backlog = logStreamMaxBacklog
+		}
+	}
+	sub := SubscribeLogs(level, backlog, after, logStreamBufSize)
+	defer sub.Close()
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("X-Accel-Buffering", "no")
+	rw.WriteHeader(http.StatusOK)
+	flusher := http.NewResponseController(rw)
+
+	writeEvent := func(event string, id uint64, data any) error {
+		buf, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		if event != "" {
+			if _, err = io.WriteString(rw, "event: "+event+"\n"); err != nil {
+				return err
+			}
+		}
+		if id != 0 {
+			if _, err = io.WriteString(rw, "id: "+strconv.FormatUint(id, 10)+"\n"); err != nil {
+				return err
+			}
+		}
+		if _, err = io.WriteString(rw, "data: "+(string)(buf)+"\n\n"); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	for i := range sub.Backlog {
+		if err := writeEvent("", sub.Backlog[i].Seq, &sub.Backlog[i]); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(logStreamHeartbeat)
+	defer ticker.Stop()
+
+	ctx := req.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case entry := <-sub.C:
+			if err := writeEvent("", entry.Seq, &entry); err != nil {
+				return
 			}
-			if err := e.Encode(v); err != nil {
-				e.Encode(err.Error())
-				cancel()
+		case <-ticker.C:
+			if dropped := sub.Dropped(); dropped > 0 {
+				if err := writeEvent("dropped", 0, Map{"count": dropped}); err != nil {
+					return
+				}
+			} else if _, err := io.WriteString(rw, ": heartbeat\n\n"); err != nil {
 				return
 			}
-		})
-		defer unregister()
+		}
+		if err := flusher.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+var wsUpgrader = &websocket.Upgrader{
+	HandshakeTimeout: time.Second * 10,
+}
 
+// apiV0LogWebSocket streams logs over WebSocket.
+// The client can send {"level": "<level>"} to change the log level
+func (cr *Cluster) apiV0LogWebSocket(rw http.ResponseWriter, req *http.Request) {
+	level, backlog := parseLogQuery(req, 100)
+
+	conn, err := wsUpgrader.Upgrade(rw, req, nil)
+	if err != nil {
+		logDebugf("Cannot upgrade websocket: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+
+	levelCh := make(chan LogLevel, 1)
+	go func() {
+		defer cancel()
+		conn.SetReadLimit(1024)
+		for {
+			var msg struct {
+				Level string `json:"level"`
+			}
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			if lvl, ok := ParseLogLevel(msg.Level); ok {
+				select {
+				case levelCh <- lvl:
+				default:
+				}
+			}
+		}
+	}()
+
+	const writeTimeout = time.Second * 10
+	send := func(v any) error {
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		return conn.WriteJSON(v)
+	}
+
+	sub := SubscribeLogs(level, backlog, 0, logStreamBufSize)
+	defer func() {
+		sub.Close()
+	}()
+	for i := range sub.Backlog {
+		if err := send(&sub.Backlog[i]); err != nil {
+			return
+		}
+	}
+
+	ticker := time.NewTicker(logStreamHeartbeat)
+	defer ticker.Stop()
+
+	for {
 		select {
 		case <-ctx.Done():
+			return
+		case lvl := <-levelCh:
+			sub.Close()
+			sub = SubscribeLogs(lvl, 0, 0, logStreamBufSize)
+		case entry := <-sub.C:
+			if err := send(&entry); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if dropped := sub.Dropped(); dropped > 0 {
+				if err := send(Map{"dropped": dropped}); err != nil {
+					return
+				}
+			} else if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout)); err != nil {
+				return
+			}
 		}
-	})
-	return
+	}
 }
 
 type Map = map[string]any
@@ -0,0 +1,192 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// decodeOptionalJson decodes the request body into v, an empty body is allowed
+func decodeOptionalJson(rw http.ResponseWriter, req *http.Request, v any) bool {
+	if err := json.NewDecoder(io.LimitReader(req.Body, 4096)).Decode(v); err != nil && !errors.Is(err, io.EOF) {
+		writeJson(rw, http.StatusBadRequest, Map{
+			"error":   "cannot decode payload",
+			"message": err.Error(),
+		})
+		return false
+	}
+	return true
+}
+
+func writeMethodNotAllowed(rw http.ResponseWriter, allow string) {
+	rw.Header().Set("Allow", allow)
+	writeJson(rw, http.StatusMethodNotAllowed, Map{
+		"error": "405 method not allowed",
+	})
+}
+
+// apiV0AdminSync reports the sync status with GET, and triggers a sync with POST.
+// The POST payload is {"heavy": <bool>}, heavy check is disabled by default
+func (cr *Cluster) apiV0AdminSync(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		writeJson(rw, http.StatusOK, Map{
+			"syncing":  cr.issync.Load(),
+			"gcing":    cr.isgc.Load(),
+			"lastSync": cr.LastSyncResult(),
+		})
+	case http.MethodPost:
+		var data struct {
+			Heavy bool `json:"heavy"`
+		}
+		if !decodeOptionalJson(rw, req, &data) {
+			return
+		}
+		if cr.issync.Load() {
+			writeJson(rw, http.StatusConflict, Map{
+				"error": "another sync task is running",
+			})
+			return
+		}
+		logInfof("Sync (heavy = %v) is triggered from %s", data.Heavy, req.RemoteAddr)
+		go func(ctx context.Context) {
+			fl, _, err := cr.FetchFileList(ctx, true)
+			if err != nil {
+				logError("Cannot query cluster file list:", err)
+				return
+			}
+			cr.SyncFiles(ctx, fl, data.Heavy)
+		}(cr.ctx)
+		writeJson(rw, http.StatusAccepted, Map{
+			"heavy": data.Heavy,
+		})
+	default:
+		writeMethodNotAllowed(rw, "GET, POST")
+	}
+}
+
+// apiV0AdminGC runs the garbage collector for one storage,
+// the payload is {"storage": "<storage id>"}
+func (cr *Cluster) apiV0AdminGC(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeMethodNotAllowed(rw, http.MethodPost)
+		return
+	}
+	var data struct {
+		Storage string `json:"storage"`
+	}
+	if !decodeOptionalJson(rw, req, &data) {
+		return
+	}
+	s := cr.getStorageById(data.Storage)
+	if s == nil {
+		writeJson(rw, http.StatusNotFound, Map{
+			"error":   "storage not found",
+			"storage": data.Storage,
+		})
+		return
+	}
+	if cr.isSyncing() {
+		writeJson(rw, http.StatusConflict, Map{
+			"error": "cannot run garbage collector during sync",
+		})
+		return
+	}
+	if !cr.filesetsReady() {
+		writeJson(rw, http.StatusServiceUnavailable, Map{
+			"error": "file lists are not ready",
+		})
+		return
+	}
+	if !cr.isgc.CompareAndSwap(false, true) {
+		writeJson(rw, http.StatusConflict, Map{
+			"error": "another garbage collector is running",
+		})
+		return
+	}
+	logInfof("Garbage collector for %s is triggered from %s", s.String(), req.RemoteAddr)
+	go func() {
+		defer cr.isgc.Store(false)
+		cr.gcFor(s)
+	}()
+	writeJson(rw, http.StatusAccepted, Map{
+		"storage": data.Storage,
+	})
+}
+
+// apiV0AdminDrain reports the drain status with GET, starts draining with POST, and cancels the drain with DELETE.
+// The POST payload is {"timeout": <seconds>}, the drain-timeout option is used by default
+func (cr *Cluster) apiV0AdminDrain(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		writeJson(rw, http.StatusOK, cr.DrainStatus())
+	case http.MethodPost:
+		var data struct {
+			Timeout int64 `json:"timeout"`
+		}
+		if !decodeOptionalJson(rw, req, &data) {
+			return
+		}
+		if data.Timeout < 0 {
+			writeJson(rw, http.StatusBadRequest, Map{
+				"error": "timeout cannot be negative",
+			})
+			return
+		}
+		timeout := (time.Duration)(config().DrainTimeout)
+		if data.Timeout > 0 {
+			timeout = (time.Duration)(data.Timeout) * time.Second
+		}
+		if cr.draining.Load() {
+			writeJson(rw, http.StatusConflict, Map{
+				"error": "cluster is already draining",
+			})
+			return
+		}
+		logInfof("Drain (timeout = %s) is triggered from %s", timeout, req.RemoteAddr)
+		go cr.Drain(cr.ctx, timeout)
+		writeJson(rw, http.StatusAccepted, Map{
+			"timeout": timeout.Seconds(),
+		})
+	case http.MethodDelete:
+		if !cr.draining.Load() {
+			writeJson(rw, http.StatusConflict, Map{
+				"error": "cluster is not draining",
+			})
+			return
+		}
+		logInfof("Drain is canceled from %s", req.RemoteAddr)
+		if err := cr.Undrain(req.Context()); err != nil {
+			writeJson(rw, http.StatusInternalServerError, Map{
+				"error":   "cannot enable cluster",
+				"message": err.Error(),
+			})
+			return
+		}
+		writeJson(rw, http.StatusOK, cr.DrainStatus())
+	default:
+		writeMethodNotAllowed(rw, "GET, POST, DELETE")
+	}
+}
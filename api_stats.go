@@ -0,0 +1,168 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	statsDefaultTopFiles = 50
+	statsMaxTopFiles     = 1000
+)
+
+// queryInt parses an integer query, and returns def if it's absent or invalid
+func queryInt(req *http.Request, key string, def int) int {
+	if v := req.URL.Query().Get(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+// apiV0StatsFiles returns the most requested files.
+// Query options: limit=<count>, sort=<hits|bytes>
+func (cr *Cluster) apiV0StatsFiles(rw http.ResponseWriter, req *http.Request) {
+	limit := queryInt(req, "limit", statsDefaultTopFiles)
+	if limit <= 0 || limit > statsMaxTopFiles {
+		limit = statsMaxTopFiles
+	}
+	byBytes := req.URL.Query().Get("sort") == "bytes"
+	writeJson(rw, http.StatusOK, Map{
+		"since": cr.analytics.SinceTime(),
+		"files": cr.analytics.TopFiles(limit, byBytes),
+	})
+}
+
+// apiV0StatsUserAgents returns the hits and bytes of each user agent
+func (cr *Cluster) apiV0StatsUserAgents(rw http.ResponseWriter, req *http.Request) {
+	writeJson(rw, http.StatusOK, Map{
+		"since":      cr.analytics.SinceTime(),
+		"userAgents": cr.analytics.UserAgentStats(),
+	})
+}
+
+// apiV0StatsStatus returns the status code distribution of the downloads
+func (cr *Cluster) apiV0StatsStatus(rw http.ResponseWriter, req *http.Request) {
+	writeJson(rw, http.StatusOK, Map{
+		"since":  cr.analytics.SinceTime(),
+		"status": cr.analytics.StatusStats(),
+	})
+}
+
+// apiV0StatsHourly returns the hourly downloads of the last hours.
+// Query options: hours=<count>, the default is 24
+func (cr *Cluster) apiV0StatsHourly(rw http.ResponseWriter, req *http.Request) {
+	hours := queryInt(req, "hours", 24)
+	if hours <= 0 || hours > analyticsHourlySize {
+		hours = analyticsHourlySize
+	}
+	writeJson(rw, http.StatusOK, Map{
+		"since":  cr.analytics.SinceTime(),
+		"hourly": cr.analytics.HourlyStats(hours),
+	})
+}
+
+// apiV0StatsReset clears the access analytics
+func (cr *Cluster) apiV0StatsReset(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeMethodNotAllowed(rw, http.MethodPost)
+		return
+	}
+	logInfof("Access analytics is reset from %s", req.RemoteAddr)
+	cr.analytics.Reset()
+	writeJson(rw, http.StatusOK, Map{
+		"since": cr.analytics.SinceTime(),
+	})
+}
+
+// parseQueryTime parses a time in RFC 3339 format or unix seconds
+func parseQueryTime(v string) (time.Time, error) {
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// apiV0StatsSeries returns the hits and bytes in the buckets of a time range.
+// Query options: from=<time>, to=<time>, step=<duration>.
+// The time can be RFC 3339 format or unix seconds, the default range is the last 24 hours with 1 hour step
+func (cr *Cluster) apiV0StatsSeries(rw http.ResponseWriter, req *http.Request) {
+	if cr.series == nil {
+		writeJson(rw, http.StatusServiceUnavailable, Map{
+			"error": "stat series is not available",
+		})
+		return
+	}
+	query := req.URL.Query()
+	to := time.Now()
+	step := time.Hour
+	var err error
+	if v := query.Get("to"); v != "" {
+		if to, err = parseQueryTime(v); err != nil {
+			writeJson(rw, http.StatusBadRequest, Map{
+				"error":   "cannot parse to",
+				"message": err.Error(),
+			})
+			return
+		}
+	}
+	from := to.Add(-time.Hour * 24)
+	if v := query.Get("from"); v != "" {
+		if from, err = parseQueryTime(v); err != nil {
+			writeJson(rw, http.StatusBadRequest, Map{
+				"error":   "cannot parse from",
+				"message": err.Error(),
+			})
+			return
+		}
+	}
+	if v := query.Get("step"); v != "" {
+		if step, err = time.ParseDuration(v); err != nil {
+			writeJson(rw, http.StatusBadRequest, Map{
+				"error":   "cannot parse step",
+				"message": err.Error(),
+			})
+			return
+		}
+	}
+	buckets, err := cr.series.Query(from, to, step)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(err, errInvalidSeriesQuery) {
+			code = http.StatusBadRequest
+		}
+		writeJson(rw, code, Map{
+			"error":   "cannot query stat series",
+			"message": err.Error(),
+		})
+		return
+	}
+	writeJson(rw, http.StatusOK, Map{
+		"from":    from,
+		"to":      to,
+		"step":    step.Seconds(),
+		"buckets": buckets,
+	})
+}
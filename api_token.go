@@ -0,0 +1,150 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	jwtIssuer          = "go-openbmclapi"
+	apiHmacKeyFileName = "api_hmac.key"
+)
+
+var (
+	ErrDashboardAuthDisabled = errors.New("Dashboard login is not configured")
+	ErrInvalidCredentials    = errors.New("Username or password is incorrect")
+)
+
+// isBcryptHash reports whether the password is already hashed by bcrypt
+func isBcryptHash(password string) bool {
+	_, err := bcrypt.Cost(([]byte)(password))
+	return err == nil
+}
+
+func hashDashboardPassword(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword(([]byte)(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return (string)(hashed), nil
+}
+
+// loadAPIHmacKey reads the key used to sign the API tokens,
+// it will generate a new random key if the key file does not exist
+func loadAPIHmacKey(dataDir string) (key []byte, err error) {
+	keyPath := filepath.Join(dataDir, apiHmacKeyFileName)
+	buf, err := os.ReadFile(keyPath)
+	if err == nil {
+		if key, err = hex.DecodeString(strings.TrimSpace((string)(buf))); err == nil && len(key) >= 32 {
+			return
+		}
+		logWarnf("API hmac key %q is invalid, generating a new one", keyPath)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	key = make([]byte, 32)
+	if _, err = rand.Read(key); err != nil {
+		return
+	}
+	if err = writeFileAtomic(keyPath, 0600, func(w io.Writer) error {
+		_, err := io.WriteString(w, hex.EncodeToString(key))
+		return err
+	}); err != nil {
+		return
+	}
+	return
+}
+
+// verifyDashboardLogin checks the username and password against the config
+func verifyDashboardLogin(username, password string) error {
+	cfg := config().Dashboard
+	if cfg.Username == "" || cfg.Password == "" {
+		return ErrDashboardAuthDisabled
+	}
+	userOk := subtle.ConstantTimeCompare(([]byte)(username), ([]byte)(cfg.Username)) == 1
+	passErr := bcrypt.CompareHashAndPassword(([]byte)(cfg.Password), ([]byte)(password))
+	if !userOk || passErr != nil {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
+type dashboardClaims struct {
+	jwt.RegisteredClaims
+}
+
+func (cr *Cluster) generateDashboardToken(username string) (token string, expireAt time.Time, err error) {
+	var jti [16]byte
+	if _, err = rand.Read(jti[:]); err != nil {
+		return
+	}
+	now := time.Now()
+	expireAt = now.Add(config().Dashboard.TokenExpire.Dur())
+	claims := &dashboardClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        hex.EncodeToString(jti[:]),
+			Subject:   username,
+			Issuer:    jwtIssuer,
+			Audience:  jwt.ClaimStrings{cr.clusterId},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expireAt),
+		},
+	}
+	token, err = jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(cr.apiHmacKey)
+	return
+}
+
+func (cr *Cluster) verifyDashboardToken(token string) (username string, err error) {
+	if cr.apiHmacKey == nil {
+		return "", ErrDashboardAuthDisabled
+	}
+	var claims dashboardClaims
+	_, err = jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (any, error) {
+		return cr.apiHmacKey, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(jwtIssuer),
+		jwt.WithAudience(cr.clusterId),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
+	if err != nil {
+		return "", err
+	}
+	// the token should be invalid if the user was renamed
+	if claims.Subject != config().Dashboard.Username {
+		return "", fmt.Errorf("Unexpected token subject %q", claims.Subject)
+	}
+	return claims.Subject, nil
+}
@@ -0,0 +1,88 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"time"
+)
+
+func TestDashboardToken(t *testing.T) {
+	oldCfg := config()
+	defer setConfig(oldCfg)
+	cfg := *oldCfg
+
+	hashed, err := hashDashboardPassword("correct horse")
+	if err != nil {
+		t.Fatalf("Cannot hash password: %v", err)
+	}
+	if !isBcryptHash(hashed) {
+		t.Errorf("isBcryptHash(%q) returned false", hashed)
+	}
+	if isBcryptHash("correct horse") {
+		t.Errorf("Plain password is considered as bcrypt hash")
+	}
+	cfg.Dashboard.Username = "admin"
+	cfg.Dashboard.Password = hashed
+	cfg.Dashboard.TokenExpire = (YAMLDuration)(time.Hour)
+	setConfig(&cfg)
+
+	if err := verifyDashboardLogin("admin", "correct horse"); err != nil {
+		t.Errorf("Cannot login with correct password: %v", err)
+	}
+	if err := verifyDashboardLogin("admin", "wrong"); err != ErrInvalidCredentials {
+		t.Errorf("Login with wrong password returned %v", err)
+	}
+	if err := verifyDashboardLogin("root", "correct horse"); err != ErrInvalidCredentials {
+		t.Errorf("Login with wrong username returned %v", err)
+	}
+
+	cr := &Cluster{
+		clusterId:  "cluster-a",
+		apiHmacKey: []byte("0123456789abcdef0123456789abcdef"),
+	}
+	token, _, err := cr.generateDashboardToken("admin")
+	if err != nil {
+		t.Fatalf("Cannot generate token: %v", err)
+	}
+	if user, err := cr.verifyDashboardToken(token); err != nil || user != "admin" {
+		t.Errorf("verifyDashboardToken returned %q, %v", user, err)
+	}
+
+	other := &Cluster{
+		clusterId:  "cluster-b",
+		apiHmacKey: cr.apiHmacKey,
+	}
+	if _, err := other.verifyDashboardToken(token); err == nil {
+		t.Errorf("Token should not be accepted by other clusters")
+	}
+
+	expiredCfg := cfg
+	expiredCfg.Dashboard.TokenExpire = (YAMLDuration)(-time.Minute)
+	setConfig(&expiredCfg)
+	expired, _, err := cr.generateDashboardToken("admin")
+	if err != nil {
+		t.Fatalf("Cannot generate token: %v", err)
+	}
+	if _, err := cr.verifyDashboardToken(expired); err == nil {
+		t.Errorf("Expired token should not be accepted")
+	}
+}
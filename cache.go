@@ -20,6 +20,8 @@
 package main
 
 import (
+	"io"
+	"sync/atomic"
 	"time"
 
 	"github.com/gregjones/httpcache"
@@ -82,6 +84,50 @@ func (c *nsCache) Delete(key string) {
 	c.cache.Delete(c.ns + key)
 }
 
+// SwitchableCache forwards the operations to the current cache,
+// so the cache can be replaced without rebuilding its users
+type SwitchableCache struct {
+	cur atomic.Pointer[Cache]
+}
+
+func NewSwitchableCache(c Cache) *SwitchableCache {
+	sc := new(SwitchableCache)
+	sc.cur.Store(&c)
+	return sc
+}
+
+func (c *SwitchableCache) Current() Cache {
+	return *c.cur.Load()
+}
+
+// Switch replaces the current cache, and closes the old one if it's closable
+func (c *SwitchableCache) Switch(cache Cache) {
+	old := *c.cur.Swap(&cache)
+	if cl, ok := old.(io.Closer); ok {
+		cl.Close()
+	}
+}
+
+func (c *SwitchableCache) Set(key string, value string, opt CacheOpt) {
+	c.Current().Set(key, value, opt)
+}
+
+func (c *SwitchableCache) Get(key string) (value string, ok bool) {
+	return c.Current().Get(key)
+}
+
+func (c *SwitchableCache) SetBytes(key string, value []byte, opt CacheOpt) {
+	c.Current().SetBytes(key, value, opt)
+}
+
+func (c *SwitchableCache) GetBytes(key string) (value []byte, ok bool) {
+	return c.Current().GetBytes(key)
+}
+
+func (c *SwitchableCache) Delete(key string) {
+	c.Current().Delete(key)
+}
+
 type httpCacheWrapper struct {
 	c Cache
 }
@@ -63,6 +63,10 @@ func NewRedisCacheByClient(cli *redis.Client) *RedisCache {
 	}
 }
 
+func (c *RedisCache) Close() error {
+	return c.Client.Close()
+}
+
 func (c *RedisCache) Set(key string, value string, opt CacheOpt) {
 	ctx, cancel := context.WithTimeout(c.Context, time.Second*3)
 	defer cancel()
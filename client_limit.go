@@ -0,0 +1,277 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tokenBucket limits the bandwidth shared by all connections of a client,
+// it allows at most one second of burst
+type tokenBucket struct {
+	mux    sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int) *tokenBucket {
+	return &tokenBucket{
+		rate:   (float64)(rate),
+		tokens: (float64)(rate),
+		last:   time.Now(),
+	}
+}
+
+// take consumes n bytes, and returns how long the caller should wait before sending them
+func (b *tokenBucket) take(n int) time.Duration {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= (float64)(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return (time.Duration)(-b.tokens / b.rate * (float64)(time.Second))
+}
+
+// full reports whether the bucket has been refilled, the bucket is not needed anymore if it's not used
+func (b *tokenBucket) full(now time.Time) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.rate
+}
+
+// clientSweepInterval is the minimum interval to remove the idle clients
+const clientSweepInterval = time.Second * 10
+
+type clientState struct {
+	conns  int
+	bucket *tokenBucket
+}
+
+// ClientLimiter limits the concurrent connections and the bandwidth of each client IP and its subnet
+type ClientLimiter struct {
+	mux       sync.Mutex
+	clients   map[string]*clientState
+	lastSweep time.Time
+
+	rejected  atomic.Int64
+	throttled atomic.Int64
+}
+
+func NewClientLimiter() *ClientLimiter {
+	return &ClientLimiter{
+		clients: make(map[string]*clientState),
+	}
+}
+
+type ClientLimitStatus struct {
+	Clients   int   `json:"clients"`
+	Rejected  int64 `json:"rejected"`
+	Throttled int64 `json:"throttled"`
+}
+
+// Status returns the count of tracked clients and subnets, rejected requests and throttled writes
+func (l *ClientLimiter) Status() ClientLimitStatus {
+	l.mux.Lock()
+	clients := len(l.clients)
+	l.mux.Unlock()
+	return ClientLimitStatus{
+		Clients:   clients,
+		Rejected:  l.rejected.Load(),
+		Throttled: l.throttled.Load(),
+	}
+}
+
+// clientLimitKeys returns the keys of the client address and its subnet.
+// The subnet key will be empty if the address cannot be parsed
+func clientLimitKeys(addr string, cfg *ClientLimitConfig) (ipKey, subnetKey string) {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return "ip:" + addr, ""
+	}
+	ip = ip.Unmap()
+	bits := cfg.IPv6Prefix
+	if ip.Is4() {
+		bits = cfg.IPv4Prefix
+	}
+	ipKey = "ip:" + ip.String()
+	if prefix, err := ip.Prefix(bits); err == nil {
+		subnetKey = "net:" + prefix.String()
+	}
+	return
+}
+
+// acquire increases the connection counters of the keys,
+// it returns false without changing the counters if any of the limits is exceeded
+func (l *ClientLimiter) acquire(keys []string, maxConns []int, rates []int) (buckets []*tokenBucket, ok bool) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	for i, key := range keys {
+		if s := l.clients[key]; s != nil && maxConns[i] > 0 && s.conns >= maxConns[i] {
+			return nil, false
+		}
+	}
+	for i, key := range keys {
+		s := l.clients[key]
+		if s == nil {
+			s = new(clientState)
+			if rates[i] > 0 {
+				s.bucket = newTokenBucket(rates[i])
+			}
+			l.clients[key] = s
+		}
+		s.conns++
+		if s.bucket != nil {
+			buckets = append(buckets, s.bucket)
+		}
+	}
+	return buckets, true
+}
+
+func (l *ClientLimiter) release(keys []string) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	for _, key := range keys {
+		if s := l.clients[key]; s != nil {
+			s.conns--
+			// the bucket is kept until it's refilled,
+			// otherwise the client will get a full burst again on its next request
+			if s.conns <= 0 && s.bucket == nil {
+				delete(l.clients, key)
+			}
+		}
+	}
+	if now := time.Now(); now.Sub(l.lastSweep) >= clientSweepInterval {
+		l.lastSweep = now
+		l.sweepLocked(now)
+	}
+}
+
+// sweepLocked removes the idle clients which buckets are full
+func (l *ClientLimiter) sweepLocked(now time.Time) {
+	for key, s := range l.clients {
+		if s.conns <= 0 && (s.bucket == nil || s.bucket.full(now)) {
+			delete(l.clients, key)
+		}
+	}
+}
+
+// Limit checks the limits for the client address.
+// If the client is over the connection limits, a 429 response will be written and ok will be false.
+// Otherwise the returned ResponseWriter should be used to send the response, and release must be called after that.
+func (l *ClientLimiter) Limit(rw http.ResponseWriter, req *http.Request, addr string) (w http.ResponseWriter, release func(), ok bool) {
+	cfg := &config().ClientLimit
+	ipKey, subnetKey := clientLimitKeys(addr, cfg)
+	keys := []string{ipKey}
+	maxConns := []int{cfg.MaxConn}
+	rates := []int{cfg.UploadRate * 1024}
+	if subnetKey != "" {
+		keys = append(keys, subnetKey)
+		maxConns = append(maxConns, cfg.SubnetMaxConn)
+		rates = append(rates, cfg.SubnetUploadRate*1024)
+	}
+	buckets, ok := l.acquire(keys, maxConns, rates)
+	if !ok {
+		l.rejected.Add(1)
+		logDebugf("Rejected request from %s: too many connections", addr)
+		if cfg.RetryAfter > 0 {
+			rw.Header().Set("Retry-After", strconv.Itoa(cfg.RetryAfter))
+		}
+		http.Error(rw, cfg.Message, http.StatusTooManyRequests)
+		return nil, nil, false
+	}
+	release = func() { l.release(keys) }
+	if len(buckets) == 0 {
+		return rw, release, true
+	}
+	w = &rateLimitedResponseWriter{
+		ResponseWriter: rw,
+		ctx:            req.Context(),
+		buckets:        buckets,
+		limiter:        l,
+	}
+	return w, release, true
+}
+
+type rateLimitedResponseWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	buckets []*tokenBucket
+	limiter *ClientLimiter
+}
+
+const rateLimitedChunkSize = 16 * 1024
+
+func (w *rateLimitedResponseWriter) Write(buf []byte) (n int, err error) {
+	for len(buf) > 0 {
+		chunk := buf
+		if len(chunk) > rateLimitedChunkSize {
+			chunk = chunk[:rateLimitedChunkSize]
+		}
+		var wait time.Duration
+		for _, b := range w.buckets {
+			if d := b.take(len(chunk)); d > wait {
+				wait = d
+			}
+		}
+		if wait > 0 {
+			w.limiter.throttled.Add(1)
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-w.ctx.Done():
+				timer.Stop()
+				return n, w.ctx.Err()
+			}
+		}
+		var m int
+		m, err = w.ResponseWriter.Write(chunk)
+		n += m
+		if err != nil {
+			return
+		}
+		buf = buf[len(chunk):]
+	}
+	return
+}
+
+func (w *rateLimitedResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *rateLimitedResponseWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
@@ -0,0 +1,142 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+func TestClientLimitKeys(t *testing.T) {
+	cfg := &ClientLimitConfig{IPv4Prefix: 24, IPv6Prefix: 64}
+	var tests = []struct {
+		addr   string
+		ip     string
+		subnet string
+	}{
+		{"192.0.2.33", "ip:192.0.2.33", "net:192.0.2.0/24"},
+		{"::ffff:192.0.2.33", "ip:192.0.2.33", "net:192.0.2.0/24"},
+		{"2001:db8:1:2:3::4", "ip:2001:db8:1:2:3::4", "net:2001:db8:1:2::/64"},
+		{"unknown", "ip:unknown", ""},
+	}
+	for _, tt := range tests {
+		ip, subnet := clientLimitKeys(tt.addr, cfg)
+		if ip != tt.ip || subnet != tt.subnet {
+			t.Errorf("clientLimitKeys(%q) returned %q, %q, expect %q, %q", tt.addr, ip, subnet, tt.ip, tt.subnet)
+		}
+	}
+}
+
+func TestClientLimiter(t *testing.T) {
+	oldCfg := config()
+	defer setConfig(oldCfg)
+	cfg := *oldCfg
+	cfg.ClientLimit = ClientLimitConfig{
+		Enable:        true,
+		MaxConn:       2,
+		SubnetMaxConn: 3,
+		IPv4Prefix:    24,
+		IPv6Prefix:    64,
+		RetryAfter:    5,
+		Message:       "slow down",
+	}
+	setConfig(&cfg)
+
+	l := NewClientLimiter()
+	req := httptest.NewRequest(http.MethodGet, "/download/00", nil)
+	var releases []func()
+	acquire := func(addr string) bool {
+		rw := httptest.NewRecorder()
+		_, release, ok := l.Limit(rw, req, addr)
+		if ok {
+			releases = append(releases, release)
+		} else if rw.Code != http.StatusTooManyRequests || rw.Header().Get("Retry-After") != "5" {
+			t.Errorf("Unexpected rejected response: %d %v", rw.Code, rw.Header())
+		}
+		return ok
+	}
+	if !acquire("192.0.2.1") || !acquire("192.0.2.1") {
+		t.Fatalf("First two connections should be accepted")
+	}
+	if acquire("192.0.2.1") {
+		t.Errorf("Third connection from the same IP should be rejected")
+	}
+	if !acquire("192.0.2.2") {
+		t.Errorf("Connection from another IP should be accepted")
+	}
+	if acquire("192.0.2.3") {
+		t.Errorf("Fourth connection from the same subnet should be rejected")
+	}
+	if !acquire("198.51.100.1") {
+		t.Errorf("Connection from another subnet should be accepted")
+	}
+	for _, release := range releases {
+		release()
+	}
+	if st := l.Status(); st.Clients != 0 || st.Rejected != 2 {
+		t.Errorf("Unexpected status after release: %#v", st)
+	}
+}
+
+func TestClientLimiterKeepBucket(t *testing.T) {
+	oldCfg := config()
+	defer setConfig(oldCfg)
+	cfg := *oldCfg
+	cfg.ClientLimit = ClientLimitConfig{
+		Enable:     true,
+		UploadRate: 1,
+		IPv4Prefix: 24,
+		IPv6Prefix: 64,
+	}
+	setConfig(&cfg)
+
+	l := NewClientLimiter()
+	req := httptest.NewRequest(http.MethodGet, "/download/00", nil)
+	_, release, ok := l.Limit(httptest.NewRecorder(), req, "192.0.2.1")
+	if !ok {
+		t.Fatalf("Connection should be accepted")
+	}
+	bucket := l.clients["ip:192.0.2.1"].bucket
+	bucket.take(1024)
+	release()
+
+	// the drained bucket must be reused by the next request
+	_, release, ok = l.Limit(httptest.NewRecorder(), req, "192.0.2.1")
+	if !ok {
+		t.Fatalf("Connection should be accepted")
+	}
+	if s := l.clients["ip:192.0.2.1"]; s == nil || s.bucket != bucket {
+		t.Errorf("Bucket is not kept for the idle client")
+	}
+	release()
+
+	l.mux.Lock()
+	l.sweepLocked(time.Now())
+	kept := len(l.clients)
+	l.sweepLocked(time.Now().Add(time.Hour))
+	left := len(l.clients)
+	l.mux.Unlock()
+	if kept != 1 || left != 0 {
+		t.Errorf("Expect the client kept before refilled and none after, got %d and %d", kept, left)
+	}
+}
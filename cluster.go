@@ -24,10 +24,13 @@ import (
 	"compress/zlib"
 	"context"
 	"crypto"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"net"
 	"net/http"
@@ -37,6 +40,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -46,7 +50,6 @@ import (
 	"github.com/LiterMC/socket.io/engine.io"
 	"github.com/gregjones/httpcache"
 	"github.com/hamba/avro/v2"
-	"github.com/klauspost/compress/zstd"
 	"github.com/vbauerster/mpb/v8"
 	"github.com/vbauerster/mpb/v8/decor"
 )
@@ -59,33 +62,50 @@ type Cluster struct {
 	prefix        string
 	byoc          bool
 
-	dataDir            string
-	maxConn            int
-	storageOpts        []StorageOption
-	storages           []Storage
-	storageWeights     []uint
-	storageTotalWeight uint
-	cache              Cache
-	httpCache          Cache
+	dataDir   string
+	maxConn   int
+	cache     Cache
+	httpCache Cache
 
-	stats  Stats
-	hits   atomic.Int32
-	hbts   atomic.Int64
-	issync atomic.Bool
+	// the storages may be shared with other clusters in the same process
+	*SharedStorages
+
+	// ctx is the context that the cluster is running in
+	ctx context.Context
+
+	stats     Stats
+	analytics AccessAnalytics
+	series    *StatSeries
+	hits      atomic.Int32
+	hbts      atomic.Int64
+	issync    atomic.Bool
+	lastSync  atomic.Pointer[SyncResult]
+
+	// transfers is the number of the downloads and measures in progress
+	transfers atomic.Int64
+	draining  atomic.Bool
+	drainMux  sync.Mutex
+	drain     *drainState
 
 	mux             sync.RWMutex
 	enabled         atomic.Bool
 	disabled        chan struct{}
 	waitEnable      []chan struct{}
 	shouldEnable    atomic.Bool
+	servingOffline  atomic.Bool
 	reconnectCount  int
 	socket          *socket.Socket
 	cancelKeepalive context.CancelFunc
 	downloadMux     sync.Mutex
 	downloading     map[string]chan error
+	partials        map[string]struct{}
 	fileMux         sync.RWMutex
 	fileset         map[string]int64
+	fileListMux     sync.Mutex
+	fileList        map[string]FileInfo
+	lastModified    int64
 	authToken       *ClusterToken
+	apiHmacKey      []byte
 
 	client   *http.Client
 	bufSlots *BufSlots
@@ -97,11 +117,11 @@ type Cluster struct {
 func NewCluster(
 	ctx context.Context,
 	prefix string,
-	baseDir string,
+	dataDir string,
 	host string, publicPort uint16,
 	clusterId string, clusterSecret string,
 	byoc bool, dialer *net.Dialer,
-	storageOpts []StorageOption,
+	storages *SharedStorages,
 	cache Cache,
 ) (cr *Cluster) {
 	transport := http.DefaultTransport
@@ -119,6 +139,8 @@ func NewCluster(
 	}
 
 	cr = &Cluster{
+		ctx: ctx,
+
 		host:          host,
 		publicPort:    publicPort,
 		clusterId:     clusterId,
@@ -126,14 +148,15 @@ func NewCluster(
 		prefix:        prefix,
 		byoc:          byoc,
 
-		dataDir:     filepath.Join(baseDir, "data"),
-		maxConn:     config.DownloadMaxConn,
-		storageOpts: storageOpts,
-		cache:       cache,
+		dataDir:        dataDir,
+		maxConn:        config().DownloadMaxConn,
+		cache:          cache,
+		SharedStorages: storages,
 
 		disabled: make(chan struct{}, 0),
 
 		downloading: make(map[string]chan error),
+		partials:    make(map[string]struct{}),
 
 		client: &http.Client{
 			Transport: transport,
@@ -143,39 +166,64 @@ func NewCluster(
 
 	cr.bufSlots = NewBufSlots(cr.maxConn)
 
-	{
-		var (
-			n   uint = 0
-			wgs      = make([]uint, len(storageOpts))
-			sts      = make([]Storage, len(storageOpts))
-		)
-		for i, s := range storageOpts {
-			sts[i] = NewStorage(s)
-			wgs[i] = s.Weight
-			n += s.Weight
+	metricEnabled.With(clusterId).SetFunc(func() float64 {
+		if cr.enabled.Load() {
+			return 1
 		}
-		cr.storages = sts
-		cr.storageWeights = wgs
-		cr.storageTotalWeight = n
-	}
+		return 0
+	})
+	storages.addCluster(cr)
 	return
 }
 
 func (cr *Cluster) Init(ctx context.Context) error {
-	// Init storages
-	vctx := context.WithValue(ctx, ClusterCacheCtxKey, cr.cache)
-	for _, s := range cr.storages {
-		s.Init(vctx)
-	}
+	// Init the shared storages, only the first cluster will do it
+	cr.SharedStorages.init(ctx, cr)
 	// create data folder
 	os.MkdirAll(cr.dataDir, 0755)
+	// load the key for signing dashboard tokens
+	if key, err := loadAPIHmacKey(cr.dataDir); err != nil {
+		logErrorf("Could not load API hmac key: %v", err)
+	} else {
+		cr.apiHmacKey = key
+	}
+	// remove the stale partial downloads
+	cr.cleanPartialDownloads()
 	// read old stats
 	if err := cr.stats.Load(cr.dataDir); err != nil {
 		logErrorf("Could not load stats: %v", err)
 	}
+	if err := cr.analytics.Load(cr.dataDir); err != nil {
+		logErrorf("Could not load access analytics: %v", err)
+	}
+	if series, err := NewStatSeries(filepath.Join(cr.dataDir, seriesDirName)); err != nil {
+		logErrorf("Could not open stat series: %v", err)
+	} else {
+		cr.series = series
+	}
+	return nil
+}
+
+// putFile creates the file in the storage and records it in the storage's file index
+func (cr *Cluster) putFile(s Storage, hash string, size int64, r io.ReadSeeker) error {
+	if err := s.Create(hash, r); err != nil {
+		return err
+	}
+	if err := cr.fileIndexes[s].Put(hash, size); err != nil {
+		logErrorf("Could not update file index for %s: %v", s.String(), err)
+	}
 	return nil
 }
 
+// removeFile removes the file from the storage and the storage's file index
+func (cr *Cluster) removeFile(s Storage, hash string) error {
+	// remove the record first, so the index will never contain a file that does not exist
+	if err := cr.fileIndexes[s].Delete(hash); err != nil {
+		logErrorf("Could not update file index for %s: %v", s.String(), err)
+	}
+	return s.Remove(hash)
+}
+
 func (cr *Cluster) allocBuf(ctx context.Context) (slotId int, buf []byte, free func()) {
 	return cr.bufSlots.Alloc(ctx)
 }
@@ -205,7 +253,7 @@ func (cr *Cluster) Connect(ctx context.Context) bool {
 
 	cr.reconnectCount = 0
 
-	if config.Advanced.DebugLog {
+	if config().Advanced.DebugLog {
 		engio.OnRecv(func(_ *engine.Socket, data []byte) {
 			logDebugf("Engine.IO recv: %q", (string)(data))
 		})
@@ -217,7 +265,7 @@ func (cr *Cluster) Connect(ctx context.Context) bool {
 		logInfo("Engine.IO connected")
 	})
 	engio.OnDisconnect(func(_ *engine.Socket, err error) {
-		if config.Advanced.ExitWhenDisconnected {
+		if config().Advanced.ExitWhenDisconnected {
 			if cr.shouldEnable.Load() {
 				logErrorf("Cluster disconnected from remote; exit.")
 				os.Exit(0x08)
@@ -269,10 +317,13 @@ func (cr *Cluster) Connect(ctx context.Context) bool {
 	logInfof("Dialing %s", engio.URL().String())
 	if err := engio.Dial(ctx); err != nil {
 		logErrorf("Dial error: %v", err)
+		cr.socket = nil
 		return false
 	}
 	if err := cr.socket.Connect(""); err != nil {
 		logErrorf("Open namespace error: %v", err)
+		go cr.socket.Close()
+		cr.socket = nil
 		return false
 	}
 	return true
@@ -299,14 +350,20 @@ func (cr *Cluster) Enable(ctx context.Context) (err error) {
 		logDebug("Extra enable")
 		return
 	}
+	if cr.draining.Load() {
+		logDebug("Ignored enable since the cluster is draining")
+		return
+	}
 
-	if !cr.socket.IO().Connected() && config.Advanced.ExitWhenDisconnected {
+	if !cr.socket.IO().Connected() && config().Advanced.ExitWhenDisconnected {
 		logErrorf("Cluster disconnected from remote; exit.")
 		os.Exit(0x08)
 		return
 	}
 
 	cr.shouldEnable.Store(true)
+	// the cached files were served before the cluster is enabled
+	cr.servingOffline.Store(false)
 
 	logInfo("Sending enable packet")
 	resCh, err := cr.socket.EmitWithAck("enable", Map{
@@ -371,6 +428,11 @@ func (cr *Cluster) Enable(ctx context.Context) (err error) {
 func (cr *Cluster) KeepAlive(ctx context.Context) (ok bool) {
 	hits, hbts := cr.hits.Swap(0), cr.hbts.Swap(0)
 	cr.stats.AddHits(hits, hbts)
+	if cr.series != nil && (hits != 0 || hbts != 0) {
+		if err := cr.series.Append(time.Now(), (int64)(hits), hbts); err != nil {
+			logError("Error when appending stat series:", err)
+		}
+	}
 	resCh, err := cr.socket.EmitWithAck("keep-alive", Map{
 		"time":  time.Now().UTC().Format("2006-01-02T15:04:05Z"),
 		"hits":  hits,
@@ -379,21 +441,28 @@ func (cr *Cluster) KeepAlive(ctx context.Context) (ok bool) {
 	if e := cr.stats.Save(cr.dataDir); e != nil {
 		logError("Error when saving status:", e)
 	}
+	if e := cr.analytics.Save(cr.dataDir); e != nil {
+		logError("Error when saving access analytics:", e)
+	}
 	if err != nil {
 		logError("Error when keep-alive:", err)
+		metricKeepAlive.With(cr.clusterId, "failure").Inc()
 		return false
 	}
 	var data []any
 	select {
 	case <-ctx.Done():
+		metricKeepAlive.With(cr.clusterId, "failure").Inc()
 		return false
 	case data = <-resCh:
 	}
 	if ero := data[0]; len(data) <= 1 || ero != nil {
 		logError("Keep-alive failed:", ero)
+		metricKeepAlive.With(cr.clusterId, "failure").Inc()
 		return false
 	}
 	logInfo("Keep-alive success:", hits, bytesToUnit((float64)(hbts)), data[1])
+	metricKeepAlive.With(cr.clusterId, "success").Inc()
 	return true
 }
 
@@ -432,7 +501,7 @@ func (cr *Cluster) Disable(ctx context.Context) (ok bool) {
 	}
 	logInfo("Disabling cluster")
 	if resCh, err := cr.socket.EmitWithAck("disable"); err == nil {
-		tctx, cancel := context.WithTimeout(ctx, time.Second*(time.Duration)(config.Advanced.KeepaliveTimeout))
+		tctx, cancel := context.WithTimeout(ctx, time.Second*(time.Duration)(config().Advanced.KeepaliveTimeout))
 		select {
 		case <-tctx.Done():
 			cancel()
@@ -477,29 +546,27 @@ type CertKeyPair struct {
 	Key  string `json:"key"`
 }
 
-func (pair *CertKeyPair) SaveAsFile() (cert, key string, err error) {
-	const pemBase = "pems"
-	if _, err = os.Stat(pemBase); err != nil {
-		if !errors.Is(err, os.ErrNotExist) {
-			return
-		}
-		if err = os.Mkdir(pemBase, 0700); err != nil {
-			return
-		}
-	}
-	cert, key = filepath.Join(pemBase, "cert.pem"), filepath.Join(pemBase, "key.pem")
-	if err = os.WriteFile(cert, ([]byte)(pair.Cert), 0600); err != nil {
-		return
+// Certificate parses the certificate key pair
+func (pair *CertKeyPair) Certificate() (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(([]byte)(pair.Cert), ([]byte)(pair.Key))
+	if err != nil {
+		return nil, err
 	}
-	if err = os.WriteFile(key, ([]byte)(pair.Key), 0600); err != nil {
-		return
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
 	}
-	return
+	return &cert, nil
 }
 
 func (cr *Cluster) RequestCert(ctx context.Context) (ckp *CertKeyPair, err error) {
+	cr.mux.RLock()
+	sock := cr.socket
+	cr.mux.RUnlock()
+	if sock == nil {
+		return nil, errors.New("Socket is not connected")
+	}
 	logInfo("Requesting certificates, please wait ...")
-	resCh, err := cr.socket.EmitWithAck("request-cert")
+	resCh, err := sock.EmitWithAck("request-cert")
 	if err != nil {
 		return
 	}
@@ -566,10 +633,27 @@ type FileInfo struct {
 	Path string `json:"path" avro:"path"`
 	Hash string `json:"hash" avro:"hash"`
 	Size int64  `json:"size" avro:"size"`
+	// Mtime is the last modified time in unix milliseconds, it's 0 if the center server does not provide it
+	Mtime int64 `json:"mtime" avro:"mtime"`
 }
 
 // from <https://github.com/bangbang93/openbmclapi/blob/master/src/cluster.ts>
 var fileListSchema = avro.MustParse(`{
+	"type": "array",
+	"items": {
+		"type": "record",
+		"name": "fileinfo",
+		"fields": [
+			{"name": "path", "type": "string"},
+			{"name": "hash", "type": "string"},
+			{"name": "size", "type": "long"},
+			{"name": "mtime", "type": "long"}
+		]
+	}
+}`)
+
+// legacyFileListSchema is the file list schema without the modified time
+var legacyFileListSchema = avro.MustParse(`{
 	"type": "array",
 	"items": {
 		"type": "record",
@@ -582,8 +666,16 @@ var fileListSchema = avro.MustParse(`{
 	}
 }`)
 
-func (cr *Cluster) GetFileList(ctx context.Context) (files []FileInfo, err error) {
-	req, err := cr.makeReqWithAuth(ctx, http.MethodGet, "/openbmclapi/files", nil)
+// GetFileList fetches the files changed after lastModified (unix milliseconds),
+// or all the files if lastModified is 0. It returns nil if no file is changed
+func (cr *Cluster) GetFileList(ctx context.Context, lastModified int64) (files []FileInfo, err error) {
+	var query url.Values
+	if lastModified > 0 {
+		query = url.Values{
+			"lastModified": {strconv.FormatInt(lastModified, 10)},
+		}
+	}
+	req, err := cr.makeReqWithAuth(ctx, http.MethodGet, "/openbmclapi/files", query)
 	if err != nil {
 		return
 	}
@@ -592,18 +684,20 @@ func (cr *Cluster) GetFileList(ctx context.Context) (files []FileInfo, err error
 		return
 	}
 	defer res.Body.Close()
+	if res.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
 	if res.StatusCode != http.StatusOK {
 		data, _ := io.ReadAll(res.Body)
 		err = fmt.Errorf("Unexpected status code: %d %s Body:\n\t%s", res.StatusCode, res.Status, (string)(data))
 		return
 	}
-	logDebug("Parsing filelist body ...")
-	zr, err := zstd.NewReader(res.Body)
+	body, err := io.ReadAll(res.Body)
 	if err != nil {
 		return
 	}
-	defer zr.Close()
-	if err = avro.NewDecoderForSchema(fileListSchema, zr).Decode(&files); err != nil {
+	logDebug("Parsing filelist body ...")
+	if files, err = decodeFileList(body); err != nil {
 		return
 	}
 	return
@@ -645,26 +739,80 @@ type syncStats struct {
 	lastInc  atomic.Int64
 }
 
+// SyncResult is the summary of a finished sync task
+type SyncResult struct {
+	StartAt time.Time `json:"startAt"`
+	// Duration is the time used by the whole sync in milliseconds
+	Duration int64  `json:"duration"`
+	Heavy    bool   `json:"heavy"`
+	Total    int    `json:"total"`
+	Missing  int    `json:"missing"`
+	OK       int    `json:"ok"`
+	Failed   int    `json:"failed"`
+	Error    string `json:"error,omitempty"`
+}
+
+// LastSyncResult returns the result of the last finished sync, or nil if there is none
+func (cr *Cluster) LastSyncResult() *SyncResult {
+	return cr.lastSync.Load()
+}
+
 func (cr *Cluster) SyncFiles(ctx context.Context, files []FileInfo, heavyCheck bool) bool {
+	return cr.syncFileList(ctx, files, heavyCheck, false)
+}
+
+// SyncFileDelta synchronizes the files changed since the last sync.
+// The files are added to the fileset, and the other files are kept
+func (cr *Cluster) SyncFileDelta(ctx context.Context, files []FileInfo) bool {
+	return cr.syncFileList(ctx, files, false, true)
+}
+
+func (cr *Cluster) syncFileList(ctx context.Context, files []FileInfo, heavyCheck bool, delta bool) bool {
 	logInfo("Preparing to sync files...")
 	if !cr.issync.CompareAndSwap(false, true) {
 		logWarn("Another sync task is running!")
 		return false
 	}
+	// the storages may be synchronizing by another cluster, wait for it
+	cr.syncMux.Lock()
+	defer cr.syncMux.Unlock()
 
+	result := &SyncResult{
+		StartAt: time.Now(),
+		Heavy:   heavyCheck,
+		Total:   len(files),
+	}
 	sort.Slice(files, func(i, j int) bool { return files[i].Hash < files[j].Hash })
-	cr.syncFiles(ctx, files, heavyCheck)
-
-	fileset := make(map[string]int64, len(files))
-	for _, f := range files {
-		fileset[f.Hash] = f.Size
+	if err := cr.syncFiles(ctx, files, heavyCheck, result); err != nil {
+		result.Error = err.Error()
+	}
+	result.Duration = time.Since(result.StartAt).Milliseconds()
+	cr.lastSync.Store(result)
+	for s, idx := range cr.fileIndexes {
+		if err := idx.Save(); err != nil {
+			logErrorf("Could not save file index for %s: %v", s.String(), err)
+		}
 	}
+
 	cr.fileMux.Lock()
-	cr.fileset = fileset
+	if delta && cr.fileset != nil {
+		for _, f := range files {
+			cr.fileset[f.Hash] = f.Size
+		}
+	} else {
+		fileset := make(map[string]int64, len(files))
+		for _, f := range files {
+			fileset[f.Hash] = f.Size
+		}
+		cr.fileset = fileset
+	}
 	cr.issync.Store(false)
 	cr.fileMux.Unlock()
 
-	go cr.gc()
+	// the removed files are not included in the delta, so they are collected after the full syncs only
+	if !delta {
+		go cr.gc()
+	}
 
 	return true
 }
@@ -744,11 +892,16 @@ func (cr *Cluster) checkFileFor(
 
 	bar.SetTotal(0x100, false)
 
-	sizeMap := make(map[string]int64, len(files))
-	{
+	index := cr.fileIndexes[storage]
+	var sizeMap map[string]int64
+	if !heavy && index.Ready() {
+		logInfof("Using file index for %s, %d files recorded", storage.String(), index.Len())
+		sizeMap = index.Sizes()
+	} else {
+		sizeMap = make(map[string]int64, len(files))
 		start := time.Now()
 		var checkedMp [256]bool
-		storage.WalkDir(func(hash string, size int64) error {
+		err := storage.WalkDir(func(hash string, size int64) error {
 			if n := HexTo256(hash); !checkedMp[n] {
 				checkedMp[n] = true
 				now := time.Now()
@@ -758,6 +911,13 @@ func (cr *Cluster) checkFileFor(
 			sizeMap[hash] = size
 			return nil
 		})
+		if err != nil {
+			logErrorf("Could not walk storage %s: %v", storage.String(), err)
+		} else if index != nil {
+			if err := index.Rebuild(sizeMap); err != nil {
+				logErrorf("Could not rebuild file index for %s: %v", storage.String(), err)
+			}
+		}
 	}
 
 	bar.SetCurrent(0)
@@ -776,7 +936,8 @@ func (cr *Cluster) checkFileFor(
 			logDebugf("Skipped empty file %s", hash)
 		} else if size, ok := sizeMap[hash]; ok {
 			if size != f.Size {
-				logWarnf("Found modified file: size of %q is %d, expect %d", hash, size, f.Size)
+				logWarnfWith(LogFields{"hash": hash, "storage": cr.getStorageId(storage), "size": size, "expect_size": f.Size},
+					"Found modified file: size of %q is %d, expect %d", hash, size, f.Size)
 				addMissing(f)
 			} else if heavy {
 				hashMethod, err := getHashMethod(len(hash))
@@ -800,9 +961,11 @@ func (cr *Cluster) checkFileFor(
 							if err != nil {
 								logErrorf("Could not calculate hash for %s: %v", hash, err)
 							} else if hs := hex.EncodeToString(hw.Sum(buf[:0])); hs != hash {
-								logWarnf("Found modified file: hash of %s became %s", hash, hs)
+								logWarnfWith(LogFields{"hash": hash, "storage": cr.getStorageId(storage), "actual_hash": hs},
+									"Found modified file: hash of %s became %s", hash, hs)
 							} else {
 								miss = false
+								index.SetVerified(hash)
 							}
 						}
 						if miss {
@@ -825,11 +988,12 @@ func (cr *Cluster) checkFileFor(
 	checkingHashMux.Unlock()
 
 	bar.SetTotal(-1, true)
-	logInfof("File check finished for %s, missing %d files", storage.String(), missingCount.Load())
+	logInfofWith(LogFields{"storage": cr.getStorageId(storage), "missing": missingCount.Load()},
+		"File check finished for %s, missing %d files", storage.String(), missingCount.Load())
 	return
 }
 
-func (cr *Cluster) syncFiles(ctx context.Context, files []FileInfo, heavyCheck bool) error {
+func (cr *Cluster) syncFiles(ctx context.Context, files []FileInfo, heavyCheck bool, result *SyncResult) error {
 	pg := mpb.New(mpb.WithAutoRefresh(), mpb.WithWidth(140))
 	setLogOutput(pg)
 	defer setLogOutput(nil)
@@ -858,6 +1022,7 @@ func (cr *Cluster) syncFiles(ctx context.Context, files []FileInfo, heavyCheck b
 	}
 
 	totalFiles := len(missingMap.m)
+	result.Missing = totalFiles
 	if totalFiles == 0 {
 		logInfo("All files was synchronized")
 		return nil
@@ -877,12 +1042,16 @@ func (cr *Cluster) syncFiles(ctx context.Context, files []FileInfo, heavyCheck b
 
 	var stats syncStats
 	stats.pg = pg
-	stats.noOpen = config.Advanced.NoOpen || syncCfg.Source == "center"
+	stats.noOpen = config().Advanced.NoOpen || syncCfg.Source == "center"
 	stats.slots = NewBufSlots(syncCfg.Concurrency)
 	stats.totalFiles = totalFiles
 	for _, f := range missing {
 		stats.totalSize += f.Size
 	}
+	defer func() {
+		result.OK = (int)(stats.okCount.Load())
+		result.Failed = (int)(stats.failCount.Load())
+	}()
 
 	var barUnit decor.SizeB1024
 	stats.lastInc.Store(time.Now().UnixNano())
@@ -905,7 +1074,14 @@ func (cr *Cluster) syncFiles(ctx context.Context, files []FileInfo, heavyCheck b
 		),
 	)
 
-	logInfof("Starting sync files, count: %d, total: %s", totalFiles, bytesToUnit((float64)(stats.totalSize)))
+	metricSyncFiles.With("total").Set((float64)(stats.totalFiles))
+	metricSyncFiles.With("ok").SetFunc(func() float64 { return (float64)(stats.okCount.Load()) })
+	metricSyncFiles.With("failed").SetFunc(func() float64 { return (float64)(stats.failCount.Load()) })
+	metricSyncBytes.With("total").Set((float64)(stats.totalSize))
+	metricSyncBytes.With("downloaded").SetFunc(func() float64 { return (float64)(stats.totalBar.Current()) })
+
+	logInfofWith(LogFields{"files": totalFiles, "bytes": stats.totalSize},
+		"Starting sync files, count: %d, total: %s", totalFiles, bytesToUnit((float64)(stats.totalSize)))
 	start := time.Now()
 
 	for _, f := range missing {
@@ -943,9 +1119,10 @@ func (cr *Cluster) syncFiles(ctx context.Context, files []FileInfo, heavyCheck b
 							logErrorf("Could not seek file %q to start: %v", path, err)
 							continue
 						}
-						err := target.Create(f.Hash, srcFd)
+						err := cr.putFile(target, f.Hash, f.Size, srcFd)
 						if err != nil {
-							logErrorf("Could not create %s/%s: %v", target.String(), f.Hash, err)
+							logErrorfWith(LogFields{"hash": f.Hash, "storage": cr.getStorageId(target), "error": err},
+								"Could not create %s/%s: %v", target.String(), f.Hash, err)
 							continue
 						}
 					}
@@ -965,27 +1142,47 @@ func (cr *Cluster) syncFiles(ctx context.Context, files []FileInfo, heavyCheck b
 	}
 
 	use := time.Since(start)
+	metricSyncDuration.With().Set(use.Seconds())
 	pg.Wait()
 
-	logInfof("All files was synchronized, use time: %v, %s/s", use, bytesToUnit((float64)(stats.totalSize)/use.Seconds()))
+	logInfofWith(LogFields{"files": totalFiles, "ok": stats.okCount.Load(), "failed": stats.failCount.Load(), "bytes": stats.totalSize, "duration": use},
+		"All files was synchronized, use time: %v, %s/s", use, bytesToUnit((float64)(stats.totalSize)/use.Seconds()))
 	return nil
 }
 
 func (cr *Cluster) gc() {
+	if !cr.filesetsReady() {
+		logWarn("Skipping garbage collector since some clusters have not got their file lists yet")
+		return
+	}
+	if !cr.isgc.CompareAndSwap(false, true) {
+		logWarn("Another garbage collector is running!")
+		return
+	}
+	defer cr.isgc.Store(false)
 	for _, s := range cr.storages {
 		cr.gcFor(s)
 	}
 }
 
 func (cr *Cluster) gcFor(s Storage) {
+	// every file would be outdated without the file lists
+	if !cr.filesetsReady() {
+		logWarn("Skipping garbage collector for", s.String(), "since some clusters have not got their file lists yet")
+		return
+	}
 	logInfo("Starting garbage collector for", s.String())
-	err := s.WalkDir(func(hash string, _ int64) error {
-		if cr.issync.Load() {
+	walk := s.WalkDir
+	if idx := cr.fileIndexes[s]; idx.Ready() {
+		walk = idx.Walk
+	}
+	err := walk(func(hash string, _ int64) error {
+		if cr.isSyncing() {
 			return context.Canceled
 		}
-		if _, ok := cr.CachedFileSize(hash); !ok {
-			logInfo("Found outdated file:", hash)
-			s.Remove(hash)
+		if !cr.hasFile(hash) {
+			logInfofWith(LogFields{"hash": hash, "storage": cr.getStorageId(s)}, "Found outdated file: %s", hash)
+			cr.removeFile(s, hash)
 		}
 		return nil
 	})
@@ -1046,6 +1243,7 @@ func (cr *Cluster) fetchFile(ctx context.Context, stats *syncStats, f FileInfo)
 
 		noOpen := stats.noOpen
 		interval := time.Second
+		start := time.Now()
 		for {
 			bar.SetCurrent(0)
 			hashMethod, err := getHashMethod(len(f.Hash))
@@ -1056,7 +1254,8 @@ func (cr *Cluster) fetchFile(ctx context.Context, stats *syncStats, f FileInfo)
 				}); err == nil {
 					pathRes <- path
 					stats.okCount.Add(1)
-					logInfof("Downloaded %s [%s] %.2f%%", f.Path,
+					logInfofWith(LogFields{"hash": f.Hash, "path": f.Path, "bytes": f.Size, "tries": trycount.Load(), "duration": time.Since(start)},
+						"Downloaded %s [%s] %.2f%%", f.Path,
 						bytesToUnit((float64)(f.Size)),
 						(float64)(stats.totalBar.Current())/(float64)(stats.totalSize)*100)
 					return
@@ -1064,7 +1263,8 @@ func (cr *Cluster) fetchFile(ctx context.Context, stats *syncStats, f FileInfo)
 			}
 			bar.SetRefill(bar.Current())
 
-			logErrorf("Download error %s:\n\t%s", f.Path, err)
+			logErrorfWith(LogFields{"hash": f.Hash, "path": f.Path, "tries": trycount.Load(), "error": err},
+				"Download error %s:\n\t%s", f.Path, err)
 			c := trycount.Add(1)
 			if c > maxRetryCount {
 				break
@@ -1088,6 +1288,63 @@ var noOpenQuery = url.Values{
 	"noopen": {"1"},
 }
 
+const (
+	partialDownloadDir    = "downloading"
+	partialDownloadExpire = time.Hour * 24 * 3
+)
+
+func (cr *Cluster) partialDownloadPath(hash string) string {
+	return filepath.Join(cr.dataDir, partialDownloadDir, hash+".part")
+}
+
+// lockPartial reports whether the caller owns the partial file of the hash,
+// a partial file can only be written by one download at the same time
+func (cr *Cluster) lockPartial(hash string) bool {
+	cr.downloadMux.Lock()
+	defer cr.downloadMux.Unlock()
+
+	if _, ok := cr.partials[hash]; ok {
+		return false
+	}
+	cr.partials[hash] = struct{}{}
+	return true
+}
+
+func (cr *Cluster) unlockPartial(hash string) {
+	cr.downloadMux.Lock()
+	defer cr.downloadMux.Unlock()
+
+	delete(cr.partials, hash)
+}
+
+// cleanPartialDownloads removes the partial files which are not touched for a long time
+func (cr *Cluster) cleanPartialDownloads() {
+	dir := filepath.Join(cr.dataDir, partialDownloadDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logErrorf("Could not read partial download dir: %v", err)
+		}
+		return
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if time.Since(info.ModTime()) > partialDownloadExpire {
+			logDebugf("Removing expired partial download %q", e.Name())
+			os.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+}
+
+// fetchFileWithBuf downloads the file into a local temporary file and verifies its hash.
+// The partial file is kept when the transfer is interrupted,
+// so the next attempt (even after restart) can resume it with a Range request.
 func (cr *Cluster) fetchFileWithBuf(
 	ctx context.Context, f FileInfo,
 	hashMethod crypto.Hash, buf []byte,
@@ -1095,78 +1352,176 @@ func (cr *Cluster) fetchFileWithBuf(
 	wrapper func(io.Reader) io.Reader,
 ) (path string, err error) {
 	var (
-		query url.Values = nil
-		req   *http.Request
-		res   *http.Response
-		fd    *os.File
-		r     io.Reader
+		query  url.Values = nil
+		req    *http.Request
+		res    *http.Response
+		fd     *os.File
+		r      io.Reader
+		offset int64
+		// discard is set when the partial data cannot be reused
+		discard bool
 	)
-	if noOpen {
-		query = noOpenQuery
-	}
-	if req, err = cr.makeReqWithAuth(ctx, http.MethodGet, f.Path, query); err != nil {
-		return
-	}
-	req.Header.Set("Accept-Encoding", "gzip, deflate")
-	if res, err = cr.client.Do(req); err != nil {
-		return
-	}
-	defer res.Body.Close()
-	if err = ctx.Err(); err != nil {
-		return
-	}
-	if res.StatusCode != http.StatusOK {
-		err = NewHTTPStatusErrorFromResponse(res)
-		return
-	}
-	switch ce := strings.ToLower(res.Header.Get("Content-Encoding")); ce {
-	case "":
-		r = res.Body
-	case "gzip":
-		if r, err = gzip.NewReader(res.Body); err != nil {
+
+	hw := hashMethod.New()
+
+	resumable := cr.lockPartial(f.Hash)
+	if resumable {
+		defer cr.unlockPartial(f.Hash)
+		path = cr.partialDownloadPath(f.Hash)
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
 			return
 		}
-	case "deflate":
-		if r, err = zlib.NewReader(res.Body); err != nil {
+		if fd, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644); err != nil {
 			return
 		}
-	default:
-		err = fmt.Errorf("Unexpected Content-Encoding %q", ce)
-		return
+	} else {
+		if fd, err = os.CreateTemp("", "*.downloading"); err != nil {
+			return
+		}
+		path = fd.Name()
 	}
-	if wrapper != nil {
-		r = wrapper(r)
+	defer func() {
+		fd.Close()
+		if err != nil {
+			if discard || !resumable {
+				os.Remove(path)
+			}
+			return
+		}
+		if resumable {
+			// move the finished file away before the partial path is unlocked,
+			// so another download of the same hash cannot reopen it while the caller is still using it
+			var done *os.File
+			if done, err = os.CreateTemp(filepath.Dir(path), f.Hash+".*.done"); err != nil {
+				return
+			}
+			done.Close()
+			if err = os.Rename(path, done.Name()); err != nil {
+				os.Remove(done.Name())
+				return
+			}
+			path = done.Name()
+		}
+	}()
+
+	if resumable {
+		// hash the data we already have, and let the wrapper count it as well
+		var pr io.Reader = fd
+		if wrapper != nil {
+			pr = wrapper(pr)
+		}
+		if offset, err = io.CopyBuffer(hw, pr, buf); err != nil {
+			discard = true
+			return
+		}
+		if f.Size >= 0 && offset > f.Size {
+			logWarnf("Partial file of %s is larger than expected, restarting", f.Path)
+			if offset, err = resetPartialFile(fd, hw); err != nil {
+				discard = true
+				return
+			}
+		}
+		if offset > 0 {
+			logDebugf("Resuming %s from %d bytes", f.Path, offset)
+		}
 	}
 
-	hw := hashMethod.New()
+	if f.Size < 0 || offset < f.Size {
+		if noOpen {
+			query = noOpenQuery
+		}
+		if req, err = cr.makeReqWithAuth(ctx, http.MethodGet, f.Path, query); err != nil {
+			return
+		}
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+			// the range must apply to the original content
+			req.Header.Set("Accept-Encoding", "identity")
+		} else {
+			req.Header.Set("Accept-Encoding", "gzip, deflate")
+		}
+		if res, err = cr.client.Do(req); err != nil {
+			return
+		}
+		defer res.Body.Close()
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		switch res.StatusCode {
+		case http.StatusOK:
+			if offset > 0 {
+				logDebugf("Server does not accept range request for %s, restarting", f.Path)
+				if offset, err = resetPartialFile(fd, hw); err != nil {
+					discard = true
+					return
+				}
+			}
+		case http.StatusPartialContent:
+			if rg := res.Header.Get("Content-Range"); offset == 0 || !strings.HasPrefix(rg, fmt.Sprintf("bytes %d-", offset)) {
+				err = fmt.Errorf("Unexpected Content-Range %q, expect start at %d", rg, offset)
+				discard = true
+				return
+			}
+		case http.StatusRequestedRangeNotSatisfiable:
+			// the partial file does not match the remote one
+			discard = true
+			fallthrough
+		default:
+			err = NewHTTPStatusErrorFromResponse(res)
+			return
+		}
+		ce := strings.ToLower(res.Header.Get("Content-Encoding"))
+		if offset > 0 && ce != "" && ce != "identity" {
+			err = fmt.Errorf("Unexpected Content-Encoding %q for range response", ce)
+			discard = true
+			return
+		}
+		switch ce {
+		case "", "identity":
+			r = res.Body
+		case "gzip":
+			if r, err = gzip.NewReader(res.Body); err != nil {
+				return
+			}
+		case "deflate":
+			if r, err = zlib.NewReader(res.Body); err != nil {
+				return
+			}
+		default:
+			err = fmt.Errorf("Unexpected Content-Encoding %q", ce)
+			return
+		}
+		if wrapper != nil {
+			r = wrapper(r)
+		}
 
-	if fd, err = os.CreateTemp("", "*.downloading"); err != nil {
-		return
-	}
-	path = fd.Name()
-	defer func(path string) {
-		if err != nil {
-			os.Remove(path)
+		if _, err = io.CopyBuffer(io.MultiWriter(hw, fd), r, buf); err != nil {
+			return
 		}
-	}(path)
+	}
 
-	_, err = io.CopyBuffer(io.MultiWriter(hw, fd), r, buf)
-	stat, err2 := fd.Stat()
-	fd.Close()
+	stat, err := fd.Stat()
 	if err != nil {
 		return
 	}
-	if err2 != nil {
-		err = err2
-		return
-	}
 	if t := stat.Size(); f.Size >= 0 && t != f.Size {
 		err = fmt.Errorf("File size wrong, got %d, expect %d", t, f.Size)
+		discard = true
 		return
 	} else if hs := hex.EncodeToString(hw.Sum(buf[:0])); hs != f.Hash {
 		err = fmt.Errorf("File hash not match, got %s, expect %s", hs, f.Hash)
+		discard = true
+		return
+	}
+	return
+}
+
+func resetPartialFile(fd *os.File, hw hash.Hash) (offset int64, err error) {
+	hw.Reset()
+	if err = fd.Truncate(0); err != nil {
 		return
 	}
+	_, err = fd.Seek(0, io.SeekStart)
 	return
 }
 
@@ -1213,10 +1568,10 @@ func (cr *Cluster) DownloadFile(ctx context.Context, hash string) (err error) {
 		done <- err
 	}()
 
-	logInfof("Downloading %s from handler", hash)
+	logInfofWith(LogFields{"hash": hash}, "Downloading %s from handler", hash)
 	defer func() {
 		if err != nil {
-			logErrorf("Could not download %s: %v", hash, err)
+			logErrorfWith(LogFields{"hash": hash, "error": err}, "Could not download %s: %v", hash, err)
 		}
 	}()
 
@@ -1224,6 +1579,7 @@ func (cr *Cluster) DownloadFile(ctx context.Context, hash string) (err error) {
 	if err != nil {
 		return
 	}
+	defer os.Remove(path)
 	var srcFd *os.File
 	if srcFd, err = os.Open(path); err != nil {
 		return
@@ -1240,8 +1596,9 @@ func (cr *Cluster) DownloadFile(ctx context.Context, hash string) (err error) {
 			logErrorf("Could not seek file %q: %v", path, err)
 			return
 		}
-		if err := target.Create(hash, srcFd); err != nil {
-			logErrorf("Could not create %q: %v", target.String(), err)
+		if err := cr.putFile(target, hash, size, srcFd); err != nil {
+			logErrorfWith(LogFields{"hash": hash, "storage": cr.getStorageId(target), "error": err},
+				"Could not create %q: %v", target.String(), err)
 			continue
 		}
 	}
@@ -0,0 +1,182 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	errNotRenewed  = errors.New("The new certificate does not expire later than the current one")
+	errNoCertCache = errors.New("No certificate is cached, the cluster must connect to the center server once before starting offline")
+)
+
+// certCacheName is the file which keeps the last certificate issued by the center server
+const certCacheName = "cert.json"
+
+const (
+	certRequestTimeout  = time.Minute * 10
+	certRenewRetryMin   = time.Minute
+	certRenewRetryMax   = time.Hour
+	certRenewMinAdvance = time.Hour
+)
+
+// requestCertificate requests and parses the certificate issued by the center server,
+// the certificate is cached so it can be served when the cluster starts offline
+func (cr *Cluster) requestCertificate(ctx context.Context) (*tls.Certificate, error) {
+	tctx, cancel := context.WithTimeout(ctx, certRequestTimeout)
+	defer cancel()
+	pair, err := cr.RequestCert(tctx)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := pair.Certificate()
+	if err != nil {
+		return nil, err
+	}
+	if err := cr.saveCertCache(pair); err != nil {
+		logWarnfWith(LogFields{"cluster": cr.clusterId, "error": err}, "Cannot cache the certificate: %v", err)
+	}
+	return cert, nil
+}
+
+// saveCertCache saves the certificate key pair, which is only readable by the owner since it contains the private key
+func (cr *Cluster) saveCertCache(pair *CertKeyPair) error {
+	data, err := json.Marshal(pair)
+	if err != nil {
+		return err
+	}
+	// the old private keys are useless, so no more snapshots are kept
+	return saveSnapshot(filepath.Join(cr.dataDir, certCacheName), data, 0600, 1)
+}
+
+// hasCertCache reports whether there is a cached certificate,
+// it does not verify the content, which is done by loadCertCache
+func (cr *Cluster) hasCertCache() bool {
+	_, err := os.Stat(filepath.Join(cr.dataDir, certCacheName))
+	return err == nil
+}
+
+// loadCertCache loads the last certificate issued by the center server, the expired one is refused
+func (cr *Cluster) loadCertCache() (cert *tls.Certificate, err error) {
+	if err = loadSnapshot(filepath.Join(cr.dataDir, certCacheName), 1, func(buf []byte) error {
+		var pair CertKeyPair
+		if err := json.Unmarshal(buf, &pair); err != nil {
+			return err
+		}
+		c, err := pair.Certificate()
+		if err != nil {
+			return err
+		}
+		cert = c
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if cert == nil {
+		return nil, errNoCertCache
+	}
+	if time.Now().After(cert.Leaf.NotAfter) {
+		return nil, fmt.Errorf("The cached certificate is expired at %s", cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	return cert, nil
+}
+
+// startupCertificate returns the certificate to serve when the cluster starts.
+// If the center server is unreachable, the cached certificate is used and cached is true
+func (cr *Cluster) startupCertificate(ctx context.Context) (cert *tls.Certificate, cached bool, err error) {
+	if cr.Connected() {
+		cert, err = cr.requestCertificate(ctx)
+		return
+	}
+	if cert, err = cr.loadCertCache(); err != nil {
+		return nil, false, err
+	}
+	logWarnfWith(LogFields{"cluster": cr.clusterId, "expireAt": cert.Leaf.NotAfter},
+		"Serving with the cached certificate which expires at %s", cert.Leaf.NotAfter.Format(time.RFC3339))
+	return cert, true, nil
+}
+
+// certRenewTime returns when the certificate should be renewed,
+// which is after two thirds of its lifetime, but at least an hour before it expires
+func certRenewTime(leaf *x509.Certificate) time.Time {
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	at := leaf.NotBefore.Add(lifetime / 3 * 2)
+	if latest := leaf.NotAfter.Add(-certRenewMinAdvance); at.After(latest) {
+		at = latest
+	}
+	return at
+}
+
+// runCertRenewer renews the certificate issued by the center server before it expires,
+// and calls update with the new certificate until the context is canceled.
+// If the certificate is loaded from the cache, a new one is requested once the cluster is enabled again
+func (cr *Cluster) runCertRenewer(ctx context.Context, cert *tls.Certificate, cached bool, update func(*tls.Certificate)) {
+	renewAt := certRenewTime(cert.Leaf)
+	if cached {
+		select {
+		case <-ctx.Done():
+			return
+		case <-cr.WaitForEnable():
+		}
+		renewAt = time.Now()
+	}
+	timer := time.NewTimer(time.Until(renewAt))
+	defer timer.Stop()
+	retry := certRenewRetryMin
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		logInfofWith(LogFields{"cluster": cr.clusterId, "expireAt": cert.Leaf.NotAfter},
+			"Renewing certificate which expires at %s", cert.Leaf.NotAfter.Format(time.RFC3339))
+		newCert, err := cr.requestCertificate(ctx)
+		// the cached certificate may be still the latest one, which is fine to be replaced with the same one
+		if err == nil && !cached && !newCert.Leaf.NotAfter.After(cert.Leaf.NotAfter) {
+			err = errNotRenewed
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logErrorfWith(LogFields{"cluster": cr.clusterId, "error": err},
+				"Cannot renew certificate: %v; retry after %s", err, retry)
+			timer.Reset(retry)
+			retry = min(retry*2, certRenewRetryMax)
+			continue
+		}
+		cert, cached = newCert, false
+		retry = certRenewRetryMin
+		update(cert)
+		logInfofWith(LogFields{"cluster": cr.clusterId, "expireAt": cert.Leaf.NotAfter},
+			"Certificate renewed, expires at %s", cert.Leaf.NotAfter.Format(time.RFC3339))
+		timer.Reset(time.Until(certRenewTime(cert.Leaf)))
+	}
+}
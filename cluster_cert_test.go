@@ -0,0 +1,130 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+func newTestCertKeyPair(t *testing.T, host string, notAfter time.Time) *CertKeyPair {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    notAfter.Add(-time.Hour * 24),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &CertKeyPair{
+		Cert: (string)(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		Key:  (string)(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})),
+	}
+}
+
+func TestCertRenewTime(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		lifetime time.Duration
+		want     time.Duration
+	}{
+		{time.Hour * 24 * 90, time.Hour * 24 * 60},
+		{time.Hour * 3, time.Hour * 2},
+		{time.Hour * 2, time.Hour},
+		{time.Minute * 30, -time.Minute * 30},
+	}
+	for _, tt := range tests {
+		leaf := &x509.Certificate{
+			NotBefore: now,
+			NotAfter:  now.Add(tt.lifetime),
+		}
+		if got := certRenewTime(leaf); !got.Equal(now.Add(tt.want)) {
+			t.Errorf("certRenewTime with lifetime %s = %s, want %s", tt.lifetime, got, now.Add(tt.want))
+		}
+	}
+}
+
+func TestStartupCertificateOffline(t *testing.T) {
+	cr := &Cluster{dataDir: t.TempDir(), clusterId: "test"}
+	ctx := context.Background()
+	if cr.hasCertCache() {
+		t.Fatalf("Should not have certificate cache")
+	}
+	if _, _, err := cr.startupCertificate(ctx); !errors.Is(err, errNoCertCache) {
+		t.Fatalf("Expect errNoCertCache, got %v", err)
+	}
+
+	if err := cr.saveCertCache(newTestCertKeyPair(t, "example.com", time.Now().Add(time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	if !cr.hasCertCache() {
+		t.Fatalf("Certificate cache is not found")
+	}
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(filepath.Join(cr.dataDir, certCacheName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm != 0600 {
+			t.Errorf("Certificate cache mode is %o, expect 600", perm)
+		}
+	}
+	cert, cached, err := cr.startupCertificate(ctx)
+	if err != nil {
+		t.Fatalf("Cannot start with the cached certificate: %v", err)
+	}
+	if !cached {
+		t.Errorf("Certificate should be marked as cached")
+	}
+	if cn := cert.Leaf.Subject.CommonName; cn != "example.com" {
+		t.Errorf("Unexpected common name %q", cn)
+	}
+
+	if err := cr.saveCertCache(newTestCertKeyPair(t, "example.com", time.Now().Add(-time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cr.startupCertificate(ctx); err == nil || errors.Is(err, errNoCertCache) {
+		t.Errorf("Expired certificate should be refused, got %v", err)
+	}
+}
@@ -0,0 +1,190 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	drainCheckInterval  = time.Millisecond * 500
+	drainReportInterval = time.Second * 10
+	drainRetryAfter     = 60
+)
+
+type drainState struct {
+	startAt  time.Time
+	deadline time.Time
+	done     chan struct{}
+	remain   int64
+}
+
+type DrainStatus struct {
+	Draining  bool       `json:"draining"`
+	Transfers int64      `json:"transfers"`
+	StartAt   *time.Time `json:"startAt,omitempty"`
+	Deadline  *time.Time `json:"deadline,omitempty"`
+	Finished  bool       `json:"finished"`
+	// Remain is the number of the transfers which are still running when the deadline exceeded
+	Remain int64 `json:"remain"`
+}
+
+// beginTransfer counts a download or measure request,
+// it returns false and responds 503 if the cluster is draining
+func (cr *Cluster) beginTransfer(rw http.ResponseWriter) (ok bool) {
+	// count first, so the drain will not miss the requests which are checking the state
+	cr.transfers.Add(1)
+	if cr.draining.Load() {
+		cr.transfers.Add(-1)
+		rw.Header().Set("Retry-After", strconv.Itoa(drainRetryAfter))
+		http.Error(rw, "Cluster is draining", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+func (cr *Cluster) endTransfer() {
+	cr.transfers.Add(-1)
+}
+
+// Drain disables the cluster with the center server, rejects new downloads,
+// and waits for the transfers in progress until all of them finished or the timeout exceeded.
+// It returns the number of the transfers which are still running.
+// If the cluster is already draining, it waits for the current drain instead
+func (cr *Cluster) Drain(ctx context.Context, timeout time.Duration) (remain int64) {
+	state, started := cr.startDrain(timeout)
+	if !started {
+		select {
+		case <-state.done:
+		case <-ctx.Done():
+			return cr.transfers.Load()
+		}
+		cr.drainMux.Lock()
+		defer cr.drainMux.Unlock()
+		return state.remain
+	}
+	defer close(state.done)
+
+	logWarnfWith(LogFields{"cluster": cr.clusterId, "deadline": state.deadline},
+		"Draining cluster, waiting for downloads up to %s", timeout)
+	cr.Disable(ctx)
+
+	remain = cr.waitTransfers(ctx, state.deadline)
+	cr.drainMux.Lock()
+	state.remain = remain
+	cr.drainMux.Unlock()
+	if remain > 0 {
+		logWarnfWith(LogFields{"cluster": cr.clusterId, "remain": remain},
+			"Drain deadline exceeded, %d downloads are still in progress", remain)
+	} else {
+		logInfofWith(LogFields{"cluster": cr.clusterId}, "Cluster drained, all downloads finished")
+	}
+	return
+}
+
+func (cr *Cluster) startDrain(timeout time.Duration) (state *drainState, started bool) {
+	cr.drainMux.Lock()
+	defer cr.drainMux.Unlock()
+	if cr.drain != nil && cr.draining.Load() {
+		return cr.drain, false
+	}
+	now := time.Now()
+	cr.drain = &drainState{
+		startAt:  now,
+		deadline: now.Add(timeout),
+		done:     make(chan struct{}),
+	}
+	cr.draining.Store(true)
+	return cr.drain, true
+}
+
+// waitTransfers waits until there are no transfers in progress, and reports the remaining count periodically
+func (cr *Cluster) waitTransfers(ctx context.Context, deadline time.Time) int64 {
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+	lastReport := time.Now()
+	for {
+		n := cr.transfers.Load()
+		if n <= 0 {
+			return 0
+		}
+		if !cr.draining.Load() {
+			// the drain is canceled
+			return n
+		}
+		if time.Since(lastReport) >= drainReportInterval {
+			lastReport = time.Now()
+			logInfofWith(LogFields{"cluster": cr.clusterId, "remain": n},
+				"Waiting for %d downloads to finish, %s left", n, time.Until(deadline).Truncate(time.Second))
+		}
+		select {
+		case <-ctx.Done():
+			return cr.transfers.Load()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Undrain stops draining and enables the cluster again,
+// ctx is only used to wait for the cluster being disabled
+func (cr *Cluster) Undrain(ctx context.Context) error {
+	cr.drainMux.Lock()
+	state := cr.drain
+	cr.drainMux.Unlock()
+	if state == nil || !cr.draining.CompareAndSwap(true, false) {
+		return nil
+	}
+	// wait for the cluster to be disabled
+	select {
+	case <-state.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	logInfofWith(LogFields{"cluster": cr.clusterId}, "Drain canceled, enabling cluster")
+	// the keepalive routine is bound to the context passed to Enable, so use the cluster's context here
+	if !cr.Connect(cr.ctx) {
+		return errors.New("Cannot connect to the center server")
+	}
+	return cr.Enable(cr.ctx)
+}
+
+func (cr *Cluster) DrainStatus() (s DrainStatus) {
+	cr.drainMux.Lock()
+	defer cr.drainMux.Unlock()
+	s.Draining = cr.draining.Load()
+	s.Transfers = cr.transfers.Load()
+	if state := cr.drain; state != nil && s.Draining {
+		startAt, deadline := state.startAt, state.deadline
+		s.StartAt, s.Deadline = &startAt, &deadline
+		select {
+		case <-state.done:
+			s.Finished = true
+			s.Remain = state.remain
+		default:
+		}
+	}
+	return
+}
@@ -0,0 +1,80 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+func TestClusterDrain(t *testing.T) {
+	cr := &Cluster{
+		disabled: make(chan struct{}),
+	}
+	if !cr.beginTransfer(httptest.NewRecorder()) {
+		t.Fatal("Should accept transfers before draining")
+	}
+	go func() {
+		time.Sleep(time.Millisecond * 700)
+		cr.endTransfer()
+	}()
+
+	done := make(chan int64, 1)
+	go func() {
+		done <- cr.Drain(context.Background(), time.Second*5)
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	rw := httptest.NewRecorder()
+	if cr.beginTransfer(rw) {
+		t.Fatal("Should reject transfers when draining")
+	}
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503, got %d", rw.Code)
+	}
+	if s := cr.DrainStatus(); !s.Draining || s.Finished || s.Transfers != 1 {
+		t.Errorf("Unexpected drain status %#v", s)
+	}
+	select {
+	case remain := <-done:
+		if remain != 0 {
+			t.Errorf("Expected no remaining transfers, got %d", remain)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("Drain did not return after the transfers finished")
+	}
+	if s := cr.DrainStatus(); !s.Finished || s.Remain != 0 {
+		t.Errorf("Unexpected drain status %#v", s)
+	}
+}
+
+func TestClusterDrainTimeout(t *testing.T) {
+	cr := &Cluster{
+		disabled: make(chan struct{}),
+	}
+	cr.beginTransfer(httptest.NewRecorder())
+	if remain := cr.Drain(context.Background(), time.Millisecond*100); remain != 1 {
+		t.Errorf("Expected 1 remaining transfer, got %d", remain)
+	}
+}
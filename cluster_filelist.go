@@ -0,0 +1,254 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hamba/avro/v2"
+	"github.com/klauspost/compress/zstd"
+)
+
+const fileListCacheName = "filelist.cache"
+
+const (
+	offlineRetryMin = time.Second * 30
+	offlineRetryMax = time.Minute * 10
+)
+
+var (
+	errNotConnected        = errors.New("Not connected to the center server")
+	errNoFileListCache     = errors.New("No cached file list")
+	errBrokenFileListCache = errors.New("File list cache is too short")
+)
+
+// decodeFileList decodes the zstd compressed avro file list sent by the center server,
+// the list without the modified times is accepted as well
+func decodeFileList(body []byte) (files []FileInfo, err error) {
+	zr, err := zstd.NewReader(nil)
+	if err != nil {
+		return
+	}
+	defer zr.Close()
+	data, err := zr.DecodeAll(body, nil)
+	if err != nil {
+		return
+	}
+	if files, err = decodeFileListWith(fileListSchema, data); err != nil {
+		var err2 error
+		if files, err2 = decodeFileListWith(legacyFileListSchema, data); err2 != nil {
+			return nil, err
+		}
+		err = nil
+	}
+	return
+}
+
+// decodeFileListWith decodes the avro data, and fails if there are remaining bytes,
+// so the schema can be detected
+func decodeFileListWith(schema avro.Schema, data []byte) (files []FileInfo, err error) {
+	r := avro.NewReader(nil, 0).Reset(data)
+	r.ReadVal(schema, &files)
+	if r.Error != nil {
+		return nil, r.Error
+	}
+	var b [1]byte
+	if r.Read(b[:]); r.Error == nil {
+		return nil, errors.New("Unexpected data after the file list")
+	}
+	return
+}
+
+func encodeFileList(files []FileInfo) ([]byte, error) {
+	data, err := avro.Marshal(fileListSchema, files)
+	if err != nil {
+		return nil, err
+	}
+	zw, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer zw.Close()
+	return zw.EncodeAll(data, nil), nil
+}
+
+// saveFileListCache saves the file list with the time it's fetched,
+// the cache is in the format of an 8 bytes big endian unix milliseconds followed by the compressed list
+func (cr *Cluster) saveFileListCache(files []FileInfo, fetchedAt time.Time) error {
+	body, err := encodeFileList(files)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 8+len(body))
+	binary.BigEndian.PutUint64(buf, (uint64)(fetchedAt.UnixMilli()))
+	copy(buf[8:], body)
+	return saveSnapshot(filepath.Join(cr.dataDir, fileListCacheName), buf, 0644, snapshotKeep)
+}
+
+// hasFileListCache reports whether there is a cached file list,
+// it does not verify the content, which is done by loadFileListCache
+func (cr *Cluster) hasFileListCache() bool {
+	path := filepath.Join(cr.dataDir, fileListCacheName)
+	for i := 0; i < snapshotKeep; i++ {
+		if _, err := os.Stat(snapshotPath(path, i)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// loadFileListCache loads the last successfully fetched file list
+func (cr *Cluster) loadFileListCache() (files []FileInfo, fetchedAt time.Time, err error) {
+	loaded := false
+	if err = loadSnapshot(filepath.Join(cr.dataDir, fileListCacheName), snapshotKeep, func(buf []byte) error {
+		if len(buf) < 8 {
+			return errBrokenFileListCache
+		}
+		fl, err := decodeFileList(buf[8:])
+		if err != nil {
+			return err
+		}
+		files, fetchedAt = fl, time.UnixMilli((int64)(binary.BigEndian.Uint64(buf)))
+		loaded = true
+		return nil
+	}); err != nil {
+		return
+	}
+	if !loaded {
+		err = errNoFileListCache
+	}
+	return
+}
+
+// FetchFileList fetches the file list from the center server and caches it.
+// If full is false and the center server provides the modified times, only the files changed since the last fetch are requested,
+// and incremental reports whether files is a delta that should be merged into the current fileset.
+// It falls back to the full list if the incremental list cannot be fetched
+func (cr *Cluster) FetchFileList(ctx context.Context, full bool) (files []FileInfo, incremental bool, err error) {
+	cr.fileListMux.Lock()
+	defer cr.fileListMux.Unlock()
+
+	if !full && cr.lastModified > 0 {
+		logInfof("Fetching file list changed since %s", time.UnixMilli(cr.lastModified).Format(time.RFC3339))
+		if files, err = cr.GetFileList(ctx, cr.lastModified); err == nil {
+			cr.mergeFileList(files)
+			return files, true, nil
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		logWarnf("Cannot query incremental file list: %v; fetching the full list", err)
+	}
+	logInfof("Fetching file list")
+	if files, err = cr.GetFileList(ctx, 0); err != nil {
+		return
+	}
+	cr.fileList = make(map[string]FileInfo, len(files))
+	cr.lastModified = 0
+	cr.mergeFileList(files)
+	return files, false, nil
+}
+
+// mergeFileList updates the known files by their paths and caches the merged list
+func (cr *Cluster) mergeFileList(files []FileInfo) {
+	if len(files) == 0 {
+		return
+	}
+	for _, f := range files {
+		cr.fileList[f.Path] = f
+		if f.Mtime > cr.lastModified {
+			cr.lastModified = f.Mtime
+		}
+	}
+	list := make([]FileInfo, 0, len(cr.fileList))
+	for _, f := range cr.fileList {
+		list = append(list, f)
+	}
+	if err := cr.saveFileListCache(list, time.Now()); err != nil {
+		logErrorf("Could not cache file list: %v", err)
+	}
+}
+
+// Connected reports whether the cluster has connected to the center server
+func (cr *Cluster) Connected() bool {
+	cr.mux.RLock()
+	defer cr.mux.RUnlock()
+	return cr.socket != nil
+}
+
+// setFileset replaces the files that the cluster can serve without syncing them
+func (cr *Cluster) setFileset(files []FileInfo) {
+	fileset := make(map[string]int64, len(files))
+	for _, f := range files {
+		fileset[f.Hash] = f.Size
+	}
+	cr.fileMux.Lock()
+	cr.fileset = fileset
+	cr.fileMux.Unlock()
+}
+
+// serveOffline serves the local files in the cached file list while the center server is unreachable.
+// It reconnects periodically, and returns the new file list once the center server is back.
+// The cached files are kept serving until the cluster is enabled
+func (cr *Cluster) serveOffline(ctx context.Context) (_ []FileInfo, err error) {
+	files, fetchedAt, err := cr.loadFileListCache()
+	if err != nil {
+		return nil, err
+	}
+	cr.setFileset(files)
+	cr.servingOffline.Store(true)
+	defer func() {
+		if err != nil {
+			cr.servingOffline.Store(false)
+		}
+	}()
+	logWarnfWith(LogFields{"cluster": cr.clusterId, "fetchedAt": fetchedAt},
+		"Serving %d files offline with the file list cached at %s", len(files), fetchedAt.Format(time.RFC3339))
+
+	retry := offlineRetryMin
+	timer := time.NewTimer(retry)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		err = errNotConnected
+		if cr.Connect(ctx) {
+			if files, _, err = cr.FetchFileList(ctx, true); err == nil {
+				logInfofWith(LogFields{"cluster": cr.clusterId}, "Center server is reachable again")
+				return files, nil
+			}
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		retry = min(retry*2, offlineRetryMax)
+		logWarnfWith(LogFields{"cluster": cr.clusterId, "error": err},
+			"Center server is still unreachable: %v; retry after %s", err, retry)
+		timer.Reset(retry)
+	}
+}
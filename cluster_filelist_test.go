@@ -0,0 +1,206 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"context"
+	"crypto"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hamba/avro/v2"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestFileListCache(t *testing.T) {
+	cr := &Cluster{dataDir: t.TempDir()}
+	if _, _, err := cr.loadFileListCache(); !errors.Is(err, errNoFileListCache) {
+		t.Fatalf("Expected errNoFileListCache, got %v", err)
+	}
+
+	files := []FileInfo{
+		{Path: "/a", Hash: "0123456789abcdef0123456789abcdef01234567", Size: 10, Mtime: 1700000000000},
+		{Path: "/b", Hash: "fedcba9876543210fedcba9876543210fedcba98", Size: 20, Mtime: 1700000001000},
+	}
+	fetchedAt := time.UnixMilli(time.Now().UnixMilli())
+	if err := cr.saveFileListCache(files, fetchedAt); err != nil {
+		t.Fatal(err)
+	}
+
+	got, gotTime, err := cr.loadFileListCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, files) {
+		t.Errorf("File list mismatch: got %v, want %v", got, files)
+	}
+	if !gotTime.Equal(fetchedAt) {
+		t.Errorf("Fetch time mismatch: got %v, want %v", gotTime, fetchedAt)
+	}
+}
+
+func TestDecodeLegacyFileList(t *testing.T) {
+	files := []FileInfo{
+		{Path: "/a", Hash: "0123456789abcdef0123456789abcdef01234567", Size: 10},
+		{Path: "/b", Hash: "fedcba9876543210fedcba9876543210fedcba98", Size: 20},
+		{Path: "/c", Hash: "00000000000000000000000000000000ffffffff", Size: 30},
+	}
+	data, err := avro.Marshal(legacyFileListSchema, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeFileList(enc.EncodeAll(data, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, files) {
+		t.Errorf("File list mismatch: got %v, want %v", got, files)
+	}
+}
+
+// signDownload generates the query which the center server signs for the download
+func signDownload(hash string, secret string) string {
+	e := strconv.FormatInt(time.Now().Add(time.Minute).UnixMilli(), 36)
+	hs := crypto.SHA1.New()
+	io.WriteString(hs, secret)
+	io.WriteString(hs, hash)
+	io.WriteString(hs, e)
+	return url.Values{
+		"s": {base64.RawURLEncoding.EncodeToString(hs.Sum(nil))},
+		"e": {e},
+	}.Encode()
+}
+
+func TestServeOfflineWithUnreachableCenter(t *testing.T) {
+	// a closed port stands for the unreachable center server
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	s := new(LocalStorage)
+	s.SetOptions(&LocalStorageOption{
+		CachePath: t.TempDir(),
+	})
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	const content = "offline data"
+	hs := crypto.SHA1.New()
+	io.WriteString(hs, content)
+	hash := hex.EncodeToString(hs.Sum(nil))
+	if err := s.Create(hash, strings.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+
+	cr := &Cluster{
+		prefix:        "http://" + addr,
+		dataDir:       t.TempDir(),
+		clusterId:     "test",
+		clusterSecret: "secret",
+		SharedStorages: &SharedStorages{
+			storageOpts:        []StorageOption{{}},
+			storages:           []Storage{s},
+			storageWeights:     []uint{1},
+			storageTotalWeight: 1,
+			storageHealth:      []*StorageHealth{NewStorageHealth()},
+		},
+	}
+	files := []FileInfo{
+		{Path: "/a", Hash: hash, Size: (int64)(len(content))},
+	}
+	if cr.hasFileListCache() {
+		t.Fatalf("Should not have file list cache")
+	}
+	if err := cr.saveFileListCache(files, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if !cr.hasFileListCache() {
+		t.Fatalf("File list cache is not found")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if cr.Connect(ctx) {
+		t.Fatalf("Connected to an unreachable center server")
+	}
+	if cr.Connected() {
+		t.Fatalf("Failed connection should not be considered as connected")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := cr.serveOffline(ctx)
+		done <- err
+	}()
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		if size, ok := cr.CachedFileSize(files[0].Hash); ok {
+			if size != files[0].Size {
+				t.Errorf("Unexpected size %d, expect %d", size, files[0].Size)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Cached file list is not served")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/download/"+hash+"?"+signDownload(hash, cr.clusterSecret), nil)
+	rw := httptest.NewRecorder()
+	cr.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Errorf("Offline download responds %d: %s", rw.Code, rw.Body.String())
+	} else if rw.Body.String() != content {
+		t.Errorf("Unexpected content %q, expect %q", rw.Body.String(), content)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expect context canceled, got %v", err)
+		}
+		if cr.servingOffline.Load() {
+			t.Errorf("Cluster is still serving offline after canceled")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("serveOffline does not return after canceled")
+	}
+}
@@ -0,0 +1,238 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClusterRouter dispatches the requests to the clusters by the Host header,
+// and picks the certificate by the TLS server name
+type ClusterRouter struct {
+	clusters []*Cluster
+	handlers []http.Handler
+
+	certMux  sync.RWMutex
+	certs    []*tls.Certificate
+	getCerts []getCertificateFunc
+}
+
+var _ http.Handler = (*ClusterRouter)(nil)
+
+func NewClusterRouter(clusters []*Cluster) (r *ClusterRouter) {
+	r = &ClusterRouter{
+		clusters: clusters,
+		handlers: make([]http.Handler, len(clusters)),
+		certs:    make([]*tls.Certificate, len(clusters)),
+		getCerts: make([]getCertificateFunc, len(clusters)),
+	}
+	for i, cr := range clusters {
+		r.handlers[i] = cr.GetHandler()
+	}
+	return
+}
+
+// match returns the index of the cluster which serves the host, or -1 if there is none
+func (r *ClusterRouter) match(host string) int {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" {
+		return -1
+	}
+	r.certMux.RLock()
+	defer r.certMux.RUnlock()
+	for i, cert := range r.certs {
+		if cert != nil && cert.Leaf != nil && cert.Leaf.VerifyHostname(host) == nil {
+			return i
+		}
+	}
+	for i, cr := range r.clusters {
+		if strings.EqualFold(cr.host, host) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (r *ClusterRouter) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	i := 0
+	if len(r.clusters) > 1 {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		// requests for unknown hosts (e.g. access by IP) go to the first cluster
+		if i = r.match(host); i < 0 {
+			i = 0
+		}
+	}
+	r.handlers[i].ServeHTTP(rw, req)
+}
+
+// SetCertificate sets the certificate of the i-th cluster
+func (r *ClusterRouter) SetCertificate(i int, cert *tls.Certificate) {
+	r.certMux.Lock()
+	defer r.certMux.Unlock()
+	r.certs[i] = cert
+}
+
+// SetGetCertificate sets the function to get the certificate of the i-th cluster,
+// it's used when the certificate may change over time, e.g. issued by ACME
+func (r *ClusterRouter) SetGetCertificate(i int, getCert getCertificateFunc) {
+	r.certMux.Lock()
+	defer r.certMux.Unlock()
+	r.getCerts[i] = getCert
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate
+func (r *ClusterRouter) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	i := r.match(hello.ServerName)
+	// do not hold the lock since getting a certificate from ACME may take a long time
+	r.certMux.RLock()
+	certs, getCerts := slices.Clone(r.certs), slices.Clone(r.getCerts)
+	r.certMux.RUnlock()
+	if i >= 0 {
+		if getCert := getCerts[i]; getCert != nil {
+			return getCert(hello)
+		}
+		if certs[i] != nil {
+			return certs[i], nil
+		}
+	}
+	// the host may be one of the extra domains
+	for _, getCert := range getCerts {
+		if getCert != nil {
+			if cert, err := getCert(hello); err == nil {
+				return cert, nil
+			}
+		}
+	}
+	for _, cert := range certs {
+		if cert != nil {
+			return cert, nil
+		}
+	}
+	return nil, errors.New("No certificate available")
+}
+
+const tlsSniffTimeout = time.Second * 10
+
+// tlsSniffListener serves TLS and plain HTTP connections on the same port.
+// The connections which start with a TLS handshake record will be wrapped by tls.Server
+type tlsSniffListener struct {
+	net.Listener
+	config *tls.Config
+
+	conns     chan net.Conn
+	errs      chan error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newTLSSniffListener(l net.Listener, config *tls.Config) *tlsSniffListener {
+	sl := &tlsSniffListener{
+		Listener: l,
+		config:   config,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		closed:   make(chan struct{}),
+	}
+	go sl.acceptLoop()
+	return sl
+}
+
+func (l *tlsSniffListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				l.Close()
+				return
+			}
+			select {
+			case l.errs <- err:
+				continue
+			case <-l.closed:
+				return
+			}
+		}
+		// do not block the accept loop by slow clients
+		go l.sniff(conn)
+	}
+}
+
+func (l *tlsSniffListener) sniff(conn net.Conn) {
+	pc := &peekedConn{
+		Conn: conn,
+		r:    bufio.NewReaderSize(conn, 16),
+	}
+	conn.SetReadDeadline(time.Now().Add(tlsSniffTimeout))
+	b, err := pc.r.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+	var c net.Conn = pc
+	if b[0] == 0x16 { // TLS handshake record
+		c = tls.Server(pc, l.config)
+	}
+	select {
+	case l.conns <- c:
+	case <-l.closed:
+		c.Close()
+	}
+}
+
+func (l *tlsSniffListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *tlsSniffListener) Close() (err error) {
+	err = net.ErrClosed
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.Listener.Close()
+	})
+	return
+}
+
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(buf []byte) (int, error) {
+	return c.r.Read(buf)
+}
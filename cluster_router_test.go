@@ -0,0 +1,125 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"time"
+)
+
+func newTestCertificate(t *testing.T, host string) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+}
+
+func TestClusterRouterMatch(t *testing.T) {
+	r := &ClusterRouter{
+		clusters: []*Cluster{{host: "a.example.com"}, {host: ""}, {host: "c.example.com"}},
+		certs:    make([]*tls.Certificate, 3),
+		getCerts: make([]getCertificateFunc, 3),
+	}
+	r.SetCertificate(1, newTestCertificate(t, "*.b.example.com"))
+	for host, expect := range map[string]int{
+		"a.example.com":     0,
+		"A.Example.com.":    0,
+		"x.b.example.com":   1,
+		"c.example.com":     2,
+		"unknown.localhost": -1,
+		"":                  -1,
+	} {
+		if i := r.match(host); i != expect {
+			t.Errorf("Host %q matched %d, expect %d", host, i, expect)
+		}
+	}
+	cert, err := r.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.example.com"})
+	if err != nil || cert != r.certs[1] {
+		t.Errorf("Should fallback to the first available certificate, got %v, %v", cert, err)
+	}
+}
+
+func TestTLSSniffListener(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := newTestCertificate(t, "localhost")
+	sl := newTLSSniffListener(listener, &tls.Config{Certificates: []tls.Certificate{*cert}})
+	svr := &http.Server{
+		Handler: (http.HandlerFunc)(func(rw http.ResponseWriter, req *http.Request) {
+			if req.TLS != nil {
+				io.WriteString(rw, "tls")
+			} else {
+				io.WriteString(rw, "plain")
+			}
+		}),
+	}
+	go svr.Serve(sl)
+	defer svr.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: "localhost"},
+		},
+	}
+	addr := listener.Addr().String()
+	for scheme, expect := range map[string]string{"http": "plain", "https": "tls"} {
+		res, err := client.Get(scheme + "://" + addr + "/")
+		if err != nil {
+			t.Fatalf("Cannot get %s: %v", scheme, err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if (string)(body) != expect {
+			t.Errorf("Got %q with %s, expect %q", body, scheme, expect)
+		}
+	}
+}
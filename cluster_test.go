@@ -0,0 +1,137 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func TestFetchFileResume(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	sum := sha1.Sum(content)
+	hash := hex.EncodeToString(sum[:])
+
+	var lastRange string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		lastRange = req.Header.Get("Range")
+		http.ServeContent(rw, req, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	cr := &Cluster{
+		prefix:    server.URL,
+		dataDir:   t.TempDir(),
+		partials:  make(map[string]struct{}),
+		client:    server.Client(),
+		authToken: &ClusterToken{Token: "test", ExpireAt: time.Now().Add(time.Hour)},
+	}
+	f := FileInfo{
+		Path: "/openbmclapi/download/" + hash,
+		Hash: hash,
+		Size: (int64)(len(content)),
+	}
+
+	partial := cr.partialDownloadPath(hash)
+	os.MkdirAll(filepath.Dir(partial), 0755)
+	if err := os.WriteFile(partial, content[:1000], 0644); err != nil {
+		t.Fatalf("Cannot write partial file: %v", err)
+	}
+	buf := make([]byte, 1024)
+	path, err := cr.fetchFileWithBuf(context.Background(), f, crypto.SHA1, buf, false, nil)
+	if err != nil {
+		t.Fatalf("Cannot fetch file: %v", err)
+	}
+	if lastRange != "bytes=1000-" {
+		t.Errorf("Unexpected range header %q", lastRange)
+	}
+	if data, err := os.ReadFile(path); err != nil || !bytes.Equal(data, content) {
+		t.Errorf("Downloaded file does not match: %v", err)
+	}
+	// the finished file must not be reachable by the next download of the same hash
+	if path == partial {
+		t.Errorf("Downloaded file is still at the partial path")
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("Partial file is not moved: %v", err)
+	}
+	os.Remove(path)
+
+	// corrupted partial data must be discarded
+	if err := os.WriteFile(partial, ([]byte)(strings.Repeat("x", 1000)), 0644); err != nil {
+		t.Fatalf("Cannot write partial file: %v", err)
+	}
+	if _, err = cr.fetchFileWithBuf(context.Background(), f, crypto.SHA1, buf, false, nil); err == nil {
+		t.Fatalf("Expect hash mismatch error")
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("Corrupted partial file is not removed: %v", err)
+	}
+	if path, err = cr.fetchFileWithBuf(context.Background(), f, crypto.SHA1, buf, false, nil); err != nil {
+		t.Fatalf("Cannot fetch file after discard: %v", err)
+	}
+	if lastRange != "" {
+		t.Errorf("Unexpected range header %q", lastRange)
+	}
+	os.Remove(path)
+}
+
+func TestGCWithoutFileset(t *testing.T) {
+	s := new(LocalStorage)
+	s.SetOptions(&LocalStorageOption{
+		CachePath: t.TempDir(),
+	})
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	const hash = "0123456789abcdef0123456789abcdef01234567"
+	if err := s.Create(hash, strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	cr := &Cluster{
+		SharedStorages: &SharedStorages{
+			storageOpts: []StorageOption{{}},
+			storages:    []Storage{s},
+		},
+	}
+	cr.clusters = []*Cluster{cr}
+	cr.gcFor(s)
+	if _, err := os.Stat(s.hashToPath(hash)); err != nil {
+		t.Fatalf("File is removed before the file list is ready: %v", err)
+	}
+
+	cr.fileset = map[string]int64{}
+	cr.gcFor(s)
+	if _, err := os.Stat(s.hashToPath(hash)); !os.IsNotExist(err) {
+		t.Fatalf("Outdated file is not removed: %v", err)
+	}
+}
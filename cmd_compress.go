@@ -20,12 +20,12 @@
 package main
 
 import (
-	"compress/gzip"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 )
 
@@ -34,6 +34,7 @@ func cmdZipCache(args []string) {
 	flagAll := false
 	flagOverwrite := false
 	flagKeep := false
+	formats := []Compressor{GzipCompressor}
 	for _, a := range args {
 		a = strings.ToLower(a)
 		if len(a) > 0 && a[0] == '-' {
@@ -59,6 +60,18 @@ func cmdZipCache(args []string) {
 				continue
 			}
 		}
+		if v, ok := strings.CutPrefix(a, "format="); ok {
+			formats = formats[:0]
+			for _, f := range strings.Split(v, ",") {
+				c, ok := ParseCompressor(strings.TrimSpace(f))
+				if !ok || !slices.Contains(precompressedVariants, c) {
+					fmt.Printf("Unsupported format %q\n", f)
+					os.Exit(2)
+				}
+				formats = append(formats, c)
+			}
+			continue
+		}
 		switch a {
 		case "verbose", "v":
 			flagVerbose = true
@@ -75,57 +88,33 @@ func cmdZipCache(args []string) {
 	}
 	cacheDir := filepath.Join(baseDir, "cache")
 	fmt.Printf("Cache directory = %q\n", cacheDir)
-	err := walkCacheDir(cacheDir, func(hash string, _ int64) (_ error) {
+	err := walkCacheFiles(cacheDir, func(hash string, size int64) (_ error) {
 		path := filepath.Join(cacheDir, hash[0:2], hash)
-		if strings.HasSuffix(path, ".gz") {
+		if _, c := cutCompressedExt(path); c != NullCompressor {
 			return
 		}
-		target := path + ".gz"
-		if !flagOverwrite {
-			if _, err := os.Stat(target); err == nil {
-				return
-			}
-		}
-		srcFd, err := os.Open(path)
-		if err != nil {
-			fmt.Printf("Error: could not open file %q: %v\n", path, err)
+		if !flagAll && size <= 1024*10 {
 			return
 		}
-		defer srcFd.Close()
-		stat, err := srcFd.Stat()
-		if err != nil {
-			fmt.Printf("Error: could not get stat of %q: %v\n", path, err)
-			return
-		}
-		if flagAll || stat.Size() > 1024*10 {
-			if flagVerbose {
-				fmt.Printf("compressing %s\n", path)
-			}
-			tmpPath := target + ".tmp"
-			var dstFd *os.File
-			if dstFd, err = os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644); err != nil {
-				fmt.Printf("Error: could not create %q: %v\n", tmpPath, err)
-				return
-			}
-			defer dstFd.Close()
-			w := gzip.NewWriter(dstFd)
-			defer w.Close()
-
-			if _, err = io.Copy(w, srcFd); err != nil {
-				os.Remove(tmpPath)
-				fmt.Printf("Error: could not compress %q: %v\n", path, err)
-				return
+		ok := true
+		for _, c := range formats {
+			target := path + c.Ext()
+			if !flagOverwrite {
+				if _, err := os.Stat(target); err == nil {
+					continue
+				}
 			}
-			os.Remove(target)
-			if err = os.Rename(tmpPath, target); err != nil {
-				os.Remove(tmpPath)
-				fmt.Printf("Error: could not rename %q to %q\n", tmpPath, target)
-				return
+			if flagVerbose {
+				fmt.Printf("compressing %s with %s\n", path, c)
 			}
-			if !flagKeep {
-				os.Remove(path)
+			if err := compressFile(path, target, c); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				ok = false
 			}
 		}
+		if ok && !flagKeep {
+			os.Remove(path)
+		}
 		return
 	})
 	if err != nil {
@@ -134,6 +123,48 @@ func cmdZipCache(args []string) {
 	}
 }
 
+// cutCompressedExt removes the precompressed file extension from the path
+func cutCompressedExt(path string) (string, Compressor) {
+	for _, c := range precompressedVariants {
+		if p, ok := strings.CutSuffix(path, c.Ext()); ok {
+			return p, c
+		}
+	}
+	return path, NullCompressor
+}
+
+func compressFile(path string, target string, c Compressor) (err error) {
+	srcFd, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not open file %q: %w", path, err)
+	}
+	defer srcFd.Close()
+
+	tmpPath := target + ".tmp"
+	dstFd, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("could not create %q: %w", tmpPath, err)
+	}
+	w := c.WrapWriter(dstFd)
+	_, err = io.Copy(w, srcFd)
+	if e := w.Close(); e != nil && err == nil {
+		err = e
+	}
+	if e := dstFd.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("could not compress %q: %w", path, err)
+	}
+	os.Remove(target)
+	if err = os.Rename(tmpPath, target); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("could not rename %q to %q", tmpPath, target)
+	}
+	return nil
+}
+
 func cmdUnzipCache(args []string) {
 	flagVerbose := false
 	flagOverwrite := false
@@ -176,12 +207,13 @@ func cmdUnzipCache(args []string) {
 	cacheDir := filepath.Join(baseDir, "cache")
 	fmt.Printf("Cache directory = %q\n", cacheDir)
 	var hashBuf [64]byte
-	err := walkCacheDir(cacheDir, func(hash string, _ int64) (_ error) {
+	err := walkCacheFiles(cacheDir, func(hash string, _ int64) (_ error) {
 		path := filepath.Join(cacheDir, hash[0:2], hash)
-		target, ok := strings.CutSuffix(path, ".gz")
-		if !ok {
+		target, compressor := cutCompressedExt(path)
+		if compressor == NullCompressor {
 			return
 		}
+		hash = filepath.Base(target)
 
 		hashMethod, err := getHashMethod(len(hash))
 		if err != nil {
@@ -210,7 +242,7 @@ func cmdUnzipCache(args []string) {
 			return
 		}
 		defer dstFd.Close()
-		r, err := gzip.NewReader(srcFd)
+		r, err := compressor.WrapReader(srcFd)
 		if err != nil {
 			fmt.Printf("Error: could not decompress %q: %v\n", path, err)
 			return
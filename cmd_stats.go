@@ -0,0 +1,246 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const statCSVAccess = "access"
+
+var statCSVHeader = []string{"type", "key", "hits", "bytes"}
+
+type statsCmdOptions struct {
+	format   string
+	cluster  string
+	conflict StatMergeRule
+	file     string
+}
+
+func parseStatsCmdArgs(args []string) (opts statsCmdOptions) {
+	opts.conflict = StatMergeSum
+	for _, a := range args {
+		if k, v, ok := strings.Cut(a, "="); ok {
+			switch strings.ToLower(k) {
+			case "format":
+				opts.format = strings.ToLower(v)
+				if opts.format != "json" && opts.format != "csv" {
+					fmt.Printf("Unsupported format %q\n", v)
+					os.Exit(2)
+				}
+			case "cluster":
+				opts.cluster = v
+			case "conflict":
+				if opts.conflict, ok = ParseStatMergeRule(v); !ok {
+					fmt.Printf("Unknown conflict rule %q\n", v)
+					os.Exit(2)
+				}
+			default:
+				fmt.Printf("Unknown option %q\n", k)
+				os.Exit(2)
+			}
+			continue
+		}
+		if opts.file != "" {
+			fmt.Printf("Unexpected argument %q\n", a)
+			os.Exit(2)
+		}
+		opts.file = a
+	}
+	if opts.format == "" && strings.EqualFold(filepath.Ext(opts.file), ".csv") {
+		opts.format = "csv"
+	}
+	return
+}
+
+// statsDataDir returns the directory which contains the stats of the cluster
+func statsDataDir(cluster string) string {
+	dataDir := filepath.Join(baseDir, "data")
+	if cluster != "" {
+		return filepath.Join(dataDir, "clusters", cluster)
+	}
+	return dataDir
+}
+
+func cmdExportStats(args []string) {
+	opts := parseStatsCmdArgs(args)
+	if opts.file == "" {
+		fmt.Println("Please specify the file to export to")
+		os.Exit(2)
+	}
+	dir := statsDataDir(opts.cluster)
+	if _, err := os.Stat(filepath.Join(dir, statsFileName)); err != nil {
+		fmt.Printf("Cannot find stats in %q: %v\n", dir, err)
+		os.Exit(1)
+	}
+	var stats Stats
+	if err := stats.Load(dir); err != nil {
+		fmt.Printf("Cannot load stats: %v\n", err)
+		os.Exit(1)
+	}
+
+	var buf bytes.Buffer
+	var err error
+	if opts.format == "csv" {
+		err = writeStatsCSV(&buf, &stats.statData)
+	} else {
+		e := json.NewEncoder(&buf)
+		e.SetIndent("", "  ")
+		err = e.Encode(&stats.statData)
+	}
+	if err != nil {
+		fmt.Printf("Cannot encode stats: %v\n", err)
+		os.Exit(1)
+	}
+	if err := writeFileAtomic(opts.file, 0644, func(w io.Writer) error {
+		_, err := buf.WriteTo(w)
+		return err
+	}); err != nil {
+		fmt.Printf("Cannot write %q: %v\n", opts.file, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Stats in %q are exported to %q\n", dir, opts.file)
+}
+
+func cmdImportStats(args []string) {
+	opts := parseStatsCmdArgs(args)
+	if opts.file == "" {
+		fmt.Println("Please specify the file to import")
+		os.Exit(2)
+	}
+	var (
+		buf []byte
+		err error
+	)
+	if opts.file == "-" {
+		buf, err = io.ReadAll(os.Stdin)
+	} else {
+		buf, err = os.ReadFile(opts.file)
+	}
+	if err != nil {
+		fmt.Printf("Cannot read %q: %v\n", opts.file, err)
+		os.Exit(1)
+	}
+	var (
+		records  []statRecord
+		accesses map[string]int
+	)
+	if opts.format == "csv" || (opts.format == "" && !bytes.HasPrefix(bytes.TrimSpace(buf), []byte("{"))) {
+		records, accesses, err = readStatsCSV(bytes.NewReader(buf))
+	} else {
+		var data statData
+		// the file may be a copy of stat.json with the checksum trailer
+		if buf, err = verifySnapshot(buf); err == nil {
+			err = json.Unmarshal(buf, &data)
+		}
+		records, accesses = data.records(), data.Accesses
+	}
+	if err != nil {
+		fmt.Printf("Cannot parse %q: %v\n", opts.file, err)
+		os.Exit(1)
+	}
+
+	dir := statsDataDir(opts.cluster)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fmt.Printf("Cannot create %q: %v\n", dir, err)
+		os.Exit(1)
+	}
+	var stats Stats
+	if err := stats.Load(dir); err != nil {
+		fmt.Printf("Cannot load stats: %v\n", err)
+		os.Exit(1)
+	}
+	stats.Merge(records, accesses, opts.conflict, time.Now())
+	if err := stats.Save(dir); err != nil {
+		fmt.Printf("Cannot save stats: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Imported %d records and %d accesses into %q with conflict rule %s\n", len(records), len(accesses), dir, opts.conflict)
+	fmt.Println("Note: the running server will overwrite the stats, please restart it if it's running")
+}
+
+// writeStatsCSV writes the stats as rows of type, key, hits and bytes.
+// The key of the periods is the UTC time, and the key of the accesses is the user agent
+func writeStatsCSV(w io.Writer, d *statData) error {
+	cw := csv.NewWriter(w)
+	cw.Write(statCSVHeader)
+	for _, r := range d.records() {
+		cw.Write([]string{r.Kind.String(), r.String(), strconv.Itoa((int)(r.Hits)), strconv.FormatInt(r.Bytes, 10)})
+	}
+	uas := make([]string, 0, len(d.Accesses))
+	for ua := range d.Accesses {
+		uas = append(uas, ua)
+	}
+	sort.Strings(uas)
+	for _, ua := range uas {
+		cw.Write([]string{statCSVAccess, ua, strconv.Itoa(d.Accesses[ua]), "0"})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func readStatsCSV(r io.Reader) (records []statRecord, accesses map[string]int, err error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(statCSVHeader)
+	accesses = make(map[string]int)
+	for line := 1; ; line++ {
+		var row []string
+		if row, err = cr.Read(); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = nil
+			}
+			return
+		}
+		if line == 1 && row[0] == statCSVHeader[0] {
+			continue
+		}
+		var hits, bytes int64
+		if hits, err = strconv.ParseInt(row[2], 10, 64); err != nil {
+			return nil, nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if bytes, err = strconv.ParseInt(row[3], 10, 64); err != nil {
+			return nil, nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if row[0] == statCSVAccess {
+			accesses[row[1]] += (int)(hits)
+			continue
+		}
+		kind, ok := parseStatRecordKind(row[0])
+		if !ok {
+			return nil, nil, fmt.Errorf("line %d: unknown type %q", line, row[0])
+		}
+		key, err := parseStatRecordKey(kind, row[1])
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		records = append(records, statRecord{key, statInstData{Hits: (int32)(hits), Bytes: bytes}})
+	}
+}
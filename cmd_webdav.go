@@ -33,11 +33,12 @@ import (
 )
 
 func cmdUploadWebdav(args []string) {
-	config = readConfig()
+	cfg := readConfig()
+	setConfig(&cfg)
 
 	var localOpt *LocalStorageOption
 	webdavOpts := make([]*WebDavStorageOption, 0, 4)
-	for _, s := range config.Storages {
+	for _, s := range config().Storages {
 		switch s := s.Data.(type) {
 		case *LocalStorageOption:
 			if localOpt == nil {
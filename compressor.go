@@ -22,17 +22,42 @@ package main
 import (
 	"compress/gzip"
 	"compress/zlib"
+	"errors"
 	"io"
+	"os"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
 )
 
 type Compressor string
 
 const (
-	NullCompressor Compressor = ""
-	ZlibCompressor Compressor = "zlib"
-	GzipCompressor Compressor = "gzip"
+	NullCompressor   Compressor = ""
+	ZlibCompressor   Compressor = "zlib"
+	GzipCompressor   Compressor = "gzip"
+	ZstdCompressor   Compressor = "zstd"
+	BrotliCompressor Compressor = "br"
 )
 
+// precompressedVariants are the compressors which can be served to the clients directly,
+// ordered by preference
+var precompressedVariants = []Compressor{
+	BrotliCompressor,
+	ZstdCompressor,
+	GzipCompressor,
+}
+
+func ParseCompressor(s string) (c Compressor, ok bool) {
+	switch c = (Compressor)(s); c {
+	case NullCompressor, ZlibCompressor, GzipCompressor, ZstdCompressor, BrotliCompressor:
+		return c, true
+	case "brotli":
+		return BrotliCompressor, true
+	}
+	return "", false
+}
+
 func (c Compressor) Ext() string {
 	switch c {
 	case NullCompressor:
@@ -41,6 +66,10 @@ func (c Compressor) Ext() string {
 		return ".zz"
 	case GzipCompressor:
 		return ".gz"
+	case ZstdCompressor:
+		return ".zst"
+	case BrotliCompressor:
+		return ".br"
 	default:
 		panic("Unknown compressor: " + c)
 	}
@@ -55,11 +84,32 @@ func (c Compressor) WrapReader(r io.Reader) (io.Reader, error) {
 		return zlib.NewReader(r)
 	case GzipCompressor:
 		return gzip.NewReader(r)
+	case ZstdCompressor:
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case BrotliCompressor:
+		return brotli.NewReader(r), nil
 	default:
 		panic("Unknown compressor: " + c)
 	}
 }
 
+// ContentEncoding returns the name of the compressor in the HTTP Content-Encoding header
+func (c Compressor) ContentEncoding() string {
+	switch c {
+	case NullCompressor:
+		return "identity"
+	case ZlibCompressor:
+		// the HTTP deflate encoding is zlib format
+		return "deflate"
+	default:
+		return (string)(c)
+	}
+}
+
 type nopWriteCloser struct {
 	io.Writer
 }
@@ -77,7 +127,112 @@ func (c Compressor) WrapWriter(w io.Writer) io.WriteCloser {
 		return zlib.NewWriter(w)
 	case GzipCompressor:
 		return gzip.NewWriter(w)
+	case ZstdCompressor:
+		e, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			panic(err) // should never happen since the options are valid
+		}
+		return e
+	case BrotliCompressor:
+		return brotli.NewWriter(w)
 	default:
 		panic("Unknown compressor: " + c)
 	}
 }
+
+// decompressSeeker is a io.ReadSeeker of a compressed file with known decompressed size.
+// Seeking forward will decompress and skip the data, and seeking backward will reopen the file.
+type decompressSeeker struct {
+	path       string
+	compressor Compressor
+	size       int64
+
+	offset int64 // the position of the next Read
+	pos    int64 // the position of the decompress stream
+	fd     *os.File
+	r      io.Reader
+}
+
+var _ io.ReadSeekCloser = (*decompressSeeker)(nil)
+
+func newDecompressSeeker(path string, compressor Compressor, size int64) *decompressSeeker {
+	return &decompressSeeker{
+		path:       path,
+		compressor: compressor,
+		size:       size,
+	}
+}
+
+func (d *decompressSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.offset
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return d.offset, errors.New("decompressSeeker.Seek: invalid whence")
+	}
+	if offset < 0 {
+		return d.offset, errors.New("decompressSeeker.Seek: negative position")
+	}
+	d.offset = offset
+	return offset, nil
+}
+
+func (d *decompressSeeker) Read(buf []byte) (n int, err error) {
+	if d.offset >= d.size {
+		return 0, io.EOF
+	}
+	if d.r == nil || d.offset < d.pos {
+		if err = d.reopen(); err != nil {
+			return
+		}
+	}
+	if d.offset > d.pos {
+		var skipped int64
+		skipped, err = io.CopyN(io.Discard, d.r, d.offset-d.pos)
+		d.pos += skipped
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+	}
+	if rest := d.size - d.offset; (int64)(len(buf)) > rest {
+		buf = buf[:rest]
+	}
+	n, err = d.r.Read(buf)
+	d.pos += (int64)(n)
+	d.offset = d.pos
+	if err == io.EOF && d.offset < d.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+func (d *decompressSeeker) reopen() (err error) {
+	d.Close()
+	if d.fd, err = os.Open(d.path); err != nil {
+		return
+	}
+	if d.r, err = d.compressor.WrapReader(d.fd); err != nil {
+		d.fd.Close()
+		d.fd = nil
+		return
+	}
+	d.pos = 0
+	return
+}
+
+func (d *decompressSeeker) Close() error {
+	if d.r == nil {
+		return nil
+	}
+	if c, ok := d.r.(io.Closer); ok {
+		c.Close()
+	}
+	d.r = nil
+	return d.fd.Close()
+}
@@ -23,9 +23,11 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -45,6 +47,18 @@ type ServeLimitConfig struct {
 	UploadRate int  `yaml:"upload-rate"`
 }
 
+type ClientLimitConfig struct {
+	Enable           bool   `yaml:"enable"`
+	MaxConn          int    `yaml:"max-conn"`
+	UploadRate       int    `yaml:"upload-rate"`
+	SubnetMaxConn    int    `yaml:"subnet-max-conn"`
+	SubnetUploadRate int    `yaml:"subnet-upload-rate"`
+	IPv4Prefix       int    `yaml:"ipv4-prefix"`
+	IPv6Prefix       int    `yaml:"ipv6-prefix"`
+	RetryAfter       int    `yaml:"retry-after"`
+	Message          string `yaml:"message"`
+}
+
 type CacheConfig struct {
 	Type string `yaml:"type"`
 	Data any    `yaml:"data,omitempty"`
@@ -85,6 +99,54 @@ type DashboardConfig struct {
 	PwaName      string `yaml:"pwa-name"`
 	PwaShortName string `yaml:"pwa-short_name"`
 	PwaDesc      string `yaml:"pwa-description"`
+
+	Username string `yaml:"username"`
+	// Password is the bcrypt hash of the password,
+	// plain text password will be hashed and written back when loading the config
+	Password    string       `yaml:"password"`
+	TokenExpire YAMLDuration `yaml:"token-expire"`
+}
+
+type MetricsConfig struct {
+	Enable bool `yaml:"enable"`
+	// Addr is the address for a separate metrics server,
+	// if it's empty, metrics will be served at /metrics on the cluster port,
+	// which requires a dashboard token
+	Addr string `yaml:"addr"`
+}
+
+type HTTP3Config struct {
+	// Enable serves HTTP/3 over QUIC for the clusters with TLS
+	Enable bool `yaml:"enable"`
+	// Port is the UDP port to listen, zero means the same as the cluster port
+	Port uint16 `yaml:"port"`
+	// AltSvcPort is the port advertised by the Alt-Svc header,
+	// zero means the port which the client connected to
+	AltSvcPort uint16 `yaml:"alt-svc-port"`
+}
+
+type ByocTLSConfig struct {
+	// Enable serves TLS for the clusters which bring their own certificates
+	Enable bool `yaml:"enable"`
+	// CertFile and KeyFile are the certificate files, they will be reloaded after changed
+	CertFile string     `yaml:"cert-file"`
+	KeyFile  string     `yaml:"key-file"`
+	Acme     AcmeConfig `yaml:"acme"`
+}
+
+type AcmeConfig struct {
+	// Enable requests the certificates from the ACME server instead of reading the certificate files
+	Enable bool   `yaml:"enable"`
+	Email  string `yaml:"email"`
+	// Domains are the extra domains besides the public hosts of the clusters
+	Domains      []string `yaml:"domains"`
+	DirectoryURL string   `yaml:"directory-url"`
+	// DirectoryCA is the CA certificate file to trust the ACME server, e.g. for Pebble
+	DirectoryCA string `yaml:"directory-ca"`
+	// HTTPAddr is the address to serve HTTP-01 challenges, e.g. :80
+	// If it's empty, only the challenges to the cluster port can be solved
+	HTTPAddr    string       `yaml:"http-addr"`
+	RenewBefore YAMLDuration `yaml:"renew-before"`
 }
 
 type WebDavUser struct {
@@ -93,27 +155,71 @@ type WebDavUser struct {
 	Password string `yaml:"password,omitempty"`
 }
 
+// ClusterOptions is the options of a cluster in the multi-cluster mode
+type ClusterOptions struct {
+	Id         string `yaml:"id"`
+	Secret     string `yaml:"secret"`
+	PublicHost string `yaml:"public-host"`
+	PublicPort uint16 `yaml:"public-port"`
+	Byoc       bool   `yaml:"byoc"`
+}
+
 type Config struct {
-	RecordServeInfo      bool   `yaml:"record-serve-info"`
-	LogSlots             int    `yaml:"log-slots"`
-	Byoc                 bool   `yaml:"byoc"`
-	TrustedXForwardedFor bool   `yaml:"trusted-x-forwarded-for"`
-	PublicHost           string `yaml:"public-host"`
-	PublicPort           uint16 `yaml:"public-port"`
-	Port                 uint16 `yaml:"port"`
-	ClusterId            string `yaml:"cluster-id"`
-	ClusterSecret        string `yaml:"cluster-secret"`
-	SyncInterval         int    `yaml:"sync-interval"`
-	DownloadMaxConn      int    `yaml:"download-max-conn"`
+	RecordServeInfo      bool         `yaml:"record-serve-info"`
+	LogSlots             int          `yaml:"log-slots"`
+	LogFormat            string       `yaml:"log-format"`
+	Byoc                 bool         `yaml:"byoc"`
+	TrustedXForwardedFor bool         `yaml:"trusted-x-forwarded-for"`
+	PublicHost           string       `yaml:"public-host"`
+	PublicPort           uint16       `yaml:"public-port"`
+	Port                 uint16       `yaml:"port"`
+	ClusterId            string       `yaml:"cluster-id"`
+	ClusterSecret        string       `yaml:"cluster-secret"`
+	SyncInterval         int          `yaml:"sync-interval"`
+	DownloadMaxConn      int          `yaml:"download-max-conn"`
+	DrainTimeout         YAMLDuration `yaml:"drain-timeout"`
+
+	// Clusters overrides the cluster options above, so multiple clusters can run in one process
+	Clusters []ClusterOptions `yaml:"clusters,omitempty"`
 
 	Cache       CacheConfig            `yaml:"cache"`
 	ServeLimit  ServeLimitConfig       `yaml:"serve-limit"`
+	ClientLimit ClientLimitConfig      `yaml:"client-limit"`
 	Dashboard   DashboardConfig        `yaml:"dashboard"`
+	Metrics     MetricsConfig          `yaml:"metrics"`
+	ByocTLS     ByocTLSConfig          `yaml:"byoc-tls"`
+	HTTP3       HTTP3Config            `yaml:"http3"`
 	Storages    []StorageOption        `yaml:"storages"`
 	WebdavUsers map[string]*WebDavUser `yaml:"webdav-users"`
 	Advanced    AdvancedConfig         `yaml:"advanced"`
 }
 
+// ClusterList returns the options of the clusters should be run.
+// The top level cluster options will be used if the clusters list is empty.
+func (cfg *Config) ClusterList() (clusters []ClusterOptions) {
+	if len(cfg.Clusters) == 0 {
+		clusters = []ClusterOptions{{
+			Id:         cfg.ClusterId,
+			Secret:     cfg.ClusterSecret,
+			PublicHost: cfg.PublicHost,
+			PublicPort: cfg.PublicPort,
+			Byoc:       cfg.Byoc,
+		}}
+	} else {
+		clusters = make([]ClusterOptions, len(cfg.Clusters))
+		copy(clusters, cfg.Clusters)
+	}
+	for i := range clusters {
+		if clusters[i].PublicPort == 0 {
+			clusters[i].PublicPort = cfg.PublicPort
+		}
+		if clusters[i].PublicPort == 0 {
+			clusters[i].PublicPort = cfg.Port
+		}
+	}
+	return
+}
+
 func (cfg *Config) applyWebManifest(manifest map[string]any) {
 	if cfg.Dashboard.Enable {
 		manifest["name"] = cfg.Dashboard.PwaName
@@ -125,6 +231,7 @@ func (cfg *Config) applyWebManifest(manifest map[string]any) {
 var defaultConfig = Config{
 	RecordServeInfo:      false,
 	LogSlots:             7,
+	LogFormat:            LogFormatText,
 	Byoc:                 false,
 	TrustedXForwardedFor: false,
 	PublicHost:           "",
@@ -134,6 +241,7 @@ var defaultConfig = Config{
 	ClusterSecret:        "${CLUSTER_SECRET}",
 	SyncInterval:         10,
 	DownloadMaxConn:      16,
+	DrainTimeout:         (YAMLDuration)(time.Minute * 5),
 
 	Cache: CacheConfig{
 		Type:     "inmem",
@@ -146,11 +254,53 @@ var defaultConfig = Config{
 		UploadRate: 1024 * 12, // 12MB
 	},
 
+	ClientLimit: ClientLimitConfig{
+		Enable:           false,
+		MaxConn:          16,
+		UploadRate:       0,
+		SubnetMaxConn:    64,
+		SubnetUploadRate: 0,
+		IPv4Prefix:       24,
+		IPv6Prefix:       64,
+		RetryAfter:       5,
+		Message:          "Too many connections from your network, please try again later",
+	},
+
 	Dashboard: DashboardConfig{
 		Enable:       true,
 		PwaName:      "GoOpenBmclApi Dashboard",
 		PwaShortName: "GOBA Dash",
 		PwaDesc:      "Go-Openbmclapi Internal Dashboard",
+
+		Username:    "",
+		Password:    "",
+		TokenExpire: (YAMLDuration)(time.Hour * 24),
+	},
+
+	Metrics: MetricsConfig{
+		Enable: false,
+		Addr:   "",
+	},
+
+	ByocTLS: ByocTLSConfig{
+		Enable:   false,
+		CertFile: "",
+		KeyFile:  "",
+		Acme: AcmeConfig{
+			Enable:       false,
+			Email:        "",
+			Domains:      nil,
+			DirectoryURL: "https://acme-v02.api.letsencrypt.org/directory",
+			DirectoryCA:  "",
+			HTTPAddr:     "",
+			RenewBefore:  (YAMLDuration)(time.Hour * 24 * 30),
+		},
+	},
+
+	HTTP3: HTTP3Config{
+		Enable:     false,
+		Port:       0,
+		AltSvcPort: 0,
 	},
 
 	Storages: nil,
@@ -276,7 +426,23 @@ func migrateConfig(data []byte, config *Config) {
 	}
 }
 
+var errConfigCreated = errors.New("Config file created, please edit it and start the program again")
+
 func readConfig() (config Config) {
+	config, err := loadConfig()
+	if err != nil {
+		logError(err)
+		if errors.Is(err, errConfigCreated) {
+			os.Exit(0xff)
+		}
+		os.Exit(1)
+	}
+	return
+}
+
+// loadConfig reads and normalizes the config file, then writes it back.
+// If the config file does not exist, a default one will be created and errConfigCreated will be returned
+func loadConfig() (config Config, err error) {
 	const configPath = "config.yaml"
 
 	config = defaultConfig
@@ -285,16 +451,16 @@ func readConfig() (config Config) {
 	notexists := false
 	if err != nil {
 		if !errors.Is(err, os.ErrNotExist) {
-			logError("Cannot read config:", err)
-			os.Exit(1)
+			err = fmt.Errorf("Cannot read config: %w", err)
+			return
 		}
 		logError("Config file not exists, create one")
 		notexists = true
 	} else {
 		migrateConfig(data, &config)
 		if err = yaml.Unmarshal(data, &config); err != nil {
-			logError("Cannot parse config:", err)
-			os.Exit(1)
+			err = fmt.Errorf("Cannot parse config: %w", err)
+			return
 		}
 		if len(config.Storages) == 0 {
 			config.Storages = []StorageOption{
@@ -317,6 +483,12 @@ func readConfig() (config Config) {
 				Password: "example-password",
 			}
 		}
+		switch config.LogFormat {
+		case LogFormatText, LogFormatJSON:
+		default:
+			logWarnf("Unknown log format %q, using %q", config.LogFormat, LogFormatText)
+			config.LogFormat = LogFormatText
+		}
 		ids := make(map[string]int, len(config.Storages))
 		for i, s := range config.Storages {
 			if s.Id == "" {
@@ -324,27 +496,53 @@ func readConfig() (config Config) {
 				config.Storages[i].Id = s.Id
 			}
 			if j, ok := ids[s.Id]; ok {
-				logErrorf("Duplicated storage id %q at [%d] and [%d], please edit the config.", s.Id, i, j)
-				os.Exit(1)
+				err = fmt.Errorf("Duplicated storage id %q at [%d] and [%d], please edit the config.", s.Id, i, j)
+				return
 			}
 			ids[s.Id] = i
 		}
+		clusterIds := make(map[string]int, len(config.Clusters))
+		for i, c := range config.Clusters {
+			if c.Id == "" || c.Secret == "" {
+				err = fmt.Errorf("Cluster id or secret is empty at clusters[%d], please edit the config.", i)
+				return
+			}
+			if j, ok := clusterIds[c.Id]; ok {
+				err = fmt.Errorf("Duplicated cluster id %q at [%d] and [%d], please edit the config.", c.Id, i, j)
+				return
+			}
+			clusterIds[c.Id] = i
+		}
+		if tc := config.ByocTLS; tc.Enable && !tc.Acme.Enable && (tc.CertFile == "" || tc.KeyFile == "") {
+			err = errors.New("byoc-tls.cert-file and byoc-tls.key-file are required when ACME is disabled, please edit the config.")
+			return
+		}
+		if pwd := config.Dashboard.Password; pwd != "" && !isBcryptHash(pwd) {
+			if config.Dashboard.Password, err = hashDashboardPassword(pwd); err != nil {
+				err = fmt.Errorf("Cannot hash dashboard password: %w", err)
+				return
+			}
+			logInfo("Dashboard password has been hashed")
+		}
 	}
 
 	var buf bytes.Buffer
 	encoder := yaml.NewEncoder(&buf)
 	encoder.SetIndent(2)
 	if err = encoder.Encode(config); err != nil {
-		logError("Cannot encode config:", err)
-		os.Exit(1)
+		err = fmt.Errorf("Cannot encode config: %w", err)
+		return
 	}
-	if err = os.WriteFile(configPath, buf.Bytes(), 0600); err != nil {
-		logError("Cannot write config:", err)
-		os.Exit(1)
+	if err = writeFileAtomic(configPath, 0600, func(w io.Writer) error {
+		_, err := buf.WriteTo(w)
+		return err
+	}); err != nil {
+		err = fmt.Errorf("Cannot write config: %w", err)
+		return
 	}
 	if notexists {
-		logError("Config file created, please edit it and start the program again")
-		os.Exit(0xff)
+		err = errConfigCreated
+		return
 	}
 
 	if os.Getenv("DEBUG") == "true" {
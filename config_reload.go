@@ -0,0 +1,90 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"reflect"
+)
+
+// reloadConfig reads the config file again and applies the changes in place.
+// It returns true if some changed options can only take effect after a full restart,
+// in that case nothing will be applied.
+func reloadConfig(storages *SharedStorages, cache *SwitchableCache, limiter *LimitedListener) (restart bool) {
+	newConfig, err := loadConfig()
+	if err != nil {
+		logError("Cannot reload config, keeping the current one:", err)
+		return false
+	}
+	oldConfig := config()
+	if configRequiresRestart(oldConfig, &newConfig) {
+		return true
+	}
+
+	// the readers may still hold the old config, so a new one is published instead of modifying it
+	newConfig.applyWebManifest(dsbManifest)
+	setConfig(&newConfig)
+
+	if !reflect.DeepEqual(oldConfig.Cache.Type, newConfig.Cache.Type) || !reflect.DeepEqual(oldConfig.Cache.Data, newConfig.Cache.Data) {
+		logInfof("Switching cache to %q", newConfig.Cache.Type)
+		cache.Switch(newConfig.Cache.newCache())
+	}
+	if limiter != nil && oldConfig.ServeLimit.UploadRate != newConfig.ServeLimit.UploadRate {
+		logInfof("Changing serve upload rate to %d KiB/s", newConfig.ServeLimit.UploadRate)
+		limiter.SetWriteRate(newConfig.ServeLimit.UploadRate * 1024)
+	}
+	weights := make([]uint, len(newConfig.Storages))
+	for i, s := range newConfig.Storages {
+		weights[i] = s.Weight
+	}
+	storages.SetStorageWeights(weights)
+
+	logInfo("Config reloaded")
+	return false
+}
+
+// configRequiresRestart reports whether the options which cannot be changed at runtime are different
+func configRequiresRestart(oldConfig, newConfig *Config) bool {
+	if len(oldConfig.Storages) != len(newConfig.Storages) {
+		return true
+	}
+	for i, s := range oldConfig.Storages {
+		n := newConfig.Storages[i]
+		if s.Id != n.Id || s.Type != n.Type || !reflect.DeepEqual(s.Data, n.Data) {
+			return true
+		}
+	}
+
+	a, b := *oldConfig, *newConfig
+	for _, c := range []*Config{&a, &b} {
+		// the options below can be changed at runtime
+		c.RecordServeInfo = false
+		c.LogSlots = 0
+		c.LogFormat = ""
+		c.TrustedXForwardedFor = false
+		c.DrainTimeout = 0
+		c.ServeLimit.UploadRate = 0
+		c.ClientLimit = ClientLimitConfig{}
+		c.Cache = CacheConfig{}
+		c.Dashboard = DashboardConfig{}
+		c.Storages = nil
+		c.Advanced = AdvancedConfig{}
+	}
+	return !reflect.DeepEqual(a, b)
+}
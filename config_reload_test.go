@@ -0,0 +1,57 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+func TestConfigRequiresRestart(t *testing.T) {
+	newStorages := func(weight uint, path string) []StorageOption {
+		return []StorageOption{{
+			BasicStorageOption: BasicStorageOption{Id: "local", Type: StorageLocal, Weight: weight},
+			Data:               &LocalStorageOption{CachePath: path},
+		}}
+	}
+	oldConfig := defaultConfig
+	oldConfig.Storages = newStorages(100, "cache")
+
+	newConfig := oldConfig
+	newConfig.RecordServeInfo = true
+	newConfig.LogFormat = LogFormatJSON
+	newConfig.ServeLimit.UploadRate = 1
+	newConfig.Dashboard.Username = "admin"
+	newConfig.Advanced.DebugLog = true
+	newConfig.Cache = CacheConfig{Type: "none"}
+	newConfig.Storages = newStorages(50, "cache")
+	if configRequiresRestart(&oldConfig, &newConfig) {
+		t.Errorf("Runtime options should not require restart")
+	}
+
+	newConfig.Port++
+	if !configRequiresRestart(&oldConfig, &newConfig) {
+		t.Errorf("Changing port should require restart")
+	}
+	newConfig.Port = oldConfig.Port
+	newConfig.Storages = newStorages(100, "other")
+	if !configRequiresRestart(&oldConfig, &newConfig) {
+		t.Errorf("Changing storage path should require restart")
+	}
+}
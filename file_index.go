@@ -0,0 +1,365 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileIndexCompactThreshold is the minimum count of stale records before the index file get compacted
+const fileIndexCompactThreshold = 4096
+
+type FileIndexEntry struct {
+	Size int64
+	// ModTime is the time (in unix millisecond) that the file was recorded
+	ModTime int64
+	// VerifiedAt is the last time (in unix millisecond) that the file passed hash check
+	VerifiedAt int64
+}
+
+// FileIndex is a persistent record of the files in a storage,
+// so the cluster does not have to walk the whole storage on every sync.
+//
+// The index is stored as an append-only text file, each line is one of:
+//
+//	<hash> <size> <modtime> <verified-at>
+//	-<hash>
+//
+// The later records override the former ones, and the file will be rewritten when it contains too many stale records.
+// The index file only exists after the index was rebuilt from a full storage walk,
+// before that the index is not ready and will not record any change.
+type FileIndex struct {
+	mux     sync.RWMutex
+	path    string
+	fd      *os.File
+	w       *bufio.Writer
+	entries map[string]FileIndexEntry
+	ready   bool
+	dirty   bool
+	stale   int
+}
+
+// OpenFileIndex loads the index file at path if it exists
+func OpenFileIndex(path string) (idx *FileIndex, err error) {
+	idx = &FileIndex{
+		path:    path,
+		entries: make(map[string]FileIndexEntry),
+	}
+	fd, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return idx, nil
+		}
+		return nil, err
+	}
+	defer fd.Close()
+	broken := false
+	sc := bufio.NewScanner(fd)
+	for sc.Scan() {
+		if !idx.parseLine(sc.Text()) {
+			broken = true
+		}
+	}
+	if err = sc.Err(); err != nil {
+		return nil, err
+	}
+	if broken {
+		// rewrite the file, so new records will not be appended after a broken line
+		err = idx.compact()
+	} else {
+		err = idx.openAppend()
+	}
+	if err != nil {
+		return nil, err
+	}
+	idx.ready = true
+	return idx, nil
+}
+
+// parseLine applies one record, and reports whether the record is valid.
+// Broken lines (e.g. the process was killed during write) are ignored
+func (idx *FileIndex) parseLine(line string) bool {
+	if len(line) == 0 {
+		return false
+	}
+	if line[0] == '-' {
+		hash := line[1:]
+		if _, ok := idx.entries[hash]; ok {
+			delete(idx.entries, hash)
+			idx.stale++
+		}
+		return true
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 4 || !IsHex(fields[0]) {
+		return false
+	}
+	var (
+		e   FileIndexEntry
+		err error
+	)
+	if e.Size, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+		return false
+	}
+	if e.ModTime, err = strconv.ParseInt(fields[2], 10, 64); err != nil {
+		return false
+	}
+	if e.VerifiedAt, err = strconv.ParseInt(fields[3], 10, 64); err != nil {
+		return false
+	}
+	if _, ok := idx.entries[fields[0]]; ok {
+		idx.stale++
+	}
+	idx.entries[fields[0]] = e
+	return true
+}
+
+func (idx *FileIndex) openAppend() (err error) {
+	if idx.fd, err = os.OpenFile(idx.path, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return
+	}
+	idx.w = bufio.NewWriter(idx.fd)
+	return
+}
+
+// Ready reports whether the index contains all files in the storage
+func (idx *FileIndex) Ready() bool {
+	if idx == nil {
+		return false
+	}
+	idx.mux.RLock()
+	defer idx.mux.RUnlock()
+	return idx.ready
+}
+
+func (idx *FileIndex) Len() int {
+	if idx == nil {
+		return 0
+	}
+	idx.mux.RLock()
+	defer idx.mux.RUnlock()
+	return len(idx.entries)
+}
+
+func (idx *FileIndex) Get(hash string) (e FileIndexEntry, ok bool) {
+	if idx == nil {
+		return
+	}
+	idx.mux.RLock()
+	defer idx.mux.RUnlock()
+	e, ok = idx.entries[hash]
+	return
+}
+
+// Sizes returns a copy of hash to size map
+func (idx *FileIndex) Sizes() map[string]int64 {
+	idx.mux.RLock()
+	defer idx.mux.RUnlock()
+	sizes := make(map[string]int64, len(idx.entries))
+	for hash, e := range idx.entries {
+		sizes[hash] = e.Size
+	}
+	return sizes
+}
+
+// Walk calls walker for each file in the index,
+// it has the same signature as Storage.WalkDir
+func (idx *FileIndex) Walk(walker func(hash string, size int64) error) error {
+	for hash, size := range idx.Sizes() {
+		if err := walker(hash, size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (idx *FileIndex) writeRecord(hash string, e FileIndexEntry) error {
+	_, err := fmt.Fprintf(idx.w, "%s %d %d %d\n", hash, e.Size, e.ModTime, e.VerifiedAt)
+	return err
+}
+
+func (idx *FileIndex) commit() (err error) {
+	if err = idx.w.Flush(); err != nil {
+		return
+	}
+	if idx.stale > fileIndexCompactThreshold && idx.stale > len(idx.entries) {
+		return idx.compact()
+	}
+	return
+}
+
+// Put records that a file is created
+func (idx *FileIndex) Put(hash string, size int64) error {
+	if idx == nil {
+		return nil
+	}
+	idx.mux.Lock()
+	defer idx.mux.Unlock()
+	if !idx.ready {
+		return nil
+	}
+	e := FileIndexEntry{
+		Size:    size,
+		ModTime: time.Now().UnixMilli(),
+	}
+	if _, ok := idx.entries[hash]; ok {
+		idx.stale++
+	}
+	idx.entries[hash] = e
+	if err := idx.writeRecord(hash, e); err != nil {
+		return err
+	}
+	return idx.commit()
+}
+
+// Delete records that a file is removed
+func (idx *FileIndex) Delete(hash string) error {
+	if idx == nil {
+		return nil
+	}
+	idx.mux.Lock()
+	defer idx.mux.Unlock()
+	if !idx.ready {
+		return nil
+	}
+	if _, ok := idx.entries[hash]; !ok {
+		return nil
+	}
+	delete(idx.entries, hash)
+	idx.stale++
+	if _, err := fmt.Fprintf(idx.w, "-%s\n", hash); err != nil {
+		return err
+	}
+	return idx.commit()
+}
+
+// SetVerified marks the file passed the hash check,
+// the change is only kept in memory until the next Save
+func (idx *FileIndex) SetVerified(hash string) {
+	if idx == nil {
+		return
+	}
+	idx.mux.Lock()
+	defer idx.mux.Unlock()
+	if e, ok := idx.entries[hash]; ok {
+		e.VerifiedAt = time.Now().UnixMilli()
+		idx.entries[hash] = e
+		idx.dirty = true
+	}
+}
+
+// Rebuild replaces the index with the result of a full storage walk.
+// The record time and verify time are kept for the files whose size did not change
+func (idx *FileIndex) Rebuild(sizes map[string]int64) error {
+	if idx == nil {
+		return nil
+	}
+	idx.mux.Lock()
+	defer idx.mux.Unlock()
+	now := time.Now().UnixMilli()
+	entries := make(map[string]FileIndexEntry, len(sizes))
+	for hash, size := range sizes {
+		if e, ok := idx.entries[hash]; ok && e.Size == size {
+			entries[hash] = e
+		} else {
+			entries[hash] = FileIndexEntry{
+				Size:    size,
+				ModTime: now,
+			}
+		}
+	}
+	idx.entries = entries
+	return idx.compact()
+}
+
+// Save writes the in-memory changes into the index file
+func (idx *FileIndex) Save() error {
+	if idx == nil {
+		return nil
+	}
+	idx.mux.Lock()
+	defer idx.mux.Unlock()
+	if !idx.ready || !idx.dirty {
+		return nil
+	}
+	return idx.compact()
+}
+
+// compact rewrites the index file with the current entries
+func (idx *FileIndex) compact() (err error) {
+	// the index is not usable until the file is successfully rewritten
+	idx.ready = false
+	if idx.fd != nil {
+		idx.w.Flush()
+		idx.fd.Close()
+		idx.fd, idx.w = nil, nil
+	}
+	if err = os.MkdirAll(filepath.Dir(idx.path), 0755); err != nil {
+		return
+	}
+	err = writeFileAtomic(idx.path, 0644, func(w io.Writer) error {
+		idx.w = bufio.NewWriter(w)
+		defer func() { idx.w = nil }()
+		for hash, e := range idx.entries {
+			if err := idx.writeRecord(hash, e); err != nil {
+				return err
+			}
+		}
+		return idx.w.Flush()
+	})
+	if err != nil {
+		return
+	}
+	if err = idx.openAppend(); err != nil {
+		return
+	}
+	idx.ready = true
+	idx.dirty = false
+	idx.stale = 0
+	return
+}
+
+func (idx *FileIndex) Close() error {
+	if idx == nil {
+		return nil
+	}
+	idx.mux.Lock()
+	defer idx.mux.Unlock()
+	if idx.fd == nil {
+		return nil
+	}
+	if idx.dirty {
+		// ignore the error since the index can be rebuilt
+		idx.compact()
+	}
+	idx.w.Flush()
+	err := idx.fd.Close()
+	idx.fd, idx.w = nil, nil
+	idx.ready = false
+	return err
+}
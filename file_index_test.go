@@ -0,0 +1,89 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"os"
+	"path/filepath"
+)
+
+func TestFileIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index", "test.idx")
+	idx, err := OpenFileIndex(path)
+	if err != nil {
+		t.Fatalf("Cannot open index: %v", err)
+	}
+	if idx.Ready() {
+		t.Fatalf("New index should not be ready")
+	}
+	// changes should be ignored before the index is built
+	idx.Put("aa", 1)
+	if _, ok := idx.Get("aa"); ok {
+		t.Errorf("Index recorded a file before rebuild")
+	}
+
+	if err := idx.Rebuild(map[string]int64{"00": 10, "01": 11}); err != nil {
+		t.Fatalf("Cannot rebuild index: %v", err)
+	}
+	if !idx.Ready() {
+		t.Fatalf("Index should be ready after rebuild")
+	}
+	idx.Put("02", 12)
+	idx.Put("00", 20)
+	idx.Delete("01")
+	idx.SetVerified("02")
+	if err := idx.Close(); err != nil {
+		t.Fatalf("Cannot close index: %v", err)
+	}
+
+	// simulate a broken tail written by a crashed process
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("Cannot open index file: %v", err)
+	}
+	fd.WriteString("03 1")
+	fd.Close()
+
+	if idx, err = OpenFileIndex(path); err != nil {
+		t.Fatalf("Cannot reopen index: %v", err)
+	}
+	if !idx.Ready() {
+		t.Fatalf("Reopened index should be ready")
+	}
+	sizes := idx.Sizes()
+	if len(sizes) != 2 || sizes["00"] != 20 || sizes["02"] != 12 {
+		t.Errorf("Unexpected index content: %v", sizes)
+	}
+	if e, _ := idx.Get("02"); e.VerifiedAt == 0 {
+		t.Errorf("Verify time is not saved")
+	}
+	idx.Put("04", 14)
+	idx.Close()
+
+	if idx, err = OpenFileIndex(path); err != nil {
+		t.Fatalf("Cannot reopen index: %v", err)
+	}
+	defer idx.Close()
+	if e, ok := idx.Get("04"); !ok || e.Size != 14 {
+		t.Errorf("Record after broken line is lost")
+	}
+}
@@ -20,6 +20,7 @@
 package main
 
 import (
+	"bufio"
 	"crypto"
 	"encoding/hex"
 	"errors"
@@ -48,6 +49,10 @@ type statusResponseWriter struct {
 	http.ResponseWriter
 	status int
 	wrote  int64
+	// storage is the id of the storage which served the download
+	storage string
+	// served is the size of the downloaded file, which may be larger than wrote if the download is redirected
+	served int64
 }
 
 func (w *statusResponseWriter) WriteHeader(status int) {
@@ -61,6 +66,45 @@ func (w *statusResponseWriter) Write(buf []byte) (n int, err error) {
 	return
 }
 
+func (w *statusResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *statusResponseWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *statusResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
+
+// clientWriter remembers the error of writing to the client,
+// so it can be told apart from the errors of the storage
+type clientWriter struct {
+	http.ResponseWriter
+	err error
+}
+
+func (w *clientWriter) Write(buf []byte) (n int, err error) {
+	n, err = w.ResponseWriter.Write(buf)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return
+}
+
+func (w *clientWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *clientWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
 func (cr *Cluster) GetHandler() (handler http.Handler) {
 	cr.handlerAPIv0 = http.StripPrefix("/api/v0", cr.initAPIv0())
 
@@ -75,10 +119,11 @@ func (cr *Cluster) GetHandler() (handler http.Handler) {
 
 		next := handler
 		handler = (http.HandlerFunc)(func(rw http.ResponseWriter, req *http.Request) {
+			cfg := config()
 			rw.Header().Set("X-Powered-By", "go-openbmclapi; url=https://github.com/LiterMC/go-openbmclapi")
 			ua := req.Header.Get("User-Agent")
 			var addr string
-			if config.TrustedXForwardedFor {
+			if cfg.TrustedXForwardedFor {
 				// X-Forwarded-For: <client>, <proxy1>, <proxy2>
 				adr, _ := split(req.Header.Get("X-Forwarded-For"), ',')
 				addr = strings.TrimSpace(adr)
@@ -86,30 +131,71 @@ func (cr *Cluster) GetHandler() (handler http.Handler) {
 			if addr == "" {
 				addr, _, _ = net.SplitHostPort(req.RemoteAddr)
 			}
-			if config.RecordServeInfo {
+			if cfg.RecordServeInfo {
 				logDebugf("Serving %s | %-4s %s | %q", addr, req.Method, req.RequestURI, ua)
 			}
 			srw := &statusResponseWriter{ResponseWriter: rw}
 			start := time.Now()
 
-			next.ServeHTTP(srw, req)
+			if cfg.ClientLimit.Enable && strings.HasPrefix(req.URL.Path, "/download/") {
+				if w, release, ok := cr.clientLimiter.Limit(rw, req, addr); ok {
+					srw.ResponseWriter = w
+					func() {
+						// the connection must be released even if the handler panics
+						defer release()
+						next.ServeHTTP(srw, req)
+					}()
+				} else {
+					// the 429 response was written directly
+					srw.status = http.StatusTooManyRequests
+				}
+			} else {
+				next.ServeHTTP(srw, req)
+			}
 
 			used := time.Since(start)
-			if config.RecordServeInfo {
+			if cfg.Metrics.Enable {
+				status := srw.status
+				if status == 0 {
+					status = http.StatusOK
+				}
+				route := getRequestRoute(req.URL.EscapedPath())
+				metricHTTPRequests.With(route, strconv.Itoa(status)).Inc()
+				metricHTTPDuration.With(route).Observe(used.Seconds())
+			}
+			if cfg.RecordServeInfo {
 				if used > time.Minute {
 					used = used.Truncate(time.Second)
 				} else if used > time.Second {
 					used = used.Truncate(time.Microsecond)
 				}
-				logInfof("Serve %d | %12v | %7s | %-15s | %s | %-4s %s | %q",
+				fields := LogFields{
+					"status":      srw.status,
+					"duration":    used,
+					"bytes":       srw.wrote,
+					"remote_addr": addr,
+					"proto":       req.Proto,
+					"method":      req.Method,
+					"uri":         req.RequestURI,
+					"user_agent":  ua,
+				}
+				if hash, ok := strings.CutPrefix(req.URL.Path, "/download/"); ok {
+					fields["hash"] = hash
+				}
+				if srw.storage != "" {
+					fields["storage"] = srw.storage
+				}
+				logInfofWith(fields, "Serve %d | %12v | %7s | %-15s | %s | %-4s %s | %q",
 					srw.status, used, bytesToUnit((float64)(srw.wrote)),
 					addr, req.Proto,
 					req.Method, req.RequestURI, ua)
 			}
-			if srw.status < 200 && 400 <= srw.status {
+			hash, ok := strings.CutPrefix(req.URL.Path, "/download/")
+			if !ok {
 				return
 			}
-			if !strings.HasPrefix(req.URL.Path, "/download/") {
+			cr.recordAccess(req, srw, hash, ua)
+			if srw.status < 200 && 400 <= srw.status {
 				return
 			}
 			var rec record
@@ -178,6 +264,21 @@ func (cr *Cluster) GetHandler() (handler http.Handler) {
 	return
 }
 
+// recordAccess records the download request in the access analytics
+func (cr *Cluster) recordAccess(req *http.Request, srw *statusResponseWriter, hash string, ua string) {
+	status := srw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	bytes := srw.wrote
+	if srw.served > bytes {
+		bytes = srw.served
+	}
+	ua, _ = split(ua, ' ')
+	ua, _ = split(ua, '/')
+	cr.analytics.Record(hash, req.URL.Query().Get("name"), ua, status, bytes, time.Now())
+}
+
 var emptyHashes = func() (hashes map[string]struct{}) {
 	hashMethods := []crypto.Hash{
 		crypto.MD5, crypto.SHA1,
@@ -215,6 +316,11 @@ func (cr *Cluster) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 			return
 		}
 
+		if !cr.beginTransfer(rw) {
+			return
+		}
+		defer cr.endTransfer()
+
 		logDebugf("Handling download %s", hash)
 		cr.handleDownload(rw, req, hash)
 		return
@@ -240,6 +346,10 @@ func (cr *Cluster) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 			http.Error(rw, fmt.Sprintf("measure size %d out of range (0, 200]", n), http.StatusBadRequest)
 			return
 		}
+		if !cr.beginTransfer(rw) {
+			return
+		}
+		defer cr.endTransfer()
 		if err := cr.storages[0].ServeMeasure(rw, req, n); err != nil {
 			logErrorf("Could not serve measure %d: %v", n, err)
 			http.Error(rw, err.Error(), http.StatusInternalServerError)
@@ -253,13 +363,21 @@ func (cr *Cluster) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 			return
 		}
 	case strings.HasPrefix(rawpath, "/dashboard/"):
-		if !config.Dashboard.Enable {
+		if !config().Dashboard.Enable {
 			http.NotFound(rw, req)
 			return
 		}
 		pth := rawpath[len("/dashboard/"):]
 		cr.serveDashboard(rw, req, pth)
 		return
+	case rawpath == "/metrics":
+		if m := config().Metrics; !m.Enable || m.Addr != "" {
+			http.NotFound(rw, req)
+			return
+		}
+		// the cluster port is public, so the metrics require a dashboard token here
+		cr.apiAuthHandle(defaultMetrics).ServeHTTP(rw, req)
+		return
 	case rawpath == "/" || rawpath == "/dashboard":
 		http.Redirect(rw, req, "/dashboard/", http.StatusFound)
 		return
@@ -284,7 +402,7 @@ func (cr *Cluster) handleDownload(rw http.ResponseWriter, req *http.Request, has
 		return
 	}
 
-	if !cr.shouldEnable.Load() {
+	if !cr.shouldEnable.Load() && !cr.servingOffline.Load() {
 		// do not serve file if cluster is not enabled yet
 		http.Error(rw, "Cluster is not enabled yet", http.StatusServiceUnavailable)
 		return
@@ -299,21 +417,69 @@ func (cr *Cluster) handleDownload(rw http.ResponseWriter, req *http.Request, has
 			return
 		}
 	}
-	forEachFromRandomIndexWithPossibility(cr.storageWeights, cr.storageTotalWeight, func(i int) bool {
+	cr.storageWeightMux.RLock()
+	weights, totalWeight := cr.storageWeights, cr.storageTotalWeight
+	cr.storageWeightMux.RUnlock()
+	// exclude the unhealthy storages, unless all of them are unhealthy
+	available := make([]bool, len(weights))
+	availWeights := make([]uint, len(weights))
+	var availTotal uint = 0
+	anyAvailable := false
+	for i, w := range weights {
+		if cr.storageHealth[i].Available() {
+			available[i] = true
+			anyAvailable = true
+			availWeights[i] = w
+			availTotal += w
+		}
+	}
+	if anyAvailable {
+		weights, totalWeight = availWeights, availTotal
+	}
+	clientGone := false
+	forEachFromRandomIndexWithPossibility(weights, totalWeight, func(i int) bool {
+		if anyAvailable && !available[i] {
+			return false
+		}
 		storage := cr.storages[i]
 		logDebugf("[handler]: Checking file on Storage [%d] %s ...", i, storage.String())
 
-		sz, er := storage.ServeDownload(rw, req, hash, size)
+		start := time.Now()
+		crw := &clientWriter{ResponseWriter: rw}
+		sz, er := storage.ServeDownload(crw, req, hash, size)
+		if er != nil && (crw.err != nil || req.Context().Err() != nil) {
+			// the client is gone, it does not mean the storage is not working
+			err = er
+			clientGone = true
+			return true
+		}
+		if cr.storageHealth[i].Record(er, time.Since(start)) {
+			id := cr.storageOpts[i].Id
+			logWarnfWith(LogFields{"storage": id, "error": er}, "Storage %s is marked as unhealthy after repeated failures: %v", id, er)
+		}
 		if er != nil {
 			err = er
 			return false
 		}
+		if srw, ok := rw.(*statusResponseWriter); ok {
+			srw.storage = cr.storageOpts[i].Id
+			srw.served = sz
+		}
 		if sz >= 0 {
 			cr.hits.Add(1)
 			cr.hbts.Add(sz)
+			if config().Metrics.Enable {
+				id := cr.storageOpts[i].Id
+				metricDownloadHits.With(id).Inc()
+				metricDownloadBytes.With(id).Add((float64)(sz))
+			}
 		}
 		return true
 	})
+	if clientGone {
+		logDebugf("[handler]: client aborted download %s: %v", hash, err)
+		return
+	}
 	if err != nil {
 		logDebugf("[handler]: failed to serve download: %v", err)
 		if errors.Is(err, os.ErrNotExist) {
@@ -47,6 +47,7 @@ func printHelp() {
 	fmt.Println("      " + "all | a : Compress all files")
 	fmt.Println("      " + "overwrite | o : Overwrite compressed file even if it exists")
 	fmt.Println("      " + "keep | k : Keep uncompressed file")
+	fmt.Println("      " + "format=<formats> : Comma separated compress formats, can be gzip, zstd and br. Default is gzip")
 	fmt.Println()
 	fmt.Println("  unzip-cache [options ...]")
 	fmt.Println("  \t" + "Decompress the cache directory")
@@ -58,4 +59,20 @@ func printHelp() {
 	fmt.Println()
 	fmt.Println("  upload-webdav")
 	fmt.Println("  \t" + "Upload objects from local storage to webdav storage")
+	fmt.Println()
+	fmt.Println("  export-stats [options ...] <file>")
+	fmt.Println("  \t" + "Export the hourly, daily, monthly and yearly stats and the user agent accesses")
+	fmt.Println()
+	fmt.Println("    Options:")
+	fmt.Println("      " + "format=json|csv : Output format. Default is csv if the file ends with .csv, otherwise json")
+	fmt.Println("      " + "cluster=<id> : Export the stats of the cluster instead of the total stats")
+	fmt.Println()
+	fmt.Println("  import-stats [options ...] <file>")
+	fmt.Println("  \t" + "Merge the stats exported by export-stats (or a stat.json) into the existing stats")
+	fmt.Println("  \t" + "The server should be stopped before importing")
+	fmt.Println()
+	fmt.Println("    Options:")
+	fmt.Println("      " + "format=json|csv : Input format. Default is detected from the content")
+	fmt.Println("      " + "cluster=<id> : Import into the stats of the cluster instead of the total stats")
+	fmt.Println("      " + "conflict=sum|max|keep|replace : How to merge the periods exist in both stats. Default is sum")
 }
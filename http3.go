@@ -0,0 +1,137 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+const http3AltSvcMaxAge = 60 * 60 * 24
+
+// altSvcHandler advertises HTTP/3 to the clients which connected with TLS over TCP.
+// If port is zero, the port the client connected to will be advertised
+func altSvcHandler(next http.Handler, port uint16) http.Handler {
+	return (http.HandlerFunc)(func(rw http.ResponseWriter, req *http.Request) {
+		if req.TLS != nil && req.ProtoMajor < 3 {
+			p := strconv.Itoa((int)(port))
+			if port == 0 {
+				p = "443"
+				if _, hp, err := net.SplitHostPort(req.Host); err == nil {
+					p = hp
+				}
+			}
+			rw.Header().Set("Alt-Svc", `h3=":`+p+`"; ma=`+strconv.Itoa(http3AltSvcMaxAge))
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// newHTTP3Server creates a HTTP/3 server which listens on the UDP address.
+// If limiter is not nil, the QUIC connections share its connection count and upload rate with the TCP connections
+func newHTTP3Server(addr string, handler http.Handler, tlsConfig *tls.Config, limiter *RateController) (*http3.Server, QUICListener, error) {
+	tlsConfig = http3.ConfigureTLSConfig(tlsConfig)
+	listener, err := quic.ListenAddrEarly(addr, tlsConfig, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	var ln QUICListener = listener
+	if limiter != nil {
+		ln = newLimitedQUICListener(listener, limiter)
+		handler = limitedResponseHandler(handler, limiter)
+	}
+	svr := &http3.Server{
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+	}
+	return svr, ln, nil
+}
+
+type QUICListener = http3.QUICEarlyListener
+
+// limitedQUICListener blocks accepting new connections when there are too many connections
+type limitedQUICListener struct {
+	QUICListener
+	controller *RateController
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newLimitedQUICListener(l QUICListener, controller *RateController) *limitedQUICListener {
+	return &limitedQUICListener{
+		QUICListener: l,
+		controller:   controller,
+		closed:       make(chan struct{}),
+	}
+}
+
+// Close will not close the controller since it's shared with the TCP listener
+func (l *limitedQUICListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.QUICListener.Close()
+}
+
+func (l *limitedQUICListener) Accept(ctx context.Context) (quic.EarlyConnection, error) {
+	if !l.controller.AcquireWithNotify(l.closed) {
+		return nil, net.ErrClosed
+	}
+	conn, err := l.QUICListener.Accept(ctx)
+	if err != nil {
+		l.controller.Release()
+		return nil, err
+	}
+	go func() {
+		<-conn.Context().Done()
+		l.controller.Release()
+	}()
+	return conn, nil
+}
+
+// limitedResponseHandler limits the upload rate of the responses,
+// since the QUIC streams cannot be limited at the connection level
+func limitedResponseHandler(next http.Handler, controller *RateController) http.Handler {
+	return (http.HandlerFunc)(func(rw http.ResponseWriter, req *http.Request) {
+		next.ServeHTTP(&limitedResponseWriter{
+			ResponseWriter: rw,
+			w:              &LimitedWriter{Writer: rw, controller: controller},
+		}, req)
+	})
+}
+
+type limitedResponseWriter struct {
+	http.ResponseWriter
+	w *LimitedWriter
+}
+
+func (w *limitedResponseWriter) Write(buf []byte) (int, error) {
+	return w.w.Write(buf)
+}
+
+func (w *limitedResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
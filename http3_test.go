@@ -0,0 +1,105 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestAltSvcHandler(t *testing.T) {
+	handler := altSvcHandler((http.HandlerFunc)(func(rw http.ResponseWriter, req *http.Request) {}), 0)
+	tests := []struct {
+		host  string
+		tls   bool
+		proto int
+		want  string
+	}{
+		{"example.com", true, 1, `h3=":443"; ma=86400`},
+		{"example.com:8443", true, 2, `h3=":8443"; ma=86400`},
+		{"example.com:8443", false, 1, ""},
+		{"example.com:8443", true, 3, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = tt.host
+		req.ProtoMajor = tt.proto
+		if !tt.tls {
+			req.TLS = nil
+		} else {
+			req.TLS = &tls.ConnectionState{}
+		}
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		if got := rw.Header().Get("Alt-Svc"); got != tt.want {
+			t.Errorf("Alt-Svc for %s (TLS=%v, HTTP/%d) = %q, want %q", tt.host, tt.tls, tt.proto, got, tt.want)
+		}
+	}
+}
+
+func TestHTTP3Server(t *testing.T) {
+	cert := newTestCertificate(t, "example.com")
+	handler := (http.HandlerFunc)(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, req.Proto)
+	})
+	limiter := NewRateController(1, 0, 1024*1024)
+	svr, listener, err := newHTTP3Server("127.0.0.1:0", handler, &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+	}, limiter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go svr.ServeListener(listener)
+	defer svr.Close()
+	defer listener.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	rt := &http3.RoundTripper{
+		TLSClientConfig: &tls.Config{
+			RootCAs:    roots,
+			ServerName: "example.com",
+		},
+	}
+	defer rt.Close()
+	client := &http.Client{Transport: rt}
+	res, err := client.Get("https://" + listener.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (string)(body) != "HTTP/3.0" {
+		t.Errorf("Unexpected response %q", body)
+	}
+	if n := limiter.Len(); n != 1 {
+		t.Errorf("Expected 1 limited connection, got %d", n)
+	}
+}
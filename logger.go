@@ -21,12 +21,14 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -48,7 +50,7 @@ func setLogOutput(out io.Writer) {
 }
 
 func logWrite(level LogLevel, buf []byte) {
-	if level <= LogLevelDebug && !config.Advanced.DebugLog {
+	if level <= LogLevelDebug && !config().Advanced.DebugLog {
 		return
 	}
 	{
@@ -89,22 +91,157 @@ func (l LogLevel) String() string {
 	}
 }
 
+// jsonName returns the level name used by JSON format logs
+func (l LogLevel) jsonName() string {
+	switch l {
+	case LogLevelDebug:
+		return "debug"
+	case LogLevelInfo:
+		return "info"
+	case LogLevelWarn:
+		return "warn"
+	case LogLevelError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+func ParseLogLevel(s string) (LogLevel, bool) {
+	switch strings.ToLower(s) {
+	case "debug", "dbug":
+		return LogLevelDebug, true
+	case "info":
+		return LogLevelInfo, true
+	case "warn", "warning":
+		return LogLevelWarn, true
+	case "error", "erro":
+		return LogLevelError, true
+	}
+	return 0, false
+}
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// LogFields are the structured data attached to a log,
+// they are only written to the console and log files when the log format is json
+type LogFields map[string]any
+
+// MarshalJSON converts the errors to their messages, otherwise they will be marshalled as {}
+func (f LogFields) MarshalJSON() ([]byte, error) {
+	m := make(map[string]any, len(f))
+	for k, v := range f {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		m[k] = v
+	}
+	return json.Marshal(m)
+}
+
+type LogEntry struct {
+	Seq    uint64    `json:"id"`
+	Time   int64     `json:"time"`
+	Level  LogLevel  `json:"-"`
+	Log    string    `json:"log"`
+	Fields LogFields `json:"fields,omitempty"`
+}
+
+func (e *LogEntry) MarshalJSON() ([]byte, error) {
+	type T LogEntry
+	return json.Marshal(struct {
+		*T
+		Level string `json:"lvl"`
+	}{
+		T:     (*T)(e),
+		Level: e.Level.String(),
+	})
+}
+
+// logRing keeps the recent log entries for the monitors
+type logRingBuffer struct {
+	mux     sync.Mutex
+	seq     uint64
+	entries []LogEntry
+	start   int
+	count   int
+}
+
+const logRingSize = 1024
+
+var logRing = &logRingBuffer{
+	entries: make([]LogEntry, logRingSize),
+}
+
+// push assigns a seq for the entry, and stores it in the buffer if store is true
+func (r *logRingBuffer) push(ts int64, level LogLevel, log string, fields LogFields, store bool) *LogEntry {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.seq++
+	e := LogEntry{
+		Seq:    r.seq,
+		Time:   ts,
+		Level:  level,
+		Log:    log,
+		Fields: fields,
+	}
+	if !store {
+		return &e
+	}
+	if r.count < len(r.entries) {
+		r.entries[(r.start+r.count)%len(r.entries)] = e
+		r.count++
+	} else {
+		r.entries[r.start] = e
+		r.start = (r.start + 1) % len(r.entries)
+	}
+	return &e
+}
+
+// recent returns at most n entries which level >= the given level and seq > after
+// the caller must hold the lock
+func (r *logRingBuffer) recent(level LogLevel, n int, after uint64) (entries []LogEntry) {
+	if n <= 0 {
+		return nil
+	}
+	for i := r.count - 1; i >= 0 && len(entries) < n; i-- {
+		e := &r.entries[(r.start+i)%len(r.entries)]
+		if e.Seq <= after {
+			break
+		}
+		if e.Level >= level {
+			entries = append(entries, *e)
+		}
+	}
+	// reverse to chronological order
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return
+}
+
+// GetRecentLogs returns at most n recent log entries that level >= the given level
+func GetRecentLogs(level LogLevel, n int) []LogEntry {
+	logRing.mux.Lock()
+	defer logRing.mux.Unlock()
+	return logRing.recent(level, n, 0)
+}
+
 type LogListenerFn = func(ts int64, level LogLevel, log string)
 
 type LogListener struct {
 	level LogLevel
-	cb    LogListenerFn
+	cb    func(*LogEntry)
 }
 
 var logListenMux sync.RWMutex
 var logListeners []*LogListener
 
-func RegisterLogMonitor(level LogLevel, cb LogListenerFn) func() {
-	l := &LogListener{
-		level: level,
-		cb:    cb,
-	}
-
+func registerLogListener(l *LogListener) func() {
 	logListenMux.Lock()
 	defer logListenMux.Unlock()
 
@@ -128,13 +265,72 @@ func RegisterLogMonitor(level LogLevel, cb LogListenerFn) func() {
 	}
 }
 
-func callLogListeners(level LogLevel, ts int64, log string) {
+// RegisterLogMonitor registers a callback that will be called synchronously when logging.
+// The callback should never block, use SubscribeLogs if it's possible to block.
+func RegisterLogMonitor(level LogLevel, cb LogListenerFn) func() {
+	return registerLogListener(&LogListener{
+		level: level,
+		cb: func(e *LogEntry) {
+			cb(e.Time, e.Level, e.Log)
+		},
+	})
+}
+
+// LogSubscription receives log entries asynchronously.
+// Entries will be dropped if the receiver is slower than the logger.
+type LogSubscription struct {
+	C       <-chan LogEntry
+	Backlog []LogEntry
+
+	dropped    atomic.Int64
+	unregister func()
+}
+
+// Dropped returns and resets the count of the dropped entries
+func (s *LogSubscription) Dropped() int64 {
+	return s.dropped.Swap(0)
+}
+
+func (s *LogSubscription) Close() {
+	s.unregister()
+}
+
+// SubscribeLogs subscribes the log entries which level >= the given level.
+// At most backlog recent entries which seq > after will be stored in Backlog.
+func SubscribeLogs(level LogLevel, backlog int, after uint64, bufSize int) *LogSubscription {
+	ch := make(chan LogEntry, bufSize)
+	sub := &LogSubscription{
+		C: ch,
+	}
+
+	logRing.mux.Lock()
+	defer logRing.mux.Unlock()
+
+	sub.Backlog = logRing.recent(level, backlog, after)
+	lastSeq := logRing.seq
+	sub.unregister = registerLogListener(&LogListener{
+		level: level,
+		cb: func(e *LogEntry) {
+			if e.Seq <= lastSeq {
+				return
+			}
+			select {
+			case ch <- *e:
+			default:
+				sub.dropped.Add(1)
+			}
+		},
+	})
+	return sub
+}
+
+func callLogListeners(e *LogEntry) {
 	logListenMux.RLock()
 	defer logListenMux.RUnlock()
 
 	for _, l := range logListeners {
-		if level >= l.level {
-			l.cb(ts, level, log)
+		if e.Level >= l.level {
+			l.cb(e)
 		}
 	}
 }
@@ -149,12 +345,31 @@ var logBufPool = sync.Pool{
 }
 
 func logXStr(level LogLevel, log string) {
+	logXStrWith(level, nil, log)
+}
+
+func logXStrWith(level LogLevel, fields LogFields, log string) {
 	now := time.Now()
-	lvl := level.String()
 
 	buf0 := logBufPool.Get().(*[]byte)
 	defer logBufPool.Put(buf0)
 	buf := bytes.NewBuffer((*buf0)[:0])
+	if config().LogFormat == LogFormatJSON {
+		formatJsonLog(buf, now, level, log, fields)
+	} else {
+		formatTextLog(buf, now, level, log)
+	}
+	// write log to console and log file
+	logWrite(level, buf.Bytes())
+	// do not let the debug logs flush the history if they are not enabled
+	store := level > LogLevelDebug || config().Advanced.DebugLog
+	// send log to monitors
+	e := logRing.push(now.UnixMilli(), level, log, fields, store)
+	callLogListeners(e)
+}
+
+func formatTextLog(buf *bytes.Buffer, now time.Time, level LogLevel, log string) {
+	lvl := level.String()
 	buf.Grow(1 + len(lvl) + 2 + len(logTimeFormat) + 3 + len(log) + 1)
 	buf.WriteString("[")
 	buf.WriteString(lvl)
@@ -163,10 +378,50 @@ func logXStr(level LogLevel, log string) {
 	buf.WriteString("]: ")
 	buf.WriteString(log)
 	buf.WriteByte('\n')
-	// write log to console and log file
-	logWrite(level, buf.Bytes())
-	// send log to monitors
-	callLogListeners(level, now.UnixMilli(), log)
+}
+
+// formatJsonLog writes a JSON line with the time, level, msg and the sorted fields.
+// time.Duration fields are written in seconds, and errors are written as their messages
+func formatJsonLog(buf *bytes.Buffer, now time.Time, level LogLevel, log string, fields LogFields) {
+	writeValue := func(v any) {
+		switch v0 := v.(type) {
+		case time.Duration:
+			v = v0.Seconds()
+		case error:
+			v = v0.Error()
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			data, _ = json.Marshal(fmt.Sprint(v))
+		}
+		buf.Write(data)
+	}
+
+	buf.WriteString(`{"time":`)
+	writeValue(now.Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeValue(level.jsonName())
+	buf.WriteString(`,"msg":`)
+	writeValue(log)
+	if len(fields) > 0 {
+		keys := make([]string, 0, len(fields))
+		for k := range fields {
+			switch k {
+			case "time", "level", "msg":
+				// do not override the basic fields
+			default:
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			buf.WriteByte(',')
+			writeValue(k)
+			buf.WriteByte(':')
+			writeValue(fields[k])
+		}
+	}
+	buf.WriteString("}\n")
 }
 
 func logX(level LogLevel, args ...any) {
@@ -183,6 +438,11 @@ func logXf(level LogLevel, format string, args ...any) {
 	logXStr(level, c)
 }
 
+func logXfWith(level LogLevel, fields LogFields, format string, args ...any) {
+	c := fmt.Sprintf(format, args...)
+	logXStrWith(level, fields, c)
+}
+
 func logDebug(args ...any) {
 	logX(LogLevelDebug, args...)
 }
@@ -215,6 +475,22 @@ func logErrorf(format string, args ...any) {
 	logXf(LogLevelError, format, args...)
 }
 
+func logDebugfWith(fields LogFields, format string, args ...any) {
+	logXfWith(LogLevelDebug, fields, format, args...)
+}
+
+func logInfofWith(fields LogFields, format string, args ...any) {
+	logXfWith(LogLevelInfo, fields, format, args...)
+}
+
+func logWarnfWith(fields LogFields, format string, args ...any) {
+	logXfWith(LogLevelWarn, fields, format, args...)
+}
+
+func logErrorfWith(fields LogFields, format string, args ...any) {
+	logXfWith(LogLevelError, fields, format, args...)
+}
+
 func flushLogfile() {
 	if _, err := os.Stat(logdir); errors.Is(err, os.ErrNotExist) {
 		os.MkdirAll(logdir, 0755)
@@ -255,8 +531,8 @@ func startFlushLogFile() {
 			case <-time.After(time.Duration(tma-time.Now().Unix()) * time.Second):
 				tma = (time.Now().Unix()/(60*60) + 1) * (60 * 60)
 				flushLogfile()
-				if config.LogSlots > 0 {
-					dur := -time.Hour * 24 * (time.Duration)(config.LogSlots)
+				if slots := config().LogSlots; slots > 0 {
+					dur := -time.Hour * 24 * (time.Duration)(slots)
 					removeExpiredLogFiles(time.Now().Add(dur).Format("20060102"))
 				}
 			}
@@ -0,0 +1,125 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+)
+
+func TestLogRingBuffer(t *testing.T) {
+	r := &logRingBuffer{
+		entries: make([]LogEntry, 4),
+	}
+	for i := 1; i <= 6; i++ {
+		level := LogLevelInfo
+		if i%2 == 0 {
+			level = LogLevelWarn
+		}
+		r.push((int64)(i), level, strconv.Itoa(i), nil, true)
+	}
+	// debug entries take seq but are not stored
+	r.push(7, LogLevelDebug, "7", nil, false)
+
+	entries := r.recent(LogLevelInfo, 10, 0)
+	if len(entries) != 4 || entries[0].Log != "3" || entries[3].Log != "6" {
+		t.Errorf("Unexpected recent entries: %v", entries)
+	}
+	entries = r.recent(LogLevelWarn, 10, 0)
+	if len(entries) != 2 || entries[0].Log != "4" || entries[1].Log != "6" {
+		t.Errorf("Unexpected recent warn entries: %v", entries)
+	}
+	entries = r.recent(LogLevelInfo, 1, 0)
+	if len(entries) != 1 || entries[0].Log != "6" {
+		t.Errorf("Unexpected last entry: %v", entries)
+	}
+	entries = r.recent(LogLevelInfo, 10, 4)
+	if len(entries) != 2 || entries[0].Seq != 5 {
+		t.Errorf("Unexpected entries after seq 4: %v", entries)
+	}
+	if r.seq != 7 {
+		t.Errorf("Seq is %d, expect 7", r.seq)
+	}
+}
+
+func TestLogSubscription(t *testing.T) {
+	sub := SubscribeLogs(LogLevelWarn, 0, 0, 2)
+	defer sub.Close()
+
+	for i := 0; i < 5; i++ {
+		logWarn("test subscription", i)
+	}
+	logInfo("should be filtered")
+
+	for i := 0; i < 2; i++ {
+		e := <-sub.C
+		if e.Level != LogLevelWarn {
+			t.Errorf("Unexpected level %s", e.Level)
+		}
+	}
+	select {
+	case e := <-sub.C:
+		t.Errorf("Unexpected entry %v", e)
+	default:
+	}
+	if dropped := sub.Dropped(); dropped != 3 {
+		t.Errorf("Dropped %d entries, expect 3", dropped)
+	}
+}
+
+func TestLogEntryJSONError(t *testing.T) {
+	sub := SubscribeLogs(LogLevelError, 0, 0, 1)
+	defer sub.Close()
+
+	logErrorfWith(LogFields{"error": errors.New("disk is full"), "storage": "s1"}, "Cannot write")
+	data, err := json.Marshal(<-sub.C)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Fields map[string]any `json:"fields"`
+	}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Fields["error"] != "disk is full" || got.Fields["storage"] != "s1" {
+		t.Errorf("Unexpected fields in %s", data)
+	}
+}
+
+func TestFormatJsonLog(t *testing.T) {
+	var buf bytes.Buffer
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	formatJsonLog(&buf, now, LogLevelWarn, "hello \"world\"", LogFields{
+		"status":   404,
+		"duration": time.Millisecond * 1500,
+		"error":    errors.New("not found"),
+		"msg":      "ignored",
+	})
+	const expect = `{"time":"2024-01-02T03:04:05Z","level":"warn","msg":"hello \"world\"","duration":1.5,"error":"not found","status":404}` + "\n"
+	if got := buf.String(); got != expect {
+		t.Errorf("Unexpected json log:\n%s\nexpect:\n%s", got, expect)
+	}
+}
@@ -22,6 +22,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -31,10 +32,16 @@ import (
 	"os/signal"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"runtime/pprof"
+
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 const ClusterServerURL = "https://openbmclapi.bangbang93.com"
@@ -45,7 +52,23 @@ var (
 
 var startTime = time.Now()
 
-var config Config = defaultConfig
+// currentConfig holds the config in use, it's replaced as a whole when reloading
+var currentConfig atomic.Pointer[Config]
+
+func init() {
+	cfg := defaultConfig
+	currentConfig.Store(&cfg)
+}
+
+// config returns the config in use, the returned config must not be modified.
+// Take it once when several options are read together, so they come from the same config
+func config() *Config {
+	return currentConfig.Load()
+}
+
+func setConfig(cfg *Config) {
+	currentConfig.Store(cfg)
+}
 
 const baseDir = "."
 
@@ -73,6 +96,12 @@ func parseArgs() {
 		case "upload-webdav":
 			cmdUploadWebdav(os.Args[2:])
 			os.Exit(0)
+		case "export-stats":
+			cmdExportStats(os.Args[2:])
+			os.Exit(0)
+		case "import-stats":
+			cmdImportStats(os.Args[2:])
+			os.Exit(0)
 		default:
 			fmt.Println("Unknown sub command:", subcmd)
 			printHelp()
@@ -113,9 +142,9 @@ START:
 
 	ctx, cancel := context.WithCancel(bgctx)
 
-	config = readConfig()
-
-	config.applyWebManifest(dsbManifest)
+	cfg := readConfig()
+	cfg.applyWebManifest(dsbManifest)
+	setConfig(&cfg)
 
 	var (
 		dialer *net.Dialer
@@ -123,129 +152,201 @@ START:
 
 	logInfof("Starting Go-OpenBmclApi v%s (%s)", ClusterVersion, BuildVersion)
 
-	cache := config.Cache.newCache()
-
-	publicPort := config.PublicPort
-	if publicPort == 0 {
-		publicPort = config.Port
-	}
-	cluster := NewCluster(ctx,
-		ClusterServerURL,
-		baseDir,
-		config.PublicHost, publicPort,
-		config.ClusterId, config.ClusterSecret,
-		config.Byoc, dialer,
-		config.Storages,
-		cache,
-	)
-	if err := cluster.Init(ctx); err != nil {
-		logError("Cannot init cluster:", err)
-		os.Exit(1)
-	}
+	cache := NewSwitchableCache(config().Cache.newCache())
 
-	if !cluster.Connect(ctx) {
-		os.Exit(1)
+	dataDir := filepath.Join(baseDir, "data")
+	storages := NewSharedStorages(dataDir, config().Storages)
+	clusterOpts := config().ClusterList()
+	clusters := make([]*Cluster, len(clusterOpts))
+	for i, opt := range clusterOpts {
+		clusterDataDir := dataDir
+		if len(config().Clusters) > 0 {
+			clusterDataDir = filepath.Join(dataDir, "clusters", opt.Id)
+		}
+		cluster := NewCluster(ctx,
+			ClusterServerURL,
+			clusterDataDir,
+			opt.PublicHost, opt.PublicPort,
+			opt.Id, opt.Secret,
+			opt.Byoc, dialer,
+			storages,
+			cache,
+		)
+		if err := cluster.Init(ctx); err != nil {
+			logErrorf("Cannot init cluster %s: %v", opt.Id, err)
+			os.Exit(1)
+		}
+		if !cluster.Connect(ctx) {
+			if !cluster.hasFileListCache() {
+				os.Exit(1)
+			}
+			if !cluster.byoc && !cluster.hasCertCache() {
+				logErrorf("Cannot start cluster %s offline: %v", opt.Id, errNoCertCache)
+				os.Exit(1)
+			}
+			// runCluster will serve the cached file list and reconnect later
+			logWarnf("Cannot connect to the center server, cluster %s will start with the cached file list", opt.Id)
+		}
+		clusters[i] = cluster
 	}
 
 	logDebugf("Receiving signals")
 	signal.Notify(signalCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
+	var (
+		byocGetCert getCertificateFunc
+		acmeManager *autocert.Manager
+	)
+	if config().ByocTLS.Enable {
+		var hosts []string
+		for _, cluster := range clusters {
+			if cluster.byoc {
+				hosts = append(hosts, cluster.host)
+			}
+		}
+		if byocGetCert, acmeManager, err = newByocCertificate(config().ByocTLS, hosts, dataDir); err != nil {
+			logError("Cannot setup TLS for BYOC:", err)
+			os.Exit(1)
+		}
+	}
+
+	router := NewClusterRouter(clusters)
 	clusterSvr := &http.Server{
-		Addr:        fmt.Sprintf("%s:%d", "0.0.0.0", config.Port),
+		Addr:        fmt.Sprintf("%s:%d", "0.0.0.0", config().Port),
 		ReadTimeout: 10 * time.Second,
 		IdleTimeout: 5 * time.Second,
-		Handler:     cluster.GetHandler(),
+		Handler:     router,
 		ErrorLog:    NullLogger, // for ignore TLS handshake error
 	}
 
+	var acmeSvr *http.Server
+	if acmeManager != nil {
+		// solve HTTP-01 challenges if the cluster port is exposed as port 80
+		clusterSvr.Handler = acmeManager.HTTPHandler(router)
+		if addr := config().ByocTLS.Acme.HTTPAddr; addr != "" {
+			acmeSvr = &http.Server{
+				Addr:        addr,
+				ReadTimeout: 10 * time.Second,
+				Handler:     acmeManager.HTTPHandler(nil),
+			}
+			go func() {
+				logInfof("ACME challenge server listening at %s", acmeSvr.Addr)
+				if err := acmeSvr.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+					logError("Error on ACME challenge server:", err)
+				}
+			}()
+		}
+	}
+
+	var metricsSvr *http.Server
+	if config().Metrics.Enable && config().Metrics.Addr != "" {
+		metricsSvr = &http.Server{
+			Addr:        config().Metrics.Addr,
+			ReadTimeout: 10 * time.Second,
+			Handler:     defaultMetrics,
+		}
+		go func() {
+			logInfof("Metrics server listening at %s", metricsSvr.Addr)
+			if err := metricsSvr.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				logError("Error on metrics server:", err)
+			}
+		}()
+	}
+
+	var serveLimiter atomic.Pointer[LimitedListener]
+	var http3Svr atomic.Pointer[http3.Server]
 	go func(ctx context.Context) {
 		listener, err := net.Listen("tcp", clusterSvr.Addr)
 		if err != nil {
 			logErrorf("Cannot listen on %s: %v", clusterSvr.Addr, err)
 			os.Exit(1)
 		}
-		if config.ServeLimit.Enable {
-			limited := NewLimitedListener(listener, config.ServeLimit.MaxConn, 0, config.ServeLimit.UploadRate*1024)
+		var rateController *RateController
+		if config().ServeLimit.Enable {
+			limited := NewLimitedListener(listener, config().ServeLimit.MaxConn, 0, config().ServeLimit.UploadRate*1024)
 			limited.SetMinWriteRate(1024)
 			listener = limited
+			rateController = limited.RateController
+			serveLimiter.Store(limited)
+			metricRateControllerConns.With("serve").SetFunc(func() float64 { return (float64)(limited.Len()) })
 		}
 
-		if !config.Byoc {
-			tctx, cancel := context.WithTimeout(ctx, time.Minute*10)
-			pair, err := cluster.RequestCert(tctx)
-			cancel()
+		publicHosts := make([]string, len(clusters))
+		hasTLS, hasPlain := false, false
+		for i, cluster := range clusters {
+			publicHosts[i] = cluster.host
+			if cluster.byoc {
+				if byocGetCert != nil {
+					hasTLS = true
+					router.SetGetCertificate(i, byocGetCert)
+				} else {
+					hasPlain = true
+				}
+				continue
+			}
+			hasTLS = true
+			cert, cached, err := cluster.startupCertificate(ctx)
 			if err != nil {
 				logError("Error when requesting cert key pair:", err)
 				os.Exit(1)
 			}
-			publicHost, _ := parseCertCommonName(([]byte)(pair.Cert))
-			certFile, keyFile, err := pair.SaveAsFile()
-			if err != nil {
-				logError("Error when saving cert key pair:", err)
-				os.Exit(1)
+			router.SetCertificate(i, cert)
+			idx := i
+			go cluster.runCertRenewer(ctx, cert, cached, func(cert *tls.Certificate) {
+				router.SetCertificate(idx, cert)
+			})
+			if cn := cert.Leaf.Subject.CommonName; cn != "" {
+				publicHosts[i] = cn
 			}
-			go func() {
-				defer listener.Close()
-				if err = clusterSvr.ServeTLS(listener, certFile, keyFile); !errors.Is(err, http.ErrServerClosed) {
-					logError("Error on server:", err)
-					os.Exit(1)
-				}
-			}()
-			if publicHost == "" {
-				publicHost = config.PublicHost
-			}
-			logInfof("Server public at https://%s:%d (%s)", publicHost, publicPort, clusterSvr.Addr)
-		} else {
-			go func() {
-				defer listener.Close()
-				if err = clusterSvr.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
-					logError("Error on server:", err)
-					os.Exit(1)
-				}
-			}()
-			logInfof("Server public at https://%s:%d (%s)", config.PublicHost, publicPort, clusterSvr.Addr)
 		}
-
-		logInfof("Fetching file list")
-		fl, err := cluster.GetFileList(ctx)
-		if err != nil {
-			logError("Cannot query cluster file list:", err)
-			if errors.Is(err, context.Canceled) {
-				return
+		if hasTLS {
+			tlsConfig := &tls.Config{
+				GetCertificate: router.GetCertificate,
+				NextProtos:     []string{"h2", "http/1.1"},
 			}
-			os.Exit(1)
-		}
-		checkCount := -1
-		heavyCheck := !config.Advanced.NoHeavyCheck
-
-		if !config.Advanced.SkipFirstSync {
-			cluster.SyncFiles(ctx, fl, false)
-			if ctx.Err() != nil {
-				return
+			if acmeManager != nil {
+				// for TLS-ALPN-01 challenges
+				tlsConfig.NextProtos = append(tlsConfig.NextProtos, acme.ALPNProto)
+			}
+			clusterSvr.TLSConfig = tlsConfig
+			if hasPlain {
+				// some clusters bring their own certificates, so both TLS and plain HTTP should be served
+				listener = newTLSSniffListener(listener, tlsConfig)
+			} else {
+				listener = tls.NewListener(listener, tlsConfig)
 			}
-		} else {
-			fileset := make(map[string]int64, len(fl))
-			for _, f := range fl {
-				fileset[f.Hash] = f.Size
+			if config().HTTP3.Enable {
+				port := config().HTTP3.Port
+				if port == 0 {
+					port = config().Port
+				}
+				addr := fmt.Sprintf("%s:%d", "0.0.0.0", port)
+				svr, h3Listener, err := newHTTP3Server(addr, router, tlsConfig, rateController)
+				if err != nil {
+					logErrorf("Cannot listen on UDP %s: %v", addr, err)
+					os.Exit(1)
+				}
+				http3Svr.Store(svr)
+				clusterSvr.Handler = altSvcHandler(clusterSvr.Handler, config().HTTP3.AltSvcPort)
+				go func() {
+					defer h3Listener.Close()
+					logInfof("HTTP/3 server listening at udp %s", addr)
+					if err := svr.ServeListener(h3Listener); err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+						logError("Error on HTTP/3 server:", err)
+					}
+				}()
 			}
-			cluster.mux.Lock()
-			cluster.fileset = fileset
-			cluster.mux.Unlock()
 		}
-		createInterval(ctx, func() {
-			logInfof("Fetching file list")
-			fl, err := cluster.GetFileList(ctx)
-			if err != nil {
-				logError("Cannot query cluster file list:", err)
-				return
+		go func() {
+			defer listener.Close()
+			if err := clusterSvr.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+				logError("Error on server:", err)
+				os.Exit(1)
 			}
-			checkCount = (checkCount + 1) % 10
-			cluster.SyncFiles(ctx, fl, heavyCheck && checkCount == 0)
-		}, (time.Duration)(config.SyncInterval)*time.Minute)
-
-		if err := cluster.Enable(ctx); err != nil {
-			logError("Cannot enable cluster:", err)
-			os.Exit(1)
+		}()
+		for i, cluster := range clusters {
+			logInfof("Server public at https://%s:%d (%s)", publicHosts[i], cluster.publicPort, clusterSvr.Addr)
+			go runCluster(ctx, cluster)
 		}
 	}(ctx)
 
@@ -281,17 +382,44 @@ SELECT_SIGNAL:
 			}
 			goto SELECT_SIGNAL
 		}
+		if s == syscall.SIGHUP {
+			logInfo("Reloading config ...")
+			if !reloadConfig(storages, cache, serveLimiter.Load()) {
+				goto SELECT_SIGNAL
+			}
+			logWarn("Some changed options require a restart")
+		}
 
-		cancel()
-		shutCtx, cancelShut := context.WithTimeout(context.Background(), 20*time.Second)
+		drainTimeout := (time.Duration)(config().DrainTimeout)
+		shutCtx, cancelShut := context.WithTimeout(context.Background(), drainTimeout+20*time.Second)
 		logWarn("Closing server ...")
 		shutExit := make(chan struct{}, 0)
 		go func() {
 			defer close(shutExit)
 			defer cancelShut()
-			cluster.Disable(shutCtx)
+			var wg sync.WaitGroup
+			for _, cluster := range clusters {
+				wg.Add(1)
+				go func(cluster *Cluster) {
+					defer wg.Done()
+					cluster.Drain(shutCtx, drainTimeout)
+				}(cluster)
+			}
+			wg.Wait()
+			// stop the background tasks after the clusters are disabled, so the keepalive will not reconnect them
+			cancel()
 			logInfo("Cluster disabled, closing http server")
 			clusterSvr.Shutdown(shutCtx)
+			if svr := http3Svr.Load(); svr != nil {
+				svr.Close()
+			}
+			if metricsSvr != nil {
+				metricsSvr.Shutdown(shutCtx)
+			}
+			if acmeSvr != nil {
+				acmeSvr.Shutdown(shutCtx)
+			}
+			storages.CloseFileIndexes()
 		}()
 		select {
 		case <-shutExit:
@@ -307,3 +435,64 @@ SELECT_SIGNAL:
 		}
 	}
 }
+
+// runCluster synchronizes the files and enables the cluster
+func runCluster(ctx context.Context, cluster *Cluster) {
+	var (
+		fl  []FileInfo
+		err = errNotConnected
+	)
+	if cluster.Connected() {
+		fl, _, err = cluster.FetchFileList(ctx, true)
+	}
+	offline := err != nil
+	if offline {
+		logError("Cannot query cluster file list:", err)
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+		if fl, err = cluster.serveOffline(ctx); err != nil {
+			if errors.Is(err, context.Canceled) {
+				return
+			}
+			logError("Cannot serve with the cached file list:", err)
+			os.Exit(1)
+		}
+	}
+	checkCount := -1
+
+	// the files may be changed while the cluster was offline, so they are always synchronized
+	if !config().Advanced.SkipFirstSync || offline {
+		cluster.SyncFiles(ctx, fl, false)
+		if ctx.Err() != nil {
+			return
+		}
+	} else {
+		cluster.setFileset(fl)
+	}
+	createInterval(ctx, func() {
+		nextCount := (checkCount + 1) % 10
+		// the removed files are not included in the incremental list, so the full list is fetched periodically
+		fl, incremental, err := cluster.FetchFileList(ctx, nextCount == 0)
+		if err != nil {
+			logError("Cannot query cluster file list:", err)
+			return
+		}
+		checkCount = nextCount
+		if incremental {
+			if len(fl) == 0 {
+				logInfo("No file is changed since the last sync")
+				return
+			}
+			cluster.SyncFileDelta(ctx, fl)
+			return
+		}
+		heavyCheck := !config().Advanced.NoHeavyCheck
+		cluster.SyncFiles(ctx, fl, heavyCheck && checkCount == 0)
+	}, (time.Duration)(config().SyncInterval)*time.Minute)
+
+	if err := cluster.Enable(ctx); err != nil {
+		logError("Cannot enable cluster:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,380 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// A tiny implementation of the prometheus text exposition format
+// see <https://prometheus.io/docs/instrumenting/exposition_formats/#text-based-format>
+
+type MetricType string
+
+const (
+	MetricCounter   MetricType = "counter"
+	MetricGauge     MetricType = "gauge"
+	MetricHistogram MetricType = "histogram"
+)
+
+var DefaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300}
+
+type atomicFloat64 struct {
+	bits atomic.Uint64
+}
+
+func (f *atomicFloat64) Load() float64 {
+	return math.Float64frombits(f.bits.Load())
+}
+
+func (f *atomicFloat64) Store(v float64) {
+	f.bits.Store(math.Float64bits(v))
+}
+
+func (f *atomicFloat64) Add(v float64) {
+	for {
+		old := f.bits.Load()
+		if f.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+type MetricSeries struct {
+	vec         *MetricVec
+	labelValues []string
+
+	value   atomicFloat64
+	fn      atomic.Pointer[func() float64]
+	buckets []atomic.Uint64
+	sum     atomicFloat64
+	count   atomic.Uint64
+}
+
+func (s *MetricSeries) Inc() {
+	s.value.Add(1)
+}
+
+func (s *MetricSeries) Add(v float64) {
+	s.value.Add(v)
+}
+
+// Set should only be used with gauges
+func (s *MetricSeries) Set(v float64) {
+	s.value.Store(v)
+}
+
+// SetFunc makes the gauge to be evaluated when collecting
+func (s *MetricSeries) SetFunc(fn func() float64) {
+	s.fn.Store(&fn)
+}
+
+// Observe should only be used with histograms
+func (s *MetricSeries) Observe(v float64) {
+	for i, b := range s.vec.buckets {
+		if v <= b {
+			s.buckets[i].Add(1)
+		}
+	}
+	s.sum.Add(v)
+	s.count.Add(1)
+}
+
+func (s *MetricSeries) Value() float64 {
+	if fn := s.fn.Load(); fn != nil {
+		return (*fn)()
+	}
+	return s.value.Load()
+}
+
+type MetricVec struct {
+	name    string
+	help    string
+	typ     MetricType
+	labels  []string
+	buckets []float64
+
+	mux    sync.RWMutex
+	series map[string]*MetricSeries
+}
+
+type MetricsRegistry struct {
+	mux     sync.RWMutex
+	metrics []*MetricVec
+}
+
+var defaultMetrics = new(MetricsRegistry)
+
+func (r *MetricsRegistry) register(vec *MetricVec) *MetricVec {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for _, m := range r.metrics {
+		if m.name == vec.name {
+			panic("Metric " + vec.name + " is already registered")
+		}
+	}
+	r.metrics = append(r.metrics, vec)
+	return vec
+}
+
+func (r *MetricsRegistry) NewCounterVec(name, help string, labels ...string) *MetricVec {
+	return r.register(newMetricVec(name, help, MetricCounter, labels, nil))
+}
+
+func (r *MetricsRegistry) NewGaugeVec(name, help string, labels ...string) *MetricVec {
+	return r.register(newMetricVec(name, help, MetricGauge, labels, nil))
+}
+
+func (r *MetricsRegistry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *MetricVec {
+	return r.register(newMetricVec(name, help, MetricHistogram, labels, buckets))
+}
+
+func newMetricVec(name, help string, typ MetricType, labels []string, buckets []float64) *MetricVec {
+	return &MetricVec{
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*MetricSeries),
+	}
+}
+
+// With returns the series with the label values, the values must match the labels in order
+func (v *MetricVec) With(values ...string) *MetricSeries {
+	if len(values) != len(v.labels) {
+		panic("Metric " + v.name + ": label count mismatch")
+	}
+	key := strings.Join(values, "\xff")
+	v.mux.RLock()
+	s, ok := v.series[key]
+	v.mux.RUnlock()
+	if ok {
+		return s
+	}
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	if s, ok = v.series[key]; !ok {
+		s = &MetricSeries{
+			vec:         v,
+			labelValues: append([]string(nil), values...),
+		}
+		if v.typ == MetricHistogram {
+			s.buckets = make([]atomic.Uint64, len(v.buckets))
+		}
+		v.series[key] = s
+	}
+	return s
+}
+
+func writeMetricLabels(w *bufio.Writer, names, values []string, extraName, extraValue string) {
+	if len(names) == 0 && extraName == "" {
+		return
+	}
+	w.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			w.WriteByte(',')
+		}
+		w.WriteString(n)
+		w.WriteString(`="`)
+		w.WriteString(escapeMetricLabel(values[i]))
+		w.WriteByte('"')
+	}
+	if extraName != "" {
+		if len(names) > 0 {
+			w.WriteByte(',')
+		}
+		w.WriteString(extraName)
+		w.WriteString(`="`)
+		w.WriteString(extraValue)
+		w.WriteByte('"')
+	}
+	w.WriteByte('}')
+}
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeMetricLabel(s string) string {
+	return metricLabelEscaper.Replace(s)
+}
+
+func formatMetricFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (v *MetricVec) writeTo(w *bufio.Writer) {
+	v.mux.RLock()
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	v.mux.RUnlock()
+	if len(keys) == 0 {
+		return
+	}
+	sort.Strings(keys)
+
+	w.WriteString("# HELP ")
+	w.WriteString(v.name)
+	w.WriteByte(' ')
+	w.WriteString(v.help)
+	w.WriteString("\n# TYPE ")
+	w.WriteString(v.name)
+	w.WriteByte(' ')
+	w.WriteString((string)(v.typ))
+	w.WriteByte('\n')
+
+	for _, k := range keys {
+		v.mux.RLock()
+		s := v.series[k]
+		v.mux.RUnlock()
+		if v.typ != MetricHistogram {
+			w.WriteString(v.name)
+			writeMetricLabels(w, v.labels, s.labelValues, "", "")
+			w.WriteByte(' ')
+			w.WriteString(formatMetricFloat(s.Value()))
+			w.WriteByte('\n')
+			continue
+		}
+		for i, b := range v.buckets {
+			w.WriteString(v.name)
+			w.WriteString("_bucket")
+			writeMetricLabels(w, v.labels, s.labelValues, "le", formatMetricFloat(b))
+			w.WriteByte(' ')
+			w.WriteString(strconv.FormatUint(s.buckets[i].Load(), 10))
+			w.WriteByte('\n')
+		}
+		count := strconv.FormatUint(s.count.Load(), 10)
+		w.WriteString(v.name)
+		w.WriteString("_bucket")
+		writeMetricLabels(w, v.labels, s.labelValues, "le", "+Inf")
+		w.WriteByte(' ')
+		w.WriteString(count)
+		w.WriteString("\n")
+		w.WriteString(v.name)
+		w.WriteString("_sum")
+		writeMetricLabels(w, v.labels, s.labelValues, "", "")
+		w.WriteByte(' ')
+		w.WriteString(formatMetricFloat(s.sum.Load()))
+		w.WriteString("\n")
+		w.WriteString(v.name)
+		w.WriteString("_count")
+		writeMetricLabels(w, v.labels, s.labelValues, "", "")
+		w.WriteByte(' ')
+		w.WriteString(count)
+		w.WriteString("\n")
+	}
+}
+
+func (r *MetricsRegistry) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		rw.Header().Set("Allow", http.MethodGet+", "+http.MethodHead)
+		http.Error(rw, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	rw.WriteHeader(http.StatusOK)
+	if req.Method == http.MethodHead {
+		return
+	}
+	w := bufio.NewWriter(rw)
+	r.mux.RLock()
+	for _, m := range r.metrics {
+		m.writeTo(w)
+	}
+	r.mux.RUnlock()
+	w.Flush()
+}
+
+const metricsNamespace = "go_openbmclapi_"
+
+var (
+	metricStartTime = defaultMetrics.NewGaugeVec(metricsNamespace+"start_time_seconds",
+		"Start time of the process since unix epoch in seconds.")
+	metricGoroutines = defaultMetrics.NewGaugeVec("go_goroutines",
+		"Number of goroutines that currently exist.")
+	metricEnabled = defaultMetrics.NewGaugeVec(metricsNamespace+"cluster_enabled",
+		"Whether the cluster is enabled.", "cluster")
+
+	metricDownloadHits = defaultMetrics.NewCounterVec(metricsNamespace+"download_hits_total",
+		"Total served download requests per storage.", "storage")
+	metricDownloadBytes = defaultMetrics.NewCounterVec(metricsNamespace+"download_bytes_total",
+		"Total served download bytes per storage.", "storage")
+	metricStorageAvailable = defaultMetrics.NewGaugeVec(metricsNamespace+"storage_available",
+		"Whether the storage is available for serving downloads.", "storage")
+	metricHTTPRequests = defaultMetrics.NewCounterVec(metricsNamespace+"http_requests_total",
+		"Total HTTP requests by route and status code.", "route", "code")
+	metricHTTPDuration = defaultMetrics.NewHistogramVec(metricsNamespace+"http_request_duration_seconds",
+		"HTTP request latencies in seconds.", DefaultLatencyBuckets, "route")
+
+	metricKeepAlive = defaultMetrics.NewCounterVec(metricsNamespace+"keepalive_total",
+		"Total keep-alive packets sent to the center server by result.", "cluster", "result")
+
+	metricSyncRunning = defaultMetrics.NewGaugeVec(metricsNamespace+"sync_running",
+		"Whether a file sync is running.")
+	metricSyncFiles = defaultMetrics.NewGaugeVec(metricsNamespace+"sync_files",
+		"File count of the current or last sync by state.", "state")
+	metricSyncBytes = defaultMetrics.NewGaugeVec(metricsNamespace+"sync_bytes",
+		"Byte count of the current or last sync by state.", "state")
+	metricSyncDuration = defaultMetrics.NewGaugeVec(metricsNamespace+"sync_last_duration_seconds",
+		"Time used by the last finished sync in seconds.")
+
+	metricRateControllerConns = defaultMetrics.NewGaugeVec(metricsNamespace+"rate_controller_connections",
+		"Current connection count of the rate controllers.", "name")
+)
+
+func init() {
+	metricStartTime.With().Set((float64)(startTime.UnixMilli()) / 1000)
+	metricGoroutines.With().SetFunc(func() float64 { return (float64)(runtime.NumGoroutine()) })
+}
+
+// getRequestRoute returns a low cardinality name of the request path
+func getRequestRoute(rawpath string) string {
+	switch {
+	case strings.HasPrefix(rawpath, "/download/"):
+		return "download"
+	case strings.HasPrefix(rawpath, "/measure/"):
+		return "measure"
+	case strings.HasPrefix(rawpath, "/api/"):
+		return "api"
+	case strings.HasPrefix(rawpath, "/dashboard"):
+		return "dashboard"
+	case rawpath == "/metrics":
+		return "metrics"
+	}
+	return "other"
+}
@@ -0,0 +1,64 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"net/http"
+	"net/http/httptest"
+)
+
+func TestMetricsRegistry(t *testing.T) {
+	r := new(MetricsRegistry)
+	counter := r.NewCounterVec("test_total", "Test counter.", "a")
+	gauge := r.NewGaugeVec("test_gauge", "Test gauge.")
+	histogram := r.NewHistogramVec("test_seconds", "Test histogram.", []float64{0.1, 1}, "b")
+	r.NewCounterVec("test_unused_total", "Should not be shown.")
+
+	counter.With(`x"y`).Add(2)
+	counter.With("z").Inc()
+	gauge.With().SetFunc(func() float64 { return 1.5 })
+	histogram.With("c").Observe(0.05)
+	histogram.With("c").Observe(0.5)
+	histogram.With("c").Observe(5)
+
+	rw := httptest.NewRecorder()
+	r.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	const expect = `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{a="x\"y"} 2
+test_total{a="z"} 1
+# HELP test_gauge Test gauge.
+# TYPE test_gauge gauge
+test_gauge 1.5
+# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{b="c",le="0.1"} 1
+test_seconds_bucket{b="c",le="1"} 2
+test_seconds_bucket{b="c",le="+Inf"} 3
+test_seconds_sum{b="c"} 5.55
+test_seconds_count{b="c"} 3
+`
+	if got := rw.Body.String(); got != expect {
+		t.Errorf("Unexpected metrics output:\n%s\nexpect:\n%s", got, expect)
+	}
+}
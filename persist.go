@@ -0,0 +1,178 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// snapshotChecksumPrefix starts the checksum trailer line of a snapshot file
+const snapshotChecksumPrefix = "\n#crc32c:"
+
+// snapshotKeep is the default count of the snapshots to keep, including the latest one
+const snapshotKeep = 3
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+var errSnapshotChecksum = errors.New("snapshot checksum mismatch")
+
+// writeTempFile writes and syncs a temporary file in the same directory as path
+func writeTempFile(path string, mode os.FileMode, write func(w io.Writer) error) (tmpPath string, err error) {
+	fd, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return
+	}
+	tmpPath = fd.Name()
+	if err = write(fd); err == nil {
+		err = fd.Sync()
+	}
+	if e := fd.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, mode)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	return
+}
+
+// writeFileAtomic writes the file through a temporary file,
+// so the file will be either the old one or the complete new one after a crash
+func writeFileAtomic(path string, mode os.FileMode, write func(w io.Writer) error) error {
+	tmpPath, err := writeTempFile(path, mode, write)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// syncDir flushes the directory entries, so the renamed files will not be lost after a power failure.
+// It's best effort since some systems (e.g. Windows) cannot open a directory for sync
+func syncDir(dir string) {
+	if fd, err := os.Open(dir); err == nil {
+		fd.Sync()
+		fd.Close()
+	}
+}
+
+func snapshotPath(path string, i int) string {
+	if i == 0 {
+		return path
+	}
+	return path + "." + strconv.Itoa(i)
+}
+
+// saveSnapshot writes the data to path with a checksum trailer,
+// the previous snapshots are rotated to path.1, path.2, ... and at most keep snapshots are preserved
+func saveSnapshot(path string, data []byte, mode os.FileMode, keep int) error {
+	trailer := fmt.Sprintf("%s%08x\n", snapshotChecksumPrefix, crc32.Checksum(data, crc32cTable))
+	tmpPath, err := writeTempFile(path, mode, func(w io.Writer) error {
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, trailer)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// the new snapshot is complete on the disk, now it's safe to rotate the old ones
+	for i := keep - 1; i > 0; i-- {
+		if err := os.Rename(snapshotPath(path, i-1), snapshotPath(path, i)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logWarnf("Cannot rotate snapshot %s: %v", snapshotPath(path, i-1), err)
+		}
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	// the legacy backup is not needed anymore
+	os.Remove(path + ".old")
+	return nil
+}
+
+// verifySnapshot checks and removes the checksum trailer.
+// The files without the trailer are written by the old versions, they are returned as is
+func verifySnapshot(buf []byte) ([]byte, error) {
+	i := bytes.LastIndex(buf, ([]byte)(snapshotChecksumPrefix))
+	if i < 0 {
+		return buf, nil
+	}
+	data, trailer := buf[:i], bytes.TrimSpace(buf[i+len(snapshotChecksumPrefix):])
+	sum, err := strconv.ParseUint((string)(trailer), 16, 32)
+	if err != nil || (uint32)(sum) != crc32.Checksum(data, crc32cTable) {
+		return nil, errSnapshotChecksum
+	}
+	return data, nil
+}
+
+// loadSnapshot parses the latest valid snapshot saved by saveSnapshot.
+// The older snapshots and the legacy path.old file are tried in order if the newer ones are broken,
+// and it returns nil if there is no snapshot at all
+func loadSnapshot(path string, keep int, parser func(buf []byte) error) error {
+	candidates := make([]string, 0, keep+1)
+	for i := 0; i < keep; i++ {
+		candidates = append(candidates, snapshotPath(path, i))
+	}
+	candidates = append(candidates, path+".old")
+
+	var firstErr error
+	for _, p := range candidates {
+		buf, err := os.ReadFile(p)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) && firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		data, err := verifySnapshot(buf)
+		if err == nil {
+			err = parser(data)
+		}
+		if err != nil {
+			logWarnf("Snapshot %s is broken: %v", p, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if firstErr != nil {
+			logWarnf("Recovered %s from snapshot %s", path, p)
+		}
+		return nil
+	}
+	return firstErr
+}
@@ -0,0 +1,79 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.json")
+	for _, v := range []string{"1", "2", "3", "4"} {
+		if err := saveSnapshot(path, ([]byte)(v), 0644, 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("Expected 3 snapshots, got %d", len(entries))
+	}
+
+	load := func() (got string, err error) {
+		err = loadSnapshot(path, 3, func(buf []byte) error {
+			if len(buf) != 1 {
+				return errors.New("invalid data")
+			}
+			got = (string)(buf)
+			return nil
+		})
+		return
+	}
+	if got, err := load(); err != nil || got != "4" {
+		t.Errorf("Expected to load 4, got %q, %v", got, err)
+	}
+	// corrupt the latest snapshot
+	if err := os.WriteFile(path, ([]byte)("5"+snapshotChecksumPrefix+"00000000\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := load(); err != nil || got != "3" {
+		t.Errorf("Expected to recover 3, got %q, %v", got, err)
+	}
+
+	// the files written by the old versions have no checksum
+	legacy := filepath.Join(dir, "legacy.json")
+	if err := os.WriteFile(legacy+".old", ([]byte)("L"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	if err := loadSnapshot(legacy, 3, func(buf []byte) error { got = (string)(buf); return nil }); err != nil || got != "L" {
+		t.Errorf("Expected to load the legacy file, got %q, %v", got, err)
+	}
+	if err := loadSnapshot(filepath.Join(dir, "missing.json"), 3, func([]byte) error { return nil }); err != nil {
+		t.Errorf("Loading missing snapshots should not fail, got %v", err)
+	}
+}
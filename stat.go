@@ -21,8 +21,6 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
-	"os"
 	"path/filepath"
 	"strconv"
 	"sync"
@@ -218,7 +216,7 @@ func (s *Stats) Load(dir string) (err error) {
 	s.mux.Lock()
 	defer s.mux.Unlock()
 
-	if err = parseFileOrOld(filepath.Join(dir, statsFileName), func(buf []byte) error {
+	if err = loadSnapshot(filepath.Join(dir, statsFileName), snapshotKeep, func(buf []byte) error {
 		return json.Unmarshal(buf, &s.statData)
 	}); err != nil {
 		return
@@ -243,7 +241,7 @@ func (s *Stats) Save(dir string) (err error) {
 		return
 	}
 
-	if err = writeFileWithOld(filepath.Join(dir, statsFileName), buf, 0644); err != nil {
+	if err = saveSnapshot(filepath.Join(dir, statsFileName), buf, 0644, snapshotKeep); err != nil {
 		return
 	}
 	return
@@ -258,44 +256,3 @@ func (s *Stats) AddHits(hits int32, bytes int64) {
 		Bytes: bytes,
 	})
 }
-
-func parseFileOrOld(path string, parser func(buf []byte) error) error {
-	oldpath := path + ".old"
-	buf, err := os.ReadFile(path)
-	if err == nil {
-		if err = parser(buf); err == nil {
-			return err
-		}
-	}
-	buf, er := os.ReadFile(oldpath)
-	if er == nil {
-		if er = parser(buf); er == nil {
-			os.WriteFile(path, buf, 0644)
-			return nil
-		}
-	}
-	if errors.Is(err, os.ErrNotExist) {
-		if errors.Is(er, os.ErrNotExist) {
-			return nil
-		}
-		err = er
-	}
-	return err
-}
-
-func writeFileWithOld(path string, buf []byte, mode os.FileMode) error {
-	oldpath := path + ".old"
-	if err := os.Remove(oldpath); err != nil && !errors.Is(err, os.ErrNotExist) {
-		return err
-	}
-	if err := os.Rename(path, oldpath); err != nil && !errors.Is(err, os.ErrNotExist) {
-		return err
-	}
-	if err := os.WriteFile(path, buf, mode); err != nil {
-		return err
-	}
-	if err := os.WriteFile(oldpath, buf, mode); err != nil {
-		return err
-	}
-	return nil
-}
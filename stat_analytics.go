@@ -0,0 +1,310 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	analyticsFileName = "analytics.json"
+
+	analyticsMaxFiles      = 20000
+	analyticsMaxUserAgents = 1000
+	// analyticsHourlySize is the number of the hours to keep, which is a week
+	analyticsHourlySize = 24 * 7
+
+	analyticsOtherUserAgent = "[Other]"
+)
+
+type accessCount struct {
+	Hits  int64 `json:"hits"`
+	Bytes int64 `json:"bytes"`
+}
+
+type fileAccess struct {
+	// Name is the last seen file name in the download query
+	Name string `json:"name,omitempty"`
+	accessCount
+}
+
+type hourAccess struct {
+	Time   time.Time `json:"time"`
+	Hits   int64     `json:"hits"`
+	Bytes  int64     `json:"bytes"`
+	Errors int64     `json:"errors"`
+}
+
+type analyticsData struct {
+	Since      time.Time               `json:"since"`
+	Files      map[string]*fileAccess  `json:"files"`
+	UserAgents map[string]*accessCount `json:"userAgents"`
+	Status     map[string]int64        `json:"status"`
+	Hourly     []hourAccess            `json:"hourly"`
+}
+
+// AccessAnalytics records the download requests by file, user agent, status code and hour.
+// Unlike Stats.Accesses, it is not cleared periodically,
+// instead the least requested files and user agents are dropped when there are too many of them
+type AccessAnalytics struct {
+	mux sync.RWMutex
+	analyticsData
+}
+
+func (a *AccessAnalytics) init() {
+	if a.Since.IsZero() {
+		a.Since = time.Now()
+	}
+	if a.Files == nil {
+		a.Files = make(map[string]*fileAccess)
+	}
+	if a.UserAgents == nil {
+		a.UserAgents = make(map[string]*accessCount)
+	}
+	if a.Status == nil {
+		a.Status = make(map[string]int64)
+	}
+}
+
+func (a *AccessAnalytics) Load(dir string) (err error) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	if err = loadSnapshot(filepath.Join(dir, analyticsFileName), snapshotKeep, func(buf []byte) error {
+		return json.Unmarshal(buf, &a.analyticsData)
+	}); err != nil {
+		return
+	}
+	a.init()
+	return
+}
+
+func (a *AccessAnalytics) Save(dir string) (err error) {
+	a.mux.RLock()
+	defer a.mux.RUnlock()
+
+	buf, err := json.Marshal(&a.analyticsData)
+	if err != nil {
+		return
+	}
+	return saveSnapshot(filepath.Join(dir, analyticsFileName), buf, 0644, snapshotKeep)
+}
+
+// Reset clears all the records
+func (a *AccessAnalytics) Reset() {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	a.analyticsData = analyticsData{}
+	a.init()
+}
+
+// Record adds a download request, the failed requests are only counted in the status and hourly data
+func (a *AccessAnalytics) Record(hash string, name string, ua string, status int, bytes int64, now time.Time) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	a.init()
+	a.Status[strconv.Itoa(status)]++
+
+	hour := a.hourAt(now)
+	failed := status >= 400
+	if failed {
+		hour.Errors++
+		return
+	}
+	hour.Hits++
+	hour.Bytes += bytes
+
+	f := a.Files[hash]
+	if f == nil {
+		if len(a.Files) >= analyticsMaxFiles {
+			pruneAccesses(a.Files, analyticsMaxFiles*3/4, func(f *fileAccess) int64 { return f.Hits })
+		}
+		f = new(fileAccess)
+		a.Files[hash] = f
+	}
+	if name != "" {
+		f.Name = name
+	}
+	f.Hits++
+	f.Bytes += bytes
+
+	if ua == "" {
+		ua = "[Unknown]"
+	}
+	u := a.UserAgents[ua]
+	if u == nil {
+		if len(a.UserAgents) >= analyticsMaxUserAgents {
+			// do not drop the user agents since they are not too many usually
+			if u = a.UserAgents[analyticsOtherUserAgent]; u == nil {
+				u = new(accessCount)
+				a.UserAgents[analyticsOtherUserAgent] = u
+			}
+		} else {
+			u = new(accessCount)
+			a.UserAgents[ua] = u
+		}
+	}
+	u.Hits++
+	u.Bytes += bytes
+}
+
+// hourAt returns the record of the hour, the missing hours will be filled with zero
+// It must be called with the lock held
+func (a *AccessAnalytics) hourAt(now time.Time) *hourAccess {
+	t := now.UTC().Truncate(time.Hour)
+	if n := len(a.Hourly); n > 0 {
+		last := a.Hourly[n-1].Time
+		if !t.After(last) {
+			// the clock may go backward, count it in the latest hour
+			return &a.Hourly[n-1]
+		}
+		if t.Sub(last) >= analyticsHourlySize*time.Hour {
+			a.Hourly = a.Hourly[:0]
+		} else {
+			for h := last.Add(time.Hour); h.Before(t); h = h.Add(time.Hour) {
+				a.Hourly = append(a.Hourly, hourAccess{Time: h})
+			}
+		}
+	}
+	a.Hourly = append(a.Hourly, hourAccess{Time: t})
+	if n := len(a.Hourly); n > analyticsHourlySize {
+		a.Hourly = append(a.Hourly[:0], a.Hourly[n-analyticsHourlySize:]...)
+	}
+	return &a.Hourly[len(a.Hourly)-1]
+}
+
+// pruneAccesses keeps the n most requested entries
+func pruneAccesses[T any](m map[string]T, n int, hits func(T) int64) {
+	if len(m) <= n {
+		return
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return hits(m[keys[i]]) > hits(m[keys[j]]) })
+	for _, k := range keys[n:] {
+		delete(m, k)
+	}
+}
+
+type FileAccessStat struct {
+	Hash  string `json:"hash"`
+	Name  string `json:"name,omitempty"`
+	Hits  int64  `json:"hits"`
+	Bytes int64  `json:"bytes"`
+}
+
+type UserAgentAccessStat struct {
+	UserAgent string `json:"userAgent"`
+	Hits      int64  `json:"hits"`
+	Bytes     int64  `json:"bytes"`
+}
+
+// TopFiles returns the most requested files, sorted by the bytes if byBytes is true, otherwise by the hits
+func (a *AccessAnalytics) TopFiles(limit int, byBytes bool) []FileAccessStat {
+	a.mux.RLock()
+	files := make([]FileAccessStat, 0, len(a.Files))
+	for hash, f := range a.Files {
+		files = append(files, FileAccessStat{
+			Hash:  hash,
+			Name:  f.Name,
+			Hits:  f.Hits,
+			Bytes: f.Bytes,
+		})
+	}
+	a.mux.RUnlock()
+
+	sort.Slice(files, func(i, j int) bool {
+		a, b := files[i], files[j]
+		if byBytes && a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		if a.Hits != b.Hits {
+			return a.Hits > b.Hits
+		}
+		return a.Hash < b.Hash
+	})
+	if limit > 0 && len(files) > limit {
+		files = files[:limit]
+	}
+	return files
+}
+
+// UserAgentStats returns the requests of each user agent sorted by the bytes
+func (a *AccessAnalytics) UserAgentStats() []UserAgentAccessStat {
+	a.mux.RLock()
+	uas := make([]UserAgentAccessStat, 0, len(a.UserAgents))
+	for ua, c := range a.UserAgents {
+		uas = append(uas, UserAgentAccessStat{
+			UserAgent: ua,
+			Hits:      c.Hits,
+			Bytes:     c.Bytes,
+		})
+	}
+	a.mux.RUnlock()
+
+	sort.Slice(uas, func(i, j int) bool {
+		if uas[i].Bytes != uas[j].Bytes {
+			return uas[i].Bytes > uas[j].Bytes
+		}
+		return uas[i].UserAgent < uas[j].UserAgent
+	})
+	return uas
+}
+
+// StatusStats returns the count of each status code
+func (a *AccessAnalytics) StatusStats() map[string]int64 {
+	a.mux.RLock()
+	defer a.mux.RUnlock()
+
+	status := make(map[string]int64, len(a.Status))
+	for k, v := range a.Status {
+		status[k] = v
+	}
+	return status
+}
+
+// HourlyStats returns the records of the last n hours, ordered from the oldest
+func (a *AccessAnalytics) HourlyStats(n int) []hourAccess {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	// make sure the records are up to date, so the chart will not stop at the last request
+	a.hourAt(time.Now())
+	hourly := a.Hourly
+	if n > 0 && len(hourly) > n {
+		hourly = hourly[len(hourly)-n:]
+	}
+	return append([]hourAccess(nil), hourly...)
+}
+
+func (a *AccessAnalytics) SinceTime() time.Time {
+	a.mux.RLock()
+	defer a.mux.RUnlock()
+	return a.Since
+}
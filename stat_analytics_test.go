@@ -0,0 +1,87 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"time"
+)
+
+func TestAccessAnalytics(t *testing.T) {
+	var a AccessAnalytics
+	now := time.Date(2024, 1, 1, 10, 30, 0, 0, time.UTC)
+	a.Record("aa", "a.jar", "bmclapi", 200, 100, now)
+	a.Record("aa", "", "bmclapi", 206, 50, now)
+	a.Record("bb", "b.jar", "PCL2", 302, 1000, now.Add(time.Hour*2))
+	a.Record("cc", "", "PCL2", 404, 0, now.Add(time.Hour*2))
+
+	files := a.TopFiles(10, false)
+	if len(files) != 2 || files[0].Hash != "aa" || files[0].Name != "a.jar" || files[0].Hits != 2 || files[0].Bytes != 150 {
+		t.Errorf("Unexpected top files %#v", files)
+	}
+	if files = a.TopFiles(1, true); len(files) != 1 || files[0].Hash != "bb" {
+		t.Errorf("Unexpected top files by bytes %#v", files)
+	}
+	uas := a.UserAgentStats()
+	if len(uas) != 2 || uas[0].UserAgent != "PCL2" || uas[0].Hits != 1 || uas[1].Bytes != 150 {
+		t.Errorf("Unexpected user agents %#v", uas)
+	}
+	status := a.StatusStats()
+	if status["200"] != 1 || status["206"] != 1 || status["302"] != 1 || status["404"] != 1 {
+		t.Errorf("Unexpected status %v", status)
+	}
+	if len(a.Hourly) != 3 {
+		t.Fatalf("Expected 3 hourly records, got %d", len(a.Hourly))
+	}
+	if h := a.Hourly[0]; !h.Time.Equal(now.Truncate(time.Hour)) || h.Hits != 2 || h.Bytes != 150 {
+		t.Errorf("Unexpected first hour %#v", h)
+	}
+	if h := a.Hourly[1]; h.Hits != 0 {
+		t.Errorf("The missing hour should be zero, got %#v", h)
+	}
+	if h := a.Hourly[2]; h.Hits != 1 || h.Errors != 1 {
+		t.Errorf("Unexpected last hour %#v", h)
+	}
+
+	dir := t.TempDir()
+	if err := a.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+	var b AccessAnalytics
+	if err := b.Load(dir); err != nil {
+		t.Fatal(err)
+	}
+	if files := b.TopFiles(0, false); len(files) != 2 || files[0].Hits != 2 {
+		t.Errorf("Unexpected top files after reload %#v", files)
+	}
+}
+
+func TestPruneAccesses(t *testing.T) {
+	m := map[string]*accessCount{
+		"a": {Hits: 3},
+		"b": {Hits: 1},
+		"c": {Hits: 2},
+	}
+	pruneAccesses(m, 2, func(c *accessCount) int64 { return c.Hits })
+	if len(m) != 2 || m["b"] != nil {
+		t.Errorf("Unexpected pruned map %v", m)
+	}
+}
@@ -0,0 +1,272 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type statRecordKind int
+
+const (
+	statRecordHour statRecordKind = iota
+	statRecordDay
+	statRecordMonth
+	statRecordYear
+)
+
+var statRecordKindNames = [...]string{"hour", "day", "month", "year"}
+
+var statRecordLayouts = [...]string{"2006-01-02T15", "2006-01-02", "2006-01", "2006"}
+
+func (k statRecordKind) String() string {
+	return statRecordKindNames[k]
+}
+
+func parseStatRecordKind(s string) (statRecordKind, bool) {
+	for i, n := range statRecordKindNames {
+		if n == s {
+			return (statRecordKind)(i), true
+		}
+	}
+	return 0, false
+}
+
+// statRecordKey identifies a period in absolute UTC time
+type statRecordKey struct {
+	Kind statRecordKind
+	// Time is the start of the period
+	Time time.Time
+}
+
+func (k statRecordKey) String() string {
+	return k.Time.Format(statRecordLayouts[k.Kind])
+}
+
+func parseStatRecordKey(kind statRecordKind, s string) (k statRecordKey, err error) {
+	k.Kind = kind
+	k.Time, err = time.Parse(statRecordLayouts[kind], s)
+	return
+}
+
+type statRecord struct {
+	statRecordKey
+	statInstData
+}
+
+func (t statTime) Time() time.Time {
+	return time.Date(t.Year, (time.Month)(t.Month+1), t.Day+1, t.Hour, 0, 0, 0, time.UTC)
+}
+
+// records converts the relative history of the stats to the absolute periods.
+// The totals of the current day, month and year are included as well,
+// so the periods which only exist in the finer series will not be lost after moved to another date
+func (d *statData) records() (records []statRecord) {
+	if d.Date.Year == 0 {
+		return nil
+	}
+	now := d.Date.Time()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	thisMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	thisYear := time.Date(now.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	yesterday := today.AddDate(0, 0, -1)
+	lastMonth := thisMonth.AddDate(0, -1, 0)
+	lastYear := thisYear.AddDate(-1, 0, 0)
+
+	add := func(kind statRecordKind, t time.Time, data statInstData) {
+		if data != (statInstData{}) {
+			records = append(records, statRecord{statRecordKey{kind, t}, data})
+		}
+	}
+
+	var dayTotal, monthTotal, yearTotal statInstData
+	for i := 0; i <= d.Date.Hour; i++ {
+		add(statRecordHour, today.Add(time.Hour*(time.Duration)(i)), d.Hours[i])
+		dayTotal.update(&d.Hours[i])
+	}
+	for i, v := range d.Prev.Hours {
+		add(statRecordHour, yesterday.Add(time.Hour*(time.Duration)(i)), v)
+	}
+	monthTotal = dayTotal
+	for i := 0; i < d.Date.Day; i++ {
+		add(statRecordDay, thisMonth.AddDate(0, 0, i), d.Days[i])
+		monthTotal.update(&d.Days[i])
+	}
+	add(statRecordDay, today, dayTotal)
+	for i, v := range d.Prev.Days {
+		if t := lastMonth.AddDate(0, 0, i); t.Before(thisMonth) {
+			add(statRecordDay, t, v)
+		}
+	}
+	yearTotal = monthTotal
+	for i := 0; i < d.Date.Month; i++ {
+		add(statRecordMonth, thisYear.AddDate(0, i, 0), d.Months[i])
+		yearTotal.update(&d.Months[i])
+	}
+	add(statRecordMonth, thisMonth, monthTotal)
+	for i, v := range d.Prev.Months {
+		add(statRecordMonth, lastYear.AddDate(0, i, 0), v)
+	}
+	for y, v := range d.Years {
+		if year, err := strconv.Atoi(y); err == nil && year < now.Year() {
+			add(statRecordYear, time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC), v)
+		}
+	}
+	add(statRecordYear, thisYear, yearTotal)
+	sort.Slice(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Time.Before(b.Time)
+	})
+	return
+}
+
+// setRecords rebuilds the history at the date from the records,
+// the records which cannot be represented at the date are dropped
+func (d *statData) setRecords(date statTime, records []statRecord) {
+	d.Date = date
+	d.statHistoryData = statHistoryData{}
+	d.Prev = statHistoryData{}
+	d.Years = make(map[string]statInstData, 2)
+
+	now := date.Time()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	thisMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	thisYear := time.Date(now.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, r := range records {
+		t := r.Time.UTC()
+		switch r.Kind {
+		case statRecordHour:
+			if day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC); day.Equal(today) {
+				if t.Hour() <= date.Hour {
+					d.Hours[t.Hour()] = r.statInstData
+				}
+			} else if day.Equal(today.AddDate(0, 0, -1)) {
+				d.Prev.Hours[t.Hour()] = r.statInstData
+			}
+		case statRecordDay:
+			// the current day is counted by the hours
+			if t.Before(today) && !t.Before(thisMonth) {
+				d.Days[t.Day()-1] = r.statInstData
+			} else if t.Before(thisMonth) && !t.Before(thisMonth.AddDate(0, -1, 0)) {
+				d.Prev.Days[t.Day()-1] = r.statInstData
+			}
+		case statRecordMonth:
+			if t.Before(thisMonth) && !t.Before(thisYear) {
+				d.Months[t.Month()-1] = r.statInstData
+			} else if t.Before(thisYear) && !t.Before(thisYear.AddDate(-1, 0, 0)) {
+				d.Prev.Months[t.Month()-1] = r.statInstData
+			}
+		case statRecordYear:
+			if t.Year() < now.Year() {
+				d.Years[strconv.Itoa(t.Year())] = r.statInstData
+			}
+		}
+	}
+}
+
+type StatMergeRule string
+
+const (
+	// StatMergeSum adds the imported data to the existing data, which is used to consolidate different clusters
+	StatMergeSum StatMergeRule = "sum"
+	// StatMergeMax keeps the larger one, so importing the same data twice will not count it twice
+	StatMergeMax StatMergeRule = "max"
+	// StatMergeKeep keeps the existing data
+	StatMergeKeep StatMergeRule = "keep"
+	// StatMergeReplace overrides the existing data with the imported data
+	StatMergeReplace StatMergeRule = "replace"
+)
+
+func ParseStatMergeRule(s string) (StatMergeRule, bool) {
+	switch r := (StatMergeRule)(strings.ToLower(s)); r {
+	case StatMergeSum, StatMergeMax, StatMergeKeep, StatMergeReplace:
+		return r, true
+	}
+	return "", false
+}
+
+func (r StatMergeRule) merge(existing, imported statInstData) statInstData {
+	switch r {
+	case StatMergeSum:
+		existing.update(&imported)
+		return existing
+	case StatMergeMax:
+		if imported.Hits > existing.Hits || (imported.Hits == existing.Hits && imported.Bytes > existing.Bytes) {
+			return imported
+		}
+		return existing
+	case StatMergeKeep:
+		return existing
+	case StatMergeReplace:
+		return imported
+	}
+	panic("unknown merge rule " + (string)(r))
+}
+
+func (r StatMergeRule) mergeCount(existing, imported int) int {
+	switch r {
+	case StatMergeSum:
+		return existing + imported
+	case StatMergeMax:
+		return max(existing, imported)
+	case StatMergeKeep:
+		return existing
+	case StatMergeReplace:
+		return imported
+	}
+	panic("unknown merge rule " + (string)(r))
+}
+
+// Merge merges the records and accesses into d with the rule, the history of d will be moved to now
+func (d *statData) Merge(records []statRecord, accesses map[string]int, rule StatMergeRule, now time.Time) {
+	merged := make(map[statRecordKey]statInstData)
+	for _, r := range d.records() {
+		merged[r.statRecordKey] = r.statInstData
+	}
+	for _, r := range records {
+		if v, ok := merged[r.statRecordKey]; ok {
+			merged[r.statRecordKey] = rule.merge(v, r.statInstData)
+		} else {
+			merged[r.statRecordKey] = r.statInstData
+		}
+	}
+	records = make([]statRecord, 0, len(merged))
+	for k, v := range merged {
+		records = append(records, statRecord{k, v})
+	}
+	d.setRecords(makeStatTime(now), records)
+
+	if d.Accesses == nil {
+		d.Accesses = make(map[string]int, len(accesses))
+	}
+	for ua, n := range accesses {
+		if v, ok := d.Accesses[ua]; ok {
+			d.Accesses[ua] = rule.mergeCount(v, n)
+		} else {
+			d.Accesses[ua] = n
+		}
+	}
+}
@@ -0,0 +1,108 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"bytes"
+	"reflect"
+	"time"
+)
+
+func newTestStatData() *statData {
+	d := new(statData)
+	d.Date = makeStatTime(time.Date(2024, 3, 10, 5, 30, 0, 0, time.UTC))
+	d.Hours[5] = statInstData{Hits: 2, Bytes: 100}
+	d.Prev.Hours[23] = statInstData{Hits: 1, Bytes: 50}
+	d.Days[0] = statInstData{Hits: 3, Bytes: 300}
+	d.Months[0] = statInstData{Hits: 4, Bytes: 400}
+	d.Years = map[string]statInstData{"2023": {Hits: 5, Bytes: 500}}
+	d.Accesses = map[string]int{"a": 1}
+	return d
+}
+
+func TestStatRecords(t *testing.T) {
+	d := newTestStatData()
+	var got statData
+	got.Accesses = d.Accesses
+	got.setRecords(d.Date, d.records())
+	if !reflect.DeepEqual(&got, d) {
+		t.Errorf("Stats changed after converted to records:\ngot  %#v\nwant %#v", &got, d)
+	}
+
+	// move to the next day, the current day should become a day record
+	got.Merge(nil, nil, StatMergeSum, time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC))
+	if v := got.Prev.Hours[5]; v != d.Hours[5] {
+		t.Errorf("Expected hour 5 of yesterday is %v, got %v", d.Hours[5], v)
+	}
+	if v := got.Days[9]; v != d.Hours[5] {
+		t.Errorf("Expected day 10 is %v, got %v", d.Hours[5], v)
+	}
+	if v := got.Days[0]; v != d.Days[0] {
+		t.Errorf("Expected day 1 is %v, got %v", d.Days[0], v)
+	}
+}
+
+func TestStatMerge(t *testing.T) {
+	now := newTestStatData().Date.Time()
+	for _, rule := range []StatMergeRule{StatMergeSum, StatMergeMax, StatMergeKeep, StatMergeReplace} {
+		d, o := newTestStatData(), newTestStatData()
+		o.Hours[5].Hits = 7
+		o.Accesses["b"] = 2
+		d.Merge(o.records(), o.Accesses, rule, now)
+		var want int32
+		switch rule {
+		case StatMergeSum:
+			want = 9
+		case StatMergeMax, StatMergeReplace:
+			want = 7
+		case StatMergeKeep:
+			want = 2
+		}
+		if d.Hours[5].Hits != want {
+			t.Errorf("%s: Expected %d hits, got %d", rule, want, d.Hours[5].Hits)
+		}
+		if rule == StatMergeSum && (d.Days[0].Hits != 6 || d.Accesses["a"] != 2) {
+			t.Errorf("%s: Expected the other data is summed, got %v, %v", rule, d.Days[0], d.Accesses)
+		}
+		if d.Accesses["b"] != 2 {
+			t.Errorf("%s: Expected new user agent is imported, got %v", rule, d.Accesses)
+		}
+	}
+}
+
+func TestStatsCSV(t *testing.T) {
+	d := newTestStatData()
+	var buf bytes.Buffer
+	if err := writeStatsCSV(&buf, d); err != nil {
+		t.Fatal(err)
+	}
+	records, accesses, err := readStatsCSV(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(records, d.records()) {
+		t.Errorf("Records mismatch:\ngot  %v\nwant %v", records, d.records())
+	}
+	if !reflect.DeepEqual(accesses, d.Accesses) {
+		t.Errorf("Accesses mismatch: got %v, want %v", accesses, d.Accesses)
+	}
+}
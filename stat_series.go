@@ -0,0 +1,317 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	seriesDirName     = "series"
+	seriesMinutesDir  = "minutes"
+	seriesHoursDir    = "hours"
+	seriesRecordSize  = 8 * 3
+	seriesDayLayout   = "2006-01-02"
+	seriesFileExt     = ".bin"
+	seriesMaxBuckets  = 10000
+	seriesMinStep     = time.Minute
+	seriesHourlyAfter = 24 * time.Hour * 7
+	// seriesHourlyRetention is how long the hourly records are kept
+	seriesHourlyRetention = 24 * time.Hour * 365 * 5
+)
+
+// StatSeries is an append-only time series store of the hits and bytes.
+// The records of the recent days are saved with minute granularity, one file per day,
+// and the older ones are downsampled into hourly records, one file per year.
+// Each record is three big-endian int64: unix time, hits and bytes.
+type StatSeries struct {
+	dir string
+	mux sync.Mutex
+	// compacted is the UTC day which all the days before it has been downsampled
+	compacted time.Time
+}
+
+var errInvalidSeriesQuery = errors.New("invalid series query")
+
+type SeriesBucket struct {
+	Time  time.Time `json:"time"`
+	Hits  int64     `json:"hits"`
+	Bytes int64     `json:"bytes"`
+}
+
+type seriesRecord struct {
+	time  int64
+	hits  int64
+	bytes int64
+}
+
+func NewStatSeries(dir string) (s *StatSeries, err error) {
+	s = &StatSeries{
+		dir: dir,
+	}
+	if err = os.MkdirAll(filepath.Join(dir, seriesMinutesDir), 0755); err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Join(dir, seriesHoursDir), 0755); err != nil {
+		return
+	}
+	return
+}
+
+func seriesDay(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+func (s *StatSeries) minutesPath(day time.Time) string {
+	return filepath.Join(s.dir, seriesMinutesDir, day.Format(seriesDayLayout)+seriesFileExt)
+}
+
+func (s *StatSeries) hoursPath(year int) string {
+	return filepath.Join(s.dir, seriesHoursDir, strconv.Itoa(year)+seriesFileExt)
+}
+
+// Append adds the hits and bytes at the time, the records are never modified after written
+func (s *StatSeries) Append(t time.Time, hits int64, bytes int64) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	day := seriesDay(t)
+	if s.compacted.Before(day) {
+		if err := s.compact(day); err != nil {
+			logErrorf("Cannot downsample stat series: %v", err)
+		}
+	}
+	return appendSeriesRecords(s.minutesPath(day), []seriesRecord{{t.Unix(), hits, bytes}})
+}
+
+// appendSeriesRecords appends the records to the file.
+// If the last write was interrupted, the incomplete record will be discarded
+func appendSeriesRecords(path string, records []seriesRecord) (err error) {
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+	stat, err := fd.Stat()
+	if err != nil {
+		return
+	}
+	if n := stat.Size(); n%seriesRecordSize != 0 {
+		if err = fd.Truncate(n - n%seriesRecordSize); err != nil {
+			return
+		}
+	}
+	buf := make([]byte, 0, len(records)*seriesRecordSize)
+	for _, r := range records {
+		buf = binary.BigEndian.AppendUint64(buf, (uint64)(r.time))
+		buf = binary.BigEndian.AppendUint64(buf, (uint64)(r.hits))
+		buf = binary.BigEndian.AppendUint64(buf, (uint64)(r.bytes))
+	}
+	_, err = fd.Write(buf)
+	return
+}
+
+// readSeriesRecords reads the records in the file, a missing file is treated as empty
+func readSeriesRecords(path string) ([]seriesRecord, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	records := make([]seriesRecord, len(buf)/seriesRecordSize)
+	for i := range records {
+		b := buf[i*seriesRecordSize:]
+		records[i] = seriesRecord{
+			time:  (int64)(binary.BigEndian.Uint64(b[0:8])),
+			hits:  (int64)(binary.BigEndian.Uint64(b[8:16])),
+			bytes: (int64)(binary.BigEndian.Uint64(b[16:24])),
+		}
+	}
+	return records, nil
+}
+
+// minuteDays returns the days which have minute records in ascending order
+func (s *StatSeries) minuteDays() ([]time.Time, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, seriesMinutesDir))
+	if err != nil {
+		return nil, err
+	}
+	days := make([]time.Time, 0, len(entries))
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), seriesFileExt)
+		if !ok {
+			continue
+		}
+		if day, err := time.Parse(seriesDayLayout, name); err == nil {
+			days = append(days, day)
+		}
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+	return days, nil
+}
+
+// compact downsamples the minute records older than seriesHourlyAfter into hourly records,
+// and removes the hourly records which exceed the retention.
+// It must be called with the lock held
+func (s *StatSeries) compact(today time.Time) error {
+	before := today.Add(-seriesHourlyAfter)
+	days, err := s.minuteDays()
+	if err != nil {
+		return err
+	}
+	for _, day := range days {
+		if !day.Before(before) {
+			break
+		}
+		if err := s.downsampleDay(day); err != nil {
+			return fmt.Errorf("day %s: %w", day.Format(seriesDayLayout), err)
+		}
+	}
+
+	expireYear := today.Add(-seriesHourlyRetention).Year()
+	entries, err := os.ReadDir(filepath.Join(s.dir, seriesHoursDir))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), seriesFileExt)
+		if !ok {
+			continue
+		}
+		if year, err := strconv.Atoi(name); err == nil && year < expireYear {
+			os.Remove(filepath.Join(s.dir, seriesHoursDir, e.Name()))
+		}
+	}
+	s.compacted = today
+	return nil
+}
+
+// downsampleDay merges the minute records of the day into the hourly file, then removes the minute file
+func (s *StatSeries) downsampleDay(day time.Time) error {
+	minutesPath := s.minutesPath(day)
+	records, err := readSeriesRecords(minutesPath)
+	if err != nil {
+		return err
+	}
+	hoursPath := s.hoursPath(day.Year())
+	hourly, err := readSeriesRecords(hoursPath)
+	if err != nil {
+		return err
+	}
+	// the day may be already downsampled if the minute file was not removed last time
+	if n := len(hourly); n == 0 || hourly[n-1].time < day.Unix() {
+		var merged []seriesRecord
+		for _, r := range records {
+			hour := r.time - r.time%3600
+			if n := len(merged); n > 0 && merged[n-1].time == hour {
+				merged[n-1].hits += r.hits
+				merged[n-1].bytes += r.bytes
+			} else {
+				merged = append(merged, seriesRecord{hour, r.hits, r.bytes})
+			}
+		}
+		if len(merged) > 0 {
+			if err := appendSeriesRecords(hoursPath, merged); err != nil {
+				return err
+			}
+		}
+	}
+	return os.Remove(minutesPath)
+}
+
+// Query sums the hits and bytes into the buckets of step in [from, to).
+// The records older than a week are hourly, so they are counted in the bucket which contains the start of their hours
+func (s *StatSeries) Query(from, to time.Time, step time.Duration) ([]SeriesBucket, error) {
+	if step < seriesMinStep {
+		return nil, fmt.Errorf("%w: step cannot be less than %s", errInvalidSeriesQuery, seriesMinStep)
+	}
+	if !from.Before(to) {
+		return nil, fmt.Errorf("%w: from must be before to", errInvalidSeriesQuery)
+	}
+	// the duration saturates if the range is too large, which cannot be divided into buckets correctly
+	span := to.Sub(from)
+	if !from.Add(span).Equal(to) {
+		return nil, fmt.Errorf("%w: time range is too large", errInvalidSeriesQuery)
+	}
+	count := (int64)(span / step)
+	if span%step != 0 {
+		count++
+	}
+	if count > seriesMaxBuckets {
+		return nil, fmt.Errorf("%w: too many buckets (%d > %d), please use a larger step", errInvalidSeriesQuery, count, seriesMaxBuckets)
+	}
+	buckets := make([]SeriesBucket, count)
+	for i := range buckets {
+		buckets[i].Time = from.Add(step * (time.Duration)(i))
+	}
+	add := func(records []seriesRecord) {
+		for _, r := range records {
+			t := time.Unix(r.time, 0)
+			if t.Before(from) || !t.Before(to) {
+				continue
+			}
+			b := &buckets[(int)(t.Sub(from)/step)]
+			b.Hits += r.hits
+			b.Bytes += r.bytes
+		}
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	// the hourly records may start at most an hour before from,
+	// and there are no records before 1970 or in the future
+	firstYear := max(from.Add(-time.Hour).UTC().Year(), 1970)
+	lastYear := min(to.UTC().Year(), time.Now().UTC().Year())
+	for year := firstYear; year <= lastYear; year++ {
+		records, err := readSeriesRecords(s.hoursPath(year))
+		if err != nil {
+			return nil, err
+		}
+		add(records)
+	}
+	days, err := s.minuteDays()
+	if err != nil {
+		return nil, err
+	}
+	for _, day := range days {
+		if day.Before(seriesDay(from)) || !day.Before(to) {
+			continue
+		}
+		records, err := readSeriesRecords(s.minutesPath(day))
+		if err != nil {
+			return nil, err
+		}
+		add(records)
+	}
+	return buckets, nil
+}
@@ -0,0 +1,111 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func TestStatSeries(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewStatSeries(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC().Truncate(time.Hour)
+	old := now.Add(-time.Hour * 24 * 10)
+	for _, r := range []struct {
+		t     time.Time
+		hits  int64
+		bytes int64
+	}{
+		{old.Add(time.Minute), 1, 10},
+		{old.Add(time.Minute * 2), 2, 20},
+		{old.Add(time.Minute * 61), 4, 40},
+		{now.Add(time.Minute * 5), 8, 80},
+	} {
+		if err := s.Append(r.t, r.hits, r.bytes); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(s.minutesPath(seriesDay(old))); !os.IsNotExist(err) {
+		t.Errorf("The old minute file should be downsampled, got %v", err)
+	}
+	hourly, err := readSeriesRecords(s.hoursPath(old.Year()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hourly) != 2 || hourly[0].hits != 3 || hourly[1].hits != 4 {
+		t.Errorf("Unexpected hourly records %v", hourly)
+	}
+
+	buckets, err := s.Query(old, now.Add(time.Hour), time.Hour*24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 11 {
+		t.Fatalf("Expected 11 buckets, got %d", len(buckets))
+	}
+	if b := buckets[0]; b.Hits != 7 || b.Bytes != 70 {
+		t.Errorf("Unexpected first bucket %#v", b)
+	}
+	if b := buckets[10]; b.Hits != 8 || !b.Time.Equal(old.Add(time.Hour*24*10)) {
+		t.Errorf("Unexpected last bucket %#v", b)
+	}
+	if _, err := s.Query(old, now, time.Second); err == nil {
+		t.Errorf("Should reject the step less than a minute")
+	}
+	// the duration of the range overflows
+	first := time.Date(1, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, step := range []time.Duration{time.Minute, time.Hour * 24 * 365 * 100} {
+		if _, err := s.Query(first, now, step); !errors.Is(err, errInvalidSeriesQuery) {
+			t.Errorf("Should reject the too large range with step %s, got %v", step, err)
+		}
+	}
+}
+
+func TestStatSeriesPartialRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.bin")
+	if err := appendSeriesRecords(path, []seriesRecord{{1, 2, 3}}); err != nil {
+		t.Fatal(err)
+	}
+	// simulate an interrupted write
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.Write([]byte{0, 1, 2})
+	fd.Close()
+	if err := appendSeriesRecords(path, []seriesRecord{{4, 5, 6}}); err != nil {
+		t.Fatal(err)
+	}
+	records, err := readSeriesRecords(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[1] != (seriesRecord{4, 5, 6}) {
+		t.Errorf("Unexpected records %v", records)
+	}
+}
@@ -55,6 +55,8 @@ const (
 	StorageLocal  = "local"
 	StorageMount  = "mount"
 	StorageWebdav = "webdav"
+	StorageS3     = "s3"
+	StorageCached = "cached"
 )
 
 type StorageFactory struct {
@@ -62,7 +64,7 @@ type StorageFactory struct {
 	NewConfig func() any
 }
 
-var storageFactories = make(map[string]StorageFactory, 3)
+var storageFactories = make(map[string]StorageFactory, 5)
 
 func RegisterStorageFactory(typ string, inst StorageFactory) {
 	if inst.New == nil || inst.NewConfig == nil {
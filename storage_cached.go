@@ -0,0 +1,351 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type CachedStorageOption struct {
+	// Path is the local directory to store the hot files
+	Path string `yaml:"path"`
+	// MaxSize is the size budget of the local cache in MiB
+	MaxSize int64 `yaml:"max-size"`
+	// MinHits is how many times a file should be requested before it's copied to local
+	MinHits int `yaml:"min-hits"`
+	// MaxFileSize is the max size of a single cached file in MiB, 0 means no limit except MaxSize
+	MaxFileSize int64 `yaml:"max-file-size"`
+	// Storage is the wrapped remote storage
+	Storage StorageOption `yaml:"storage"`
+}
+
+var (
+	_ yaml.Marshaler   = (*CachedStorageOption)(nil)
+	_ yaml.Unmarshaler = (*CachedStorageOption)(nil)
+)
+
+func (o *CachedStorageOption) MarshalYAML() (any, error) {
+	type T CachedStorageOption
+	return (*T)(o), nil
+}
+
+func (o *CachedStorageOption) UnmarshalYAML(n *yaml.Node) (err error) {
+	// set default values
+	o.Path = "hot-cache"
+	o.MaxSize = 1024 * 10
+	o.MinHits = 2
+	o.MaxFileSize = 0
+
+	type T CachedStorageOption
+	if err = n.Decode((*T)(o)); err != nil {
+		return
+	}
+	return
+}
+
+const (
+	cachedStorageMaxFills   = 4
+	cachedStorageMaxHitKeys = 1024 * 64
+)
+
+type cachedFile struct {
+	hash string
+	size int64
+}
+
+// CachedStorage keeps the frequently requested files of the wrapped storage on local disk,
+// the least recently used files will be evicted when the cache is full.
+//
+// The wrapped storage is still the source of truth,
+// so Size, Open, WalkDir and the sync operations are all forwarded to it.
+type CachedStorage struct {
+	opt CachedStorageOption
+
+	inner Storage
+	local *LocalStorage
+
+	mux     sync.Mutex
+	lru     *list.List // front is the most recently used
+	entries map[string]*list.Element
+	size    int64
+	hits    map[string]int
+	filling map[string]struct{}
+	fillSem chan struct{}
+}
+
+var _ Storage = (*CachedStorage)(nil)
+
+func init() {
+	RegisterStorageFactory(StorageCached, StorageFactory{
+		New:       func() Storage { return new(CachedStorage) },
+		NewConfig: func() any { return new(CachedStorageOption) },
+	})
+}
+
+func (s *CachedStorage) String() string {
+	return fmt.Sprintf("<CachedStorage path=%q storage=%s>", s.opt.Path, s.inner)
+}
+
+func (s *CachedStorage) Options() any {
+	return &s.opt
+}
+
+func (s *CachedStorage) SetOptions(newOpts any) {
+	s.opt = *(newOpts.(*CachedStorageOption))
+	s.inner = NewStorage(s.opt.Storage)
+	s.local = new(LocalStorage)
+	s.local.SetOptions(&LocalStorageOption{
+		CachePath: s.opt.Path,
+	})
+}
+
+func (s *CachedStorage) maxSize() int64 {
+	return s.opt.MaxSize * 1024 * 1024
+}
+
+func (s *CachedStorage) Init(ctx context.Context) (err error) {
+	s.lru = list.New()
+	s.entries = make(map[string]*list.Element)
+	s.hits = make(map[string]int)
+	s.filling = make(map[string]struct{})
+	s.fillSem = make(chan struct{}, cachedStorageMaxFills)
+
+	if err = s.local.Init(ctx); err != nil {
+		return
+	}
+	// load the files which are cached before, the recently modified files are considered as recently used
+	type fileWithTime struct {
+		cachedFile
+		modTime time.Time
+	}
+	var files []fileWithTime
+	walkCacheDir(s.opt.Path, func(hash string, size int64) error {
+		if info, err := os.Stat(s.local.hashToPath(hash)); err == nil {
+			files = append(files, fileWithTime{cachedFile{hash, size}, info.ModTime()})
+		}
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.After(files[j].modTime) })
+	s.mux.Lock()
+	for i := range files {
+		f := &files[i].cachedFile
+		s.entries[f.hash] = s.lru.PushBack(f)
+		s.size += f.size
+	}
+	s.evictLocked()
+	s.mux.Unlock()
+	logInfof("Loaded %d hot cached files for %s, total %s", len(files), s.inner.String(), bytesToUnit((float64)(s.size)))
+
+	return s.inner.Init(ctx)
+}
+
+func (s *CachedStorage) Size(hash string) (int64, error) {
+	return s.inner.Size(hash)
+}
+
+func (s *CachedStorage) Open(hash string) (io.ReadCloser, error) {
+	return s.inner.Open(hash)
+}
+
+func (s *CachedStorage) Create(hash string, r io.ReadSeeker) error {
+	// the content may be changed, so drop the old cache
+	s.drop(hash)
+	return s.inner.Create(hash, r)
+}
+
+func (s *CachedStorage) Remove(hash string) error {
+	s.drop(hash)
+	return s.inner.Remove(hash)
+}
+
+func (s *CachedStorage) WalkDir(walker func(hash string, size int64) error) error {
+	return s.inner.WalkDir(walker)
+}
+
+func (s *CachedStorage) ServeDownload(rw http.ResponseWriter, req *http.Request, hash string, size int64) (int64, error) {
+	if s.touch(hash) {
+		n, err := s.local.ServeDownload(rw, req, hash, size)
+		if err == nil {
+			return n, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return n, err
+		}
+		// the file was removed externally
+		s.drop(hash)
+	} else if s.shouldFill(hash, size) {
+		go s.fill(hash, size)
+	}
+	return s.inner.ServeDownload(rw, req, hash, size)
+}
+
+func (s *CachedStorage) ServeMeasure(rw http.ResponseWriter, req *http.Request, size int) error {
+	return s.inner.ServeMeasure(rw, req, size)
+}
+
+// touch marks the file as recently used and reports whether it's cached
+func (s *CachedStorage) touch(hash string) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	e, ok := s.entries[hash]
+	if ok {
+		s.lru.MoveToFront(e)
+	}
+	return ok
+}
+
+// shouldFill counts the hits of an uncached file,
+// and reports whether it should be copied to local now
+func (s *CachedStorage) shouldFill(hash string, size int64) bool {
+	if size <= 0 || size > s.maxSize() || (s.opt.MaxFileSize > 0 && size > s.opt.MaxFileSize*1024*1024) {
+		return false
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if _, ok := s.filling[hash]; ok {
+		return false
+	}
+	if len(s.hits) >= cachedStorageMaxHitKeys {
+		// forget the old counters, so the map will not grow forever
+		clear(s.hits)
+	}
+	s.hits[hash]++
+	if s.hits[hash] < s.opt.MinHits {
+		return false
+	}
+	select {
+	case s.fillSem <- struct{}{}:
+	default:
+		// too many files are filling, try next time
+		return false
+	}
+	delete(s.hits, hash)
+	s.filling[hash] = struct{}{}
+	return true
+}
+
+// fill copies the file from the wrapped storage to local
+func (s *CachedStorage) fill(hash string, size int64) {
+	defer func() {
+		s.mux.Lock()
+		delete(s.filling, hash)
+		s.mux.Unlock()
+		<-s.fillSem
+	}()
+	if err := s.copyToLocal(hash, size); err != nil {
+		logErrorf("Could not cache %s from %s: %v", hash, s.inner.String(), err)
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if _, ok := s.entries[hash]; !ok {
+		s.entries[hash] = s.lru.PushFront(&cachedFile{hash, size})
+		s.size += size
+	}
+	s.evictLocked()
+}
+
+func (s *CachedStorage) copyToLocal(hash string, size int64) (err error) {
+	hashMethod, err := getHashMethod(len(hash))
+	if err != nil {
+		return
+	}
+	r, err := s.inner.Open(hash)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	fd, err := os.CreateTemp(s.local.opt.TmpPath(), "*.filling")
+	if err != nil {
+		return
+	}
+	tmpPath := fd.Name()
+	defer os.Remove(tmpPath)
+
+	hw := hashMethod.New()
+	var buf []byte
+	{
+		buf0 := bufPool.Get().(*[]byte)
+		defer bufPool.Put(buf0)
+		buf = *buf0
+	}
+	n, err := io.CopyBuffer(io.MultiWriter(fd, hw), r, buf)
+	if e := fd.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		return
+	}
+	if n != size {
+		return fmt.Errorf("File size wrong, got %d, expect %d", n, size)
+	}
+	if hs := hex.EncodeToString(hw.Sum(buf[:0])); hs != hash {
+		return fmt.Errorf("File hash not match, got %s, expect %s", hs, hash)
+	}
+	return os.Rename(tmpPath, s.local.hashToPath(hash))
+}
+
+// drop removes the file from the local cache
+func (s *CachedStorage) drop(hash string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if e, ok := s.entries[hash]; ok {
+		s.removeLocked(e)
+	}
+}
+
+func (s *CachedStorage) removeLocked(e *list.Element) {
+	f := s.lru.Remove(e).(*cachedFile)
+	delete(s.entries, f.hash)
+	s.size -= f.size
+	if err := s.local.Remove(f.hash); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logErrorf("Could not remove cached file %s: %v", f.hash, err)
+	}
+}
+
+// evictLocked removes the least recently used files until the cache fits the size budget
+func (s *CachedStorage) evictLocked() {
+	max := s.maxSize()
+	for s.size > max {
+		e := s.lru.Back()
+		if e == nil {
+			return
+		}
+		s.removeLocked(e)
+	}
+}
+
+// Unwrap returns the wrapped storage
+func (s *CachedStorage) Unwrap() Storage {
+	return s.inner
+}
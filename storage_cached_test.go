@@ -0,0 +1,166 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func TestCachedStorage(t *testing.T) {
+	dir := t.TempDir()
+	inner := new(LocalStorage)
+	inner.SetOptions(&LocalStorageOption{CachePath: filepath.Join(dir, "inner")})
+	s := &CachedStorage{
+		opt: CachedStorageOption{
+			Path:    filepath.Join(dir, "hot"),
+			MaxSize: 1,
+			MinHits: 2,
+		},
+		inner: inner,
+		local: new(LocalStorage),
+	}
+	s.local.SetOptions(&LocalStorageOption{CachePath: s.opt.Path})
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+
+	newFile := func(b byte) (string, []byte) {
+		data := bytes.Repeat([]byte{b}, 600*1024)
+		sum := md5.Sum(data)
+		hash := hex.EncodeToString(sum[:])
+		if err := s.Create(hash, bytes.NewReader(data)); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		return hash, data
+	}
+	serve := func(hash string, data []byte) {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/download/"+hash, nil)
+		if _, err := s.ServeDownload(rw, req, hash, (int64)(len(data))); err != nil {
+			t.Fatalf("ServeDownload: %v", err)
+		}
+		if !bytes.Equal(rw.Body.Bytes(), data) {
+			t.Fatalf("Unexpected content of %s", hash)
+		}
+	}
+	waitCached := func(hash string) {
+		for i := 0; i < 100; i++ {
+			s.mux.Lock()
+			_, filling := s.filling[hash]
+			s.mux.Unlock()
+			if !filling {
+				return
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		t.Fatalf("Fill %s timeout", hash)
+	}
+
+	hash1, data1 := newFile('a')
+	serve(hash1, data1)
+	if s.touch(hash1) {
+		t.Fatalf("File should not be cached before min hits")
+	}
+	serve(hash1, data1)
+	waitCached(hash1)
+	if !s.touch(hash1) {
+		t.Fatalf("File should be cached after min hits")
+	}
+	// the cached copy should be served even if the inner storage lost it
+	os.Remove(inner.hashToPath(hash1))
+	serve(hash1, data1)
+
+	hash2, data2 := newFile('b')
+	serve(hash2, data2)
+	serve(hash2, data2)
+	waitCached(hash2)
+	if s.touch(hash1) || !s.touch(hash2) {
+		t.Errorf("The least recently used file should be evicted")
+	}
+	if _, err := os.Stat(s.local.hashToPath(hash1)); !os.IsNotExist(err) {
+		t.Errorf("Evicted file should be removed, got %v", err)
+	}
+}
+
+func TestCachedStorageInitEvict(t *testing.T) {
+	dir := t.TempDir()
+	hot := new(LocalStorage)
+	hot.SetOptions(&LocalStorageOption{CachePath: filepath.Join(dir, "hot")})
+	if err := hot.Init(context.Background()); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	// from the most recently used one to the least
+	sizes := []int{900 * 1024, 200 * 1024, 100 * 1024}
+	hashes := make([]string, len(sizes))
+	now := time.Now()
+	for i, n := range sizes {
+		data := bytes.Repeat([]byte{(byte)('a' + i)}, n)
+		sum := md5.Sum(data)
+		hashes[i] = hex.EncodeToString(sum[:])
+		if err := hot.Create(hashes[i], bytes.NewReader(data)); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		mtime := now.Add(-time.Duration(i) * time.Hour)
+		if err := os.Chtimes(hot.hashToPath(hashes[i]), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	inner := new(LocalStorage)
+	inner.SetOptions(&LocalStorageOption{CachePath: filepath.Join(dir, "inner")})
+	s := &CachedStorage{
+		opt: CachedStorageOption{
+			Path:    filepath.Join(dir, "hot"),
+			MaxSize: 1,
+		},
+		inner: inner,
+		local: hot,
+	}
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+
+	if s.size != (int64)(sizes[0]) {
+		t.Errorf("Cache size is %d, expect %d", s.size, sizes[0])
+	}
+	if len(s.entries) != 1 || s.lru.Len() != 1 {
+		t.Fatalf("Expect 1 entry left, got %d entries and %d elements", len(s.entries), s.lru.Len())
+	}
+	if e, ok := s.entries[hashes[0]]; !ok || e.Value.(*cachedFile).hash != hashes[0] {
+		t.Errorf("The most recently used file is not kept")
+	}
+	if _, err := os.Stat(hot.hashToPath(hashes[0])); err != nil {
+		t.Errorf("The most recently used file is removed: %v", err)
+	}
+	for _, hash := range hashes[1:] {
+		if _, err := os.Stat(hot.hashToPath(hash)); !os.IsNotExist(err) {
+			t.Errorf("Evicted file %s should be removed, got %v", hash, err)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StorageHealthChecker can be implemented by the storages which have a better way to check their health.
+// Storages without it will be probed by querying the size of a file.
+type StorageHealthChecker interface {
+	CheckHealth(ctx context.Context) error
+}
+
+type CircuitState int
+
+const (
+	// CircuitClosed means the storage is healthy
+	CircuitClosed CircuitState = iota
+	// CircuitOpen means the storage is excluded from serving
+	CircuitOpen
+	// CircuitHalfOpen means the storage passed the probe and is waiting for a successful request
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "healthy"
+	case CircuitOpen:
+		return "unhealthy"
+	case CircuitHalfOpen:
+		return "recovering"
+	default:
+		return "unknown"
+	}
+}
+
+func (s CircuitState) MarshalText() ([]byte, error) {
+	return ([]byte)(s.String()), nil
+}
+
+const (
+	healthFailThreshold = 5
+	healthMinCooldown   = time.Second * 30
+	healthMaxCooldown   = time.Minute * 10
+	healthCheckInterval = time.Minute * 3
+	healthProbeTimeout  = time.Second * 10
+	healthLatencySmooth = 0.2
+	healthProbeInterval = time.Second * 10
+)
+
+// StorageHealth tracks the error rate and latency of a storage, and works as a circuit breaker
+type StorageHealth struct {
+	mux          sync.Mutex
+	state        CircuitState
+	failStreak   int
+	successCount int64
+	failCount    int64
+	latency      time.Duration
+	cooldown     time.Duration
+	openedAt     time.Time
+	lastCheck    time.Time
+	lastError    string
+	// probing is set while a probe which cannot be canceled is running
+	probing atomic.Bool
+}
+
+type StorageHealthStatus struct {
+	Id        string       `json:"id"`
+	State     CircuitState `json:"state"`
+	Success   int64        `json:"success"`
+	Failed    int64        `json:"failed"`
+	ErrorRate float64      `json:"errorRate"`
+	// Latency is the smoothed time in milliseconds used by serving a request
+	Latency   float64    `json:"latency"`
+	OpenedAt  *time.Time `json:"openedAt,omitempty"`
+	LastError string     `json:"lastError,omitempty"`
+}
+
+func NewStorageHealth() *StorageHealth {
+	return &StorageHealth{
+		cooldown: healthMinCooldown,
+	}
+}
+
+// isHealthError reports whether the error means the storage is not working
+func isHealthError(err error) bool {
+	return err != nil && !errors.Is(err, os.ErrNotExist) && !errors.Is(err, context.Canceled)
+}
+
+// Available reports whether the storage should be used to serve requests
+func (h *StorageHealth) Available() bool {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	return h.state != CircuitOpen
+}
+
+// Record updates the health with the result of a request,
+// it returns true if the circuit is opened by this failure
+func (h *StorageHealth) Record(err error, used time.Duration) (opened bool) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	if !isHealthError(err) {
+		h.successCount++
+		h.failStreak = 0
+		if h.latency == 0 {
+			h.latency = used
+		} else {
+			h.latency += (time.Duration)((float64)(used-h.latency) * healthLatencySmooth)
+		}
+		if h.state == CircuitHalfOpen {
+			h.state = CircuitClosed
+			h.cooldown = healthMinCooldown
+		}
+		return false
+	}
+	h.failCount++
+	h.failStreak++
+	h.lastError = err.Error()
+	if h.state == CircuitHalfOpen || (h.state == CircuitClosed && h.failStreak >= healthFailThreshold) {
+		h.open()
+		return true
+	}
+	return false
+}
+
+// open must be called with the lock held
+func (h *StorageHealth) open() {
+	if h.state == CircuitHalfOpen {
+		// failed again after recovering, wait longer
+		h.cooldown *= 2
+		if h.cooldown > healthMaxCooldown {
+			h.cooldown = healthMaxCooldown
+		}
+	}
+	h.state = CircuitOpen
+	h.openedAt = time.Now()
+}
+
+// shouldProbe reports whether the storage need to be checked now
+func (h *StorageHealth) shouldProbe(now time.Time, hasChecker bool) bool {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if h.state == CircuitOpen {
+		return now.Sub(h.openedAt) >= h.cooldown && now.Sub(h.lastCheck) >= h.cooldown
+	}
+	// storages with their own checker are checked periodically even if they are healthy
+	return hasChecker && now.Sub(h.lastCheck) >= healthCheckInterval
+}
+
+// recordProbe updates the circuit state with the probe result
+func (h *StorageHealth) recordProbe(err error) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.lastCheck = time.Now()
+	if err != nil {
+		h.lastError = err.Error()
+		if h.state != CircuitOpen {
+			h.open()
+		} else {
+			h.openedAt = h.lastCheck
+		}
+		return
+	}
+	if h.state == CircuitOpen {
+		h.state = CircuitHalfOpen
+	}
+}
+
+func (h *StorageHealth) Status(id string) (s StorageHealthStatus) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	s.Id = id
+	s.State = h.state
+	s.Success = h.successCount
+	s.Failed = h.failCount
+	if total := h.successCount + h.failCount; total > 0 {
+		s.ErrorRate = (float64)(h.failCount) / (float64)(total)
+	}
+	s.Latency = (float64)(h.latency) / (float64)(time.Millisecond)
+	if h.state != CircuitClosed {
+		openedAt := h.openedAt
+		s.OpenedAt = &openedAt
+	}
+	s.LastError = h.lastError
+	return
+}
+
+// getHealthChecker returns the health checker of the storage,
+// the wrapper storages are healthy only if the wrapped one is
+func getHealthChecker(s Storage) (checker StorageHealthChecker, ok bool) {
+	for {
+		if checker, ok = s.(StorageHealthChecker); ok {
+			return
+		}
+		w, ok := s.(interface{ Unwrap() Storage })
+		if !ok {
+			return nil, false
+		}
+		s = w.Unwrap()
+	}
+}
+
+var errProbeRunning = errors.New("Previous health probe is still running")
+
+// probeStorage checks whether the storage is working
+func (cr *Cluster) probeStorage(ctx context.Context, s Storage, h *StorageHealth) error {
+	if checker, ok := getHealthChecker(s); ok {
+		return checker.CheckHealth(ctx)
+	}
+	var hash string
+	cr.fileMux.RLock()
+	for h := range cr.fileset {
+		hash = h
+		break
+	}
+	cr.fileMux.RUnlock()
+	if hash == "" {
+		return nil
+	}
+	// Size cannot be canceled, so do not start another one if the last probe is still hanging
+	if !h.probing.CompareAndSwap(false, true) {
+		return errProbeRunning
+	}
+	done := make(chan error, 1)
+	go func() {
+		defer h.probing.Store(false)
+		_, err := s.Size(hash)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if isHealthError(err) {
+			return err
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// runHealthProber probes the unhealthy storages in background until the context is canceled
+func (cr *Cluster) runHealthProber(ctx context.Context) {
+	ticker := time.NewTicker(healthProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for i, s := range cr.storages {
+				h := cr.storageHealth[i]
+				_, hasChecker := getHealthChecker(s)
+				if !h.shouldProbe(now, hasChecker) {
+					continue
+				}
+				tctx, cancel := context.WithTimeout(ctx, healthProbeTimeout)
+				err := cr.probeStorage(tctx, s, h)
+				cancel()
+				if ctx.Err() != nil {
+					return
+				}
+				wasAvailable := h.Available()
+				h.recordProbe(err)
+				id := cr.storageOpts[i].Id
+				if err != nil {
+					if wasAvailable {
+						logWarnfWith(LogFields{"storage": id, "error": err}, "Storage %s is unhealthy: %v", id, err)
+					} else {
+						logDebugf("Storage %s is still unhealthy: %v", id, err)
+					}
+				} else if !wasAvailable {
+					logInfofWith(LogFields{"storage": id}, "Storage %s passed health check, recovering", id)
+				}
+			}
+		}
+	}
+}
+
+// StorageHealthStatus returns the health status of all storages
+func (cr *Cluster) StorageHealthStatus() []StorageHealthStatus {
+	status := make([]StorageHealthStatus, len(cr.storages))
+	for i, h := range cr.storageHealth {
+		status[i] = h.Status(cr.storageOpts[i].Id)
+	}
+	return status
+}
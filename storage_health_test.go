@@ -0,0 +1,198 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+func TestStorageHealth(t *testing.T) {
+	h := NewStorageHealth()
+	errDown := errors.New("connection refused")
+
+	for i := 0; i < healthFailThreshold-1; i++ {
+		if h.Record(errDown, time.Millisecond) {
+			t.Fatalf("Circuit opened too early at %d", i)
+		}
+	}
+	// missing files should not be considered as failures
+	h.Record(os.ErrNotExist, time.Millisecond)
+	if !h.Available() {
+		t.Fatalf("Storage should be available")
+	}
+	h.Record(errDown, time.Millisecond)
+	for i := 0; i < healthFailThreshold-1; i++ {
+		h.Record(errDown, time.Millisecond)
+	}
+	if h.Record(errDown, time.Millisecond) {
+		t.Errorf("Circuit should already be opened")
+	}
+	if h.Available() {
+		t.Fatalf("Storage should be unavailable after repeated failures")
+	}
+
+	now := time.Now()
+	if h.shouldProbe(now, false) {
+		t.Errorf("Storage should not be probed during cooldown")
+	}
+	if !h.shouldProbe(now.Add(healthMinCooldown), false) {
+		t.Errorf("Storage should be probed after cooldown")
+	}
+	h.recordProbe(nil)
+	if st := h.Status("s"); st.State != CircuitHalfOpen || !h.Available() {
+		t.Errorf("Storage should be recovering after probe, got %s", st.State)
+	}
+	// fail again during recovering
+	if !h.Record(errDown, time.Millisecond) {
+		t.Errorf("Circuit should be opened again")
+	}
+	if h.cooldown != healthMinCooldown*2 {
+		t.Errorf("Cooldown is %v, expect %v", h.cooldown, healthMinCooldown*2)
+	}
+	h.recordProbe(nil)
+	h.Record(nil, time.Millisecond)
+	if st := h.Status("s"); st.State != CircuitClosed || st.OpenedAt != nil {
+		t.Errorf("Storage should be healthy, got %#v", st)
+	}
+}
+
+func TestGetHealthChecker(t *testing.T) {
+	mount := new(MountStorage)
+	if _, ok := getHealthChecker(&CachedStorage{inner: mount}); !ok {
+		t.Errorf("Health checker of the cached mount storage is not found")
+	}
+	if _, ok := getHealthChecker(&CachedStorage{inner: new(LocalStorage)}); ok {
+		t.Errorf("Cached local storage should not have a health checker")
+	}
+}
+
+type hangingStorage struct {
+	*LocalStorage
+	release chan struct{}
+	calls   atomic.Int32
+}
+
+func (s *hangingStorage) Size(hash string) (int64, error) {
+	s.calls.Add(1)
+	<-s.release
+	return 0, os.ErrNotExist
+}
+
+func TestProbeStorageHanging(t *testing.T) {
+	const hash = "0123456789abcdef0123456789abcdef01234567"
+	cr := &Cluster{
+		fileset: map[string]int64{hash: 4},
+	}
+	s := &hangingStorage{
+		LocalStorage: new(LocalStorage),
+		release:      make(chan struct{}),
+	}
+	h := NewStorageHealth()
+
+	probe := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+		defer cancel()
+		return cr.probeStorage(ctx, s, h)
+	}
+	if err := probe(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expect deadline exceeded, got %v", err)
+	}
+	if err := probe(); !errors.Is(err, errProbeRunning) {
+		t.Fatalf("Expect errProbeRunning, got %v", err)
+	}
+	if n := s.calls.Load(); n != 1 {
+		t.Errorf("Size is called %d times while the previous one is hanging", n)
+	}
+	close(s.release)
+	deadline := time.Now().Add(time.Second * 5)
+	for h.probing.Load() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Probe is not finished after released")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if err := probe(); err != nil {
+		t.Errorf("Probe failed after released: %v", err)
+	}
+}
+
+type brokenPipeWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w brokenPipeWriter) Write(buf []byte) (int, error) {
+	return 0, syscall.EPIPE
+}
+
+func TestDownloadClientGone(t *testing.T) {
+	s := new(LocalStorage)
+	s.SetOptions(&LocalStorageOption{
+		CachePath: t.TempDir(),
+	})
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	const hash = "0123456789abcdef0123456789abcdef01234567"
+	if err := s.Create(hash, strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+	health := NewStorageHealth()
+	cr := &Cluster{
+		SharedStorages: &SharedStorages{
+			storageOpts:        []StorageOption{{BasicStorageOption: BasicStorageOption{Id: "local"}}},
+			storages:           []Storage{s},
+			storageWeights:     []uint{1},
+			storageTotalWeight: 1,
+			storageHealth:      []*StorageHealth{health},
+		},
+		fileset: map[string]int64{hash: 4},
+	}
+	cr.shouldEnable.Store(true)
+
+	for i := 0; i < healthFailThreshold*2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/download/"+hash, nil)
+		cr.handleDownload(brokenPipeWriter{httptest.NewRecorder()}, req, hash)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodGet, "/download/"+hash, nil).WithContext(ctx)
+	cr.handleDownload(brokenPipeWriter{httptest.NewRecorder()}, req, hash)
+
+	if st := health.Status("local"); st.Failed != 0 || st.State != CircuitClosed {
+		t.Errorf("Client disconnects are recorded as storage failures: %#v", st)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/download/"+hash, nil)
+	rw := httptest.NewRecorder()
+	cr.handleDownload(rw, req, hash)
+	if rw.Code != http.StatusOK || rw.Body.String() != "data" {
+		t.Errorf("Unexpected response %d %q", rw.Code, rw.Body.String())
+	}
+}
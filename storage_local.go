@@ -20,7 +20,6 @@
 package main
 
 import (
-	"compress/gzip"
 	"context"
 	"encoding/hex"
 	"errors"
@@ -128,7 +127,17 @@ func (s *LocalStorage) Create(hash string, r io.ReadSeeker) error {
 }
 
 func (s *LocalStorage) Remove(hash string) error {
-	return os.Remove(s.hashToPath(hash))
+	path := s.hashToPath(hash)
+	removed := false
+	for _, c := range precompressedVariants {
+		if os.Remove(path+c.Ext()) == nil {
+			removed = true
+		}
+	}
+	if err := os.Remove(path); err != nil && !(removed && errors.Is(err, os.ErrNotExist)) {
+		return err
+	}
+	return nil
 }
 
 func (s *LocalStorage) WalkDir(walker func(hash string, size int64) error) error {
@@ -139,82 +148,85 @@ func (s *LocalStorage) ServeDownload(rw http.ResponseWriter, req *http.Request,
 	acceptEncoding := splitCSV(req.Header.Get("Accept-Encoding"))
 	name := req.URL.Query().Get("name")
 
-	hasGzip := false
-	isGzip := false
 	path := s.hashToPath(hash)
-	if s.opt.Compressor == GzipCompressor {
-		if _, err := os.Stat(path + ".gz"); err == nil {
-			hasGzip = true
+	// variants are the precompressed files generated by zip-cache
+	var variants []Compressor
+	if s.opt.Compressor != NullCompressor {
+		rw.Header().Add("Vary", "Accept-Encoding")
+		for _, c := range precompressedVariants {
+			if _, err := os.Stat(path + c.Ext()); err == nil {
+				variants = append(variants, c)
+			}
 		}
 	}
+	hasRaw := true
 	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
-		if !hasGzip {
+		if len(variants) == 0 {
 			return 0, err
 		}
-		if hasGzip {
-			isGzip = true
-			path += ".gz"
-		}
+		hasRaw = false
 	}
 
-	if !isGzip && rw.Header().Get("Range") != "" {
-		fd, err := os.Open(path)
-		if err != nil {
-			return 0, err
-		}
-		defer fd.Close()
-
-		counter := &countReader{
-			ReadSeeker: fd,
+	if req.Header.Get("Range") != "" {
+		var rs io.ReadSeeker
+		if hasRaw {
+			fd, err := os.Open(path)
+			if err != nil {
+				return 0, err
+			}
+			defer fd.Close()
+			rs = fd
+		} else if size > 0 {
+			// only the compressed variants exist, seek by decompressing and skipping
+			c := variants[0]
+			ds := newDecompressSeeker(path+c.Ext(), c, size)
+			defer ds.Close()
+			rs = ds
 		}
-		rw.Header().Set("ETag", `"`+hash+`"`)
-		rw.Header().Set("Cache-Control", "public,max-age=31536000,immutable") // cache for a year
-		rw.Header().Set("Content-Type", "application/octet-stream")
-		if name != "" {
-			rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		if rs != nil {
+			counter := &countReader{
+				ReadSeeker: rs,
+			}
+			setDownloadHeaders(rw, hash, name)
+			http.ServeContent(rw, req, name, time.Time{}, counter)
+			return counter.n, nil
 		}
-		rw.Header().Set("X-Bmclapi-Hash", hash)
-		http.ServeContent(rw, req, name, time.Time{}, counter)
-		return counter.n, nil
 	}
 
 	var r io.Reader
-	if hasGzip && acceptEncoding["gzip"] != 0 {
-		if !isGzip {
-			isGzip = true
-			path += ".gz"
-		}
-		fd, err := os.Open(path)
+	if c := selectEncoding(acceptEncoding, variants); c != NullCompressor {
+		fd, err := os.Open(path + c.Ext())
 		if err != nil {
 			return 0, err
 		}
 		defer fd.Close()
 		r = fd
 		size, _ = getFileSize(fd)
-		rw.Header().Set("Content-Encoding", "gzip")
-	} else {
+		rw.Header().Set("Content-Encoding", c.ContentEncoding())
+	} else if hasRaw {
 		fd, err := os.Open(path)
 		if err != nil {
 			return 0, err
 		}
 		defer fd.Close()
 		r = fd
-		if isGzip {
-			size = 0
-			if r, err = gzip.NewReader(r); err != nil {
-				logErrorf("Could not decompress %q: %v", path, err)
-				return 0, err
-			}
-			isGzip = false
+	} else {
+		// the client does not accept any of the variants, decompress it for them
+		c = variants[0]
+		fd, err := os.Open(path + c.Ext())
+		if err != nil {
+			return 0, err
+		}
+		defer fd.Close()
+		if r, err = c.WrapReader(fd); err != nil {
+			logErrorf("Could not decompress %q: %v", path+c.Ext(), err)
+			return 0, err
+		}
+		if closer, ok := r.(io.Closer); ok {
+			defer closer.Close()
 		}
 	}
-	rw.Header().Set("ETag", `"`+hash+`"`)
-	rw.Header().Set("Cache-Control", "public,max-age=31536000,immutable") // cache for a year
-	rw.Header().Set("Content-Type", "application/octet-stream")
-	if name != "" {
-		rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
-	}
-	rw.Header().Set("X-Bmclapi-Hash", hash)
+	setDownloadHeaders(rw, hash, name)
 	if size > 0 {
 		rw.Header().Set("Content-Length", strconv.FormatInt(size, 10))
 	}
@@ -231,6 +243,34 @@ func (s *LocalStorage) ServeDownload(rw http.ResponseWriter, req *http.Request,
 	return 0, nil
 }
 
+func setDownloadHeaders(rw http.ResponseWriter, hash string, name string) {
+	rw.Header().Set("ETag", `"`+hash+`"`)
+	rw.Header().Set("Cache-Control", "public,max-age=31536000,immutable") // cache for a year
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	if name != "" {
+		rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	}
+	rw.Header().Set("X-Bmclapi-Hash", hash)
+}
+
+// selectEncoding picks the variant which has the highest quality in the Accept-Encoding header.
+// If the qualities are same, the order in the variants will be used.
+// It returns NullCompressor if none of the variants are acceptable.
+func selectEncoding(acceptEncoding map[string]float32, variants []Compressor) (c Compressor) {
+	c = NullCompressor
+	var best float32 = 0
+	for _, v := range variants {
+		q, ok := acceptEncoding[v.ContentEncoding()]
+		if !ok {
+			q = acceptEncoding["*"]
+		}
+		if q > best {
+			c, best = v, q
+		}
+	}
+	return
+}
+
 func (s *LocalStorage) ServeMeasure(rw http.ResponseWriter, req *http.Request, size int) error {
 	rw.Header().Set("Content-Length", strconv.Itoa(size*mbChunkSize))
 	rw.WriteHeader(http.StatusOK)
@@ -242,7 +282,54 @@ func (s *LocalStorage) ServeMeasure(rw http.ResponseWriter, req *http.Request, s
 	return nil
 }
 
+// walkCacheDir walks the files in the cache directory by their hashes.
+// The precompressed variants generated by zip-cache are reported under the hash of the original file only once,
+// with the size of the original file if it exists
 func walkCacheDir(cacheDir string, walker func(hash string, size int64) (err error)) (err error) {
+	type cacheFile struct {
+		hash string
+		size int64
+	}
+	var (
+		lastDir string
+		files   []cacheFile
+		indexes = make(map[string]int)
+	)
+	flush := func() error {
+		for _, f := range files {
+			if err := walker(f.hash, f.size); err != nil {
+				return err
+			}
+		}
+		files = files[:0]
+		clear(indexes)
+		return nil
+	}
+	if err = walkCacheFiles(cacheDir, func(name string, size int64) error {
+		if dir := name[:2]; dir != lastDir {
+			if err := flush(); err != nil {
+				return err
+			}
+			lastDir = dir
+		}
+		hash, c := cutCompressedExt(name)
+		if i, ok := indexes[hash]; ok {
+			if c == NullCompressor {
+				files[i].size = size
+			}
+			return nil
+		}
+		indexes[hash] = len(files)
+		files = append(files, cacheFile{hash, size})
+		return nil
+	}); err != nil {
+		return
+	}
+	return flush()
+}
+
+// walkCacheFiles walks all the files in the cache directory, including the precompressed variants
+func walkCacheFiles(cacheDir string, walker func(name string, size int64) (err error)) (err error) {
 	for _, dir := range hex256 {
 		files, err := os.ReadDir(filepath.Join(cacheDir, dir))
 		if err != nil {
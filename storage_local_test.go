@@ -0,0 +1,221 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+func TestLocalStorageServeCompressed(t *testing.T) {
+	s := new(LocalStorage)
+	s.SetOptions(&LocalStorageOption{
+		CachePath:  t.TempDir(),
+		Compressor: GzipCompressor,
+	})
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	sum := md5.Sum(data)
+	hash := hex.EncodeToString(sum[:])
+	path := s.hashToPath(hash)
+	for _, c := range []Compressor{BrotliCompressor, GzipCompressor} {
+		var buf bytes.Buffer
+		w := c.WrapWriter(&buf)
+		w.Write(data)
+		w.Close()
+		if err := os.WriteFile(path+c.Ext(), buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		accept   string
+		encoding Compressor
+	}{
+		{"", NullCompressor},
+		{"gzip, deflate", GzipCompressor},
+		{"gzip, deflate, br", BrotliCompressor},
+		{"gzip;q=1, br;q=0.5", GzipCompressor},
+		{"zstd", NullCompressor},
+		{"*", BrotliCompressor},
+		{"br;q=0, *", GzipCompressor},
+	} {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/download/"+hash, nil)
+		req.Header.Set("Accept-Encoding", tc.accept)
+		n, err := s.ServeDownload(rw, req, hash, (int64)(len(data)))
+		if err != nil {
+			t.Fatalf("ServeDownload with %q: %v", tc.accept, err)
+		}
+		res := rw.Result()
+		if got := res.Header.Get("Vary"); got != "Accept-Encoding" {
+			t.Errorf("Vary header is %q with %q", got, tc.accept)
+		}
+		if n != (int64)(rw.Body.Len()) || res.Header.Get("Content-Length") != strconv.FormatInt(n, 10) {
+			t.Errorf("Wrong served bytes %d with %q, body is %d, content length is %s", n, tc.accept, rw.Body.Len(), res.Header.Get("Content-Length"))
+		}
+		body := io.Reader(res.Body)
+		if tc.encoding == NullCompressor {
+			if enc := res.Header.Get("Content-Encoding"); enc != "" {
+				t.Errorf("Unexpected encoding %q with %q", enc, tc.accept)
+			}
+		} else {
+			if enc := res.Header.Get("Content-Encoding"); enc != tc.encoding.ContentEncoding() {
+				t.Errorf("Encoding is %q with %q, expect %q", enc, tc.accept, tc.encoding.ContentEncoding())
+			}
+			if body, err = tc.encoding.WrapReader(body); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got, _ := io.ReadAll(body); !bytes.Equal(got, data) {
+			t.Errorf("Unexpected content with %q", tc.accept)
+		}
+	}
+}
+
+func TestLocalStorageServeCompressedRange(t *testing.T) {
+	s := new(LocalStorage)
+	s.SetOptions(&LocalStorageOption{
+		CachePath:  t.TempDir(),
+		Compressor: GzipCompressor,
+	})
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	data := make([]byte, 256*1024)
+	for i := range data {
+		data[i] = (byte)(i * 7 % 251)
+	}
+	sum := md5.Sum(data)
+	hash := hex.EncodeToString(sum[:])
+	var buf bytes.Buffer
+	w := ZstdCompressor.WrapWriter(&buf)
+	w.Write(data)
+	w.Close()
+	if err := os.WriteFile(s.hashToPath(hash)+ZstdCompressor.Ext(), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		rang    string
+		ifRange string
+		status  int
+		expect  []byte
+	}{
+		{"bytes=100-199", "", 206, data[100:200]},
+		{"bytes=200000-", "", 206, data[200000:]},
+		{"bytes=-10", "", 206, data[len(data)-10:]},
+		{"bytes=100-199", `"` + hash + `"`, 206, data[100:200]},
+		{"bytes=100-199", `"other"`, 200, data},
+		{"bytes=300000-", "", 416, nil},
+	} {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/download/"+hash, nil)
+		req.Header.Set("Range", tc.rang)
+		if tc.ifRange != "" {
+			req.Header.Set("If-Range", tc.ifRange)
+		}
+		n, err := s.ServeDownload(rw, req, hash, (int64)(len(data)))
+		if err != nil {
+			t.Fatalf("ServeDownload with %q: %v", tc.rang, err)
+		}
+		if rw.Code != tc.status {
+			t.Errorf("Status is %d with %q, expect %d", rw.Code, tc.rang, tc.status)
+			continue
+		}
+		if tc.expect != nil && !bytes.Equal(rw.Body.Bytes(), tc.expect) {
+			t.Errorf("Unexpected content with %q", tc.rang)
+		}
+		if tc.expect != nil && n != (int64)(len(tc.expect)) {
+			t.Errorf("Served %d bytes with %q, expect %d", n, tc.rang, len(tc.expect))
+		}
+	}
+}
+
+func TestDecompressSeeker(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	path := t.TempDir() + "/data.gz"
+	var buf bytes.Buffer
+	w := GzipCompressor.WrapWriter(&buf)
+	w.Write(data)
+	w.Close()
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d := newDecompressSeeker(path, GzipCompressor, (int64)(len(data)))
+	defer d.Close()
+	if n, _ := d.Seek(0, io.SeekEnd); n != (int64)(len(data)) {
+		t.Fatalf("Seek end returned %d", n)
+	}
+	for _, off := range []int64{5000, 9995, 12, 0} {
+		d.Seek(off, io.SeekStart)
+		got := make([]byte, 5)
+		if _, err := io.ReadFull(d, got); err != nil {
+			t.Fatalf("Read at %d: %v", off, err)
+		}
+		if !bytes.Equal(got, data[off:off+5]) {
+			t.Errorf("Read %q at %d, expect %q", got, off, data[off:off+5])
+		}
+	}
+}
+
+func TestWalkCacheDirVariants(t *testing.T) {
+	dir := t.TempDir()
+	const (
+		raw        = "0123456789abcdef0123456789abcdef"
+		compressed = "01fedcba9876543210fedcba98765432"
+	)
+	os.MkdirAll(filepath.Join(dir, "01"), 0755)
+	for name, size := range map[string]int{
+		raw:                 100,
+		raw + ".br":         10,
+		raw + ".gz":         20,
+		compressed + ".gz":  30,
+		compressed + ".zst": 40,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, "01", name), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := make(map[string]int64)
+	if err := walkCacheDir(dir, func(hash string, size int64) error {
+		if _, ok := got[hash]; ok {
+			t.Errorf("Hash %s is reported twice", hash)
+		}
+		got[hash] = size
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[raw] != 100 || got[compressed] == 0 {
+		t.Errorf("Unexpected walked files: %v", got)
+	}
+}
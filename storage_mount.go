@@ -30,15 +30,12 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
-	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/LiterMC/go-openbmclapi/internal/gosrc"
 )
 
-var errNotWorking = errors.New("storage is down")
-
 type MountStorageOption struct {
 	Path           string `yaml:"path"`
 	RedirectBase   string `yaml:"redirect-base"`
@@ -53,12 +50,12 @@ type MountStorage struct {
 	opt MountStorageOption
 
 	supportRange atomic.Bool
-	working      atomic.Int32
-	checkMux     sync.RWMutex
-	lastCheck    time.Time
 }
 
-var _ Storage = (*MountStorage)(nil)
+var (
+	_ Storage              = (*MountStorage)(nil)
+	_ StorageHealthChecker = (*MountStorage)(nil)
+)
 
 func init() {
 	RegisterStorageFactory(StorageMount, StorageFactory{
@@ -113,10 +110,19 @@ func (s *MountStorage) Init(ctx context.Context) (err error) {
 		return
 	}
 	s.supportRange.Store(supportRange)
-	s.working.Store(1)
 	return
 }
 
+// CheckHealth checks whether the redirect target is accessible
+func (s *MountStorage) CheckHealth(ctx context.Context) error {
+	supportRange, err := s.checkAlive(ctx, 0)
+	if err != nil {
+		return err
+	}
+	s.supportRange.Store(supportRange)
+	return nil
+}
+
 func (s *MountStorage) hashToPath(hash string) string {
 	return filepath.Join(s.opt.CachePath(), hash[0:2], hash)
 }
@@ -155,56 +161,6 @@ func (s *MountStorage) WalkDir(walker func(hash string, size int64) error) error
 }
 
 func (s *MountStorage) ServeDownload(rw http.ResponseWriter, req *http.Request, hash string, size int64) (int64, error) {
-	now := time.Now()
-	if s.working.Load() != 1 {
-		if !s.working.CompareAndSwap(0, 2) {
-			return 0, errNotWorking
-		}
-		s.checkMux.Lock()
-		needCheck := now.Sub(s.lastCheck) > time.Minute*3
-		if needCheck {
-			s.lastCheck = now
-		}
-		s.checkMux.Unlock()
-		if !needCheck {
-			s.working.Store(0)
-			return 0, errNotWorking
-		}
-		tctx, cancel := context.WithTimeout(req.Context(), time.Second*5)
-		supportRange, err := s.checkAlive(tctx, 0)
-		cancel()
-		if err != nil {
-			s.working.Store(0)
-			return 0, errNotWorking
-		}
-		s.supportRange.Store(supportRange)
-		s.working.Store(1)
-	} else {
-		s.checkMux.RLock()
-		lastCheck := s.lastCheck
-		s.checkMux.RUnlock()
-		if now.Sub(lastCheck) > time.Minute*3 {
-			go func() {
-				s.checkMux.Lock()
-				if s.lastCheck != lastCheck {
-					s.checkMux.Unlock()
-					return
-				}
-				s.lastCheck = now
-				s.checkMux.Unlock()
-
-				tctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-				defer cancel()
-				if supportRange, err := s.checkAlive(tctx, 0); err == nil {
-					s.supportRange.Store(supportRange)
-					s.working.Store(1)
-				} else {
-					s.working.Store(0)
-				}
-			}()
-		}
-	}
-
 	target, err := url.JoinPath(s.opt.RedirectBase, "download", hash[:2], hash)
 	if err != nil {
 		return 0, err
@@ -0,0 +1,550 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/LiterMC/go-openbmclapi/internal/gosrc"
+)
+
+type S3StorageOption struct {
+	// EndPoint is the base URL of the S3 service, e.g. https://s3.us-east-1.amazonaws.com
+	EndPoint  string `yaml:"endpoint"`
+	Region    string `yaml:"region"`
+	Bucket    string `yaml:"bucket"`
+	Prefix    string `yaml:"prefix"`
+	AccessKey string `yaml:"access-key"`
+	SecretKey string `yaml:"secret-key"`
+	// PathStyle uses <endpoint>/<bucket>/<key> instead of <bucket>.<endpoint>/<key>
+	PathStyle bool `yaml:"path-style"`
+
+	MaxConn         int          `yaml:"max-conn"`
+	MaxUploadRate   int          `yaml:"max-upload-rate"`
+	MaxDownloadRate int          `yaml:"max-download-rate"`
+	PreGenMeasures  bool         `yaml:"pre-gen-measures"`
+	PresignExpire   YAMLDuration `yaml:"presign-expire"`
+	// RedirectBase will be used instead of the presigned URL if it's not empty
+	RedirectBase string `yaml:"redirect-base"`
+}
+
+var (
+	_ yaml.Marshaler   = (*S3StorageOption)(nil)
+	_ yaml.Unmarshaler = (*S3StorageOption)(nil)
+)
+
+func (o *S3StorageOption) MarshalYAML() (any, error) {
+	type T S3StorageOption
+	return (*T)(o), nil
+}
+
+func (o *S3StorageOption) UnmarshalYAML(n *yaml.Node) (err error) {
+	// set default values
+	o.Region = "us-east-1"
+	o.PathStyle = true
+	o.MaxConn = 24
+	o.MaxUploadRate = 0
+	o.MaxDownloadRate = 0
+	o.PreGenMeasures = false
+	o.PresignExpire = (YAMLDuration)(time.Minute * 10)
+	o.RedirectBase = ""
+
+	type T S3StorageOption
+	if err = n.Decode((*T)(o)); err != nil {
+		return
+	}
+	return
+}
+
+type S3Storage struct {
+	opt S3StorageOption
+
+	endpoint      *url.URL
+	limitedDialer *LimitedDialer
+	httpCli       *http.Client
+}
+
+var _ Storage = (*S3Storage)(nil)
+
+func init() {
+	RegisterStorageFactory(StorageS3, StorageFactory{
+		New:       func() Storage { return new(S3Storage) },
+		NewConfig: func() any { return new(S3StorageOption) },
+	})
+}
+
+func (s *S3Storage) String() string {
+	return fmt.Sprintf("<S3Storage endpoint=%q bucket=%q prefix=%q>", s.opt.EndPoint, s.opt.Bucket, s.opt.Prefix)
+}
+
+func (s *S3Storage) Options() any {
+	return &s.opt
+}
+
+func (s *S3Storage) SetOptions(newOpts any) {
+	s.opt = *(newOpts.(*S3StorageOption))
+}
+
+func (s *S3Storage) Init(ctx context.Context) (err error) {
+	if s.endpoint, err = url.Parse(s.opt.EndPoint); err != nil {
+		return
+	}
+	if s.endpoint.Scheme == "" || s.endpoint.Host == "" {
+		return fmt.Errorf("Invalid s3 endpoint %q", s.opt.EndPoint)
+	}
+	if s.opt.Bucket == "" {
+		return fmt.Errorf("Bucket of %s is empty", s.String())
+	}
+
+	s.limitedDialer = NewLimitedDialer(nil, s.opt.MaxConn, s.opt.MaxDownloadRate*1024, s.opt.MaxUploadRate*1024)
+	s.limitedDialer.SetMinReadRate(1024)
+	s.limitedDialer.SetMinWriteRate(1024)
+
+	s.httpCli = &http.Client{
+		Transport: &http.Transport{
+			DialContext: s.limitedDialer.DialContext,
+		},
+	}
+
+	if s.opt.PreGenMeasures {
+		logInfof("Creating measure files at %s", s.String())
+		for i := 1; i <= 200; i++ {
+			if err := s.createMeasureFile(ctx, i); err != nil {
+				os.Exit(2)
+			}
+		}
+		logInfo("Measure files created")
+	}
+	return
+}
+
+func (s *S3Storage) hashToKey(hash string) string {
+	return path.Join(s.opt.Prefix, "download", hash[0:2], hash)
+}
+
+func (s *S3Storage) measureKey(size int) string {
+	return path.Join(s.opt.Prefix, "measure", strconv.Itoa(size))
+}
+
+// objectURL returns the URL of the object key without any query
+func (s *S3Storage) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	if s.opt.PathStyle {
+		u.Path = path.Join("/", u.Path, s.opt.Bucket, key)
+	} else {
+		u.Host = s.opt.Bucket + "." + u.Host
+		u.Path = path.Join("/", u.Path, key)
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	return &u
+}
+
+func (s *S3Storage) newRequest(ctx context.Context, method string, key string, query url.Values, body io.Reader) (req *http.Request, err error) {
+	u := s.objectURL(key)
+	if query != nil {
+		u.RawQuery = s3EncodeQuery(query)
+	}
+	if req, err = http.NewRequestWithContext(ctx, method, u.String(), body); err != nil {
+		return
+	}
+	req.Header.Set("User-Agent", ClusterUserAgentFull)
+	return
+}
+
+func (s *S3Storage) do(req *http.Request) (*http.Response, error) {
+	s3SignRequest(req, s.opt.AccessKey, s.opt.SecretKey, s.opt.Region, time.Now())
+	return s.httpCli.Do(req)
+}
+
+func (s *S3Storage) Size(hash string) (int64, error) {
+	req, err := s.newRequest(context.TODO(), http.MethodHead, s.hashToKey(hash), nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	res, err := s.do(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return res.ContentLength, nil
+	case http.StatusNotFound:
+		return 0, os.ErrNotExist
+	default:
+		return 0, &HTTPStatusError{Code: res.StatusCode, URL: req.URL.String()}
+	}
+}
+
+func (s *S3Storage) Open(hash string) (io.ReadCloser, error) {
+	req, err := s.newRequest(context.TODO(), http.MethodGet, s.hashToKey(hash), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+		return res.Body, nil
+	case http.StatusNotFound:
+		res.Body.Close()
+		return nil, os.ErrNotExist
+	default:
+		err := NewHTTPStatusErrorFromResponse(res)
+		res.Body.Close()
+		return nil, err
+	}
+}
+
+func (s *S3Storage) putObject(ctx context.Context, key string, r io.ReadSeeker) error {
+	size, err := getFileSize(r)
+	if err != nil {
+		return err
+	}
+	req, err := s.newRequest(ctx, http.MethodPut, key, nil, io.NopCloser(r))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	logDebugf("Putting %q", req.URL.String())
+	res, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return NewHTTPStatusErrorFromResponse(res)
+	}
+	return nil
+}
+
+func (s *S3Storage) Create(hash string, r io.ReadSeeker) error {
+	return s.putObject(context.TODO(), s.hashToKey(hash), r)
+}
+
+func (s *S3Storage) Remove(hash string) error {
+	req, err := s.newRequest(context.TODO(), http.MethodDelete, s.hashToKey(hash), nil, nil)
+	if err != nil {
+		return err
+	}
+	res, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		return os.ErrNotExist
+	default:
+		return NewHTTPStatusErrorFromResponse(res)
+	}
+}
+
+type s3ListBucketResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key  string `xml:"Key"`
+		Size int64  `xml:"Size"`
+	} `xml:"Contents"`
+}
+
+func (s *S3Storage) WalkDir(walker func(hash string, size int64) error) error {
+	prefix := path.Join(s.opt.Prefix, "download") + "/"
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {prefix},
+	}
+	for {
+		req, err := s.newRequest(context.TODO(), http.MethodGet, "", query, nil)
+		if err != nil {
+			return err
+		}
+		res, err := s.do(req)
+		if err != nil {
+			return err
+		}
+		if res.StatusCode != http.StatusOK {
+			err := NewHTTPStatusErrorFromResponse(res)
+			res.Body.Close()
+			return err
+		}
+		var result s3ListBucketResult
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, obj := range result.Contents {
+			// <prefix>/download/<hash[0:2]>/<hash>
+			dir, hash := path.Split(strings.TrimPrefix(obj.Key, prefix))
+			if len(hash) >= 2 && dir == hash[:2]+"/" {
+				if err := walker(hash, obj.Size); err != nil {
+					return err
+				}
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+	return nil
+}
+
+func (s *S3Storage) redirectURL(key string) (string, error) {
+	if s.opt.RedirectBase != "" {
+		return url.JoinPath(s.opt.RedirectBase, strings.TrimPrefix(key, s.opt.Prefix))
+	}
+	u := s.objectURL(key)
+	s3PresignURL(u, s.opt.AccessKey, s.opt.SecretKey, s.opt.Region, time.Now(), s.opt.PresignExpire.Dur())
+	return u.String(), nil
+}
+
+func (s *S3Storage) ServeDownload(rw http.ResponseWriter, req *http.Request, hash string, size int64) (int64, error) {
+	target, err := s.redirectURL(s.hashToKey(hash))
+	if err != nil {
+		return 0, err
+	}
+	// fix the size for Ranged request
+	rgs, err := gosrc.ParseRange(req.Header.Get("Range"), size)
+	if err == nil && len(rgs) > 0 {
+		var newSize int64 = 0
+		for _, r := range rgs {
+			newSize += r.Length
+		}
+		if newSize < size {
+			size = newSize
+		}
+	}
+	http.Redirect(rw, req, target, http.StatusFound)
+	return size, nil
+}
+
+func (s *S3Storage) ServeMeasure(rw http.ResponseWriter, req *http.Request, size int) error {
+	if err := s.createMeasureFile(req.Context(), size); err != nil {
+		return err
+	}
+	target, err := s.redirectURL(s.measureKey(size))
+	if err != nil {
+		return err
+	}
+	http.Redirect(rw, req, target, http.StatusFound)
+	return nil
+}
+
+func (s *S3Storage) createMeasureFile(ctx context.Context, size int) (err error) {
+	key := s.measureKey(size)
+	tsz := (int64)(size) * mbChunkSize
+	if size == 0 {
+		tsz = 2
+	}
+	req, err := s.newRequest(ctx, http.MethodHead, key, nil, nil)
+	if err != nil {
+		return
+	}
+	if res, err := s.do(req); err == nil {
+		res.Body.Close()
+		if res.StatusCode == http.StatusOK {
+			if res.ContentLength == tsz {
+				return nil
+			}
+			logDebugf("File [%d] size %d does not match %d", size, res.ContentLength, tsz)
+		}
+	} else if e := ctx.Err(); e != nil {
+		return e
+	} else {
+		logErrorf("Cannot get stat of %s: %v", key, err)
+	}
+	logInfof("Creating measure file at %q", key)
+	if err = s.putObject(ctx, key, io.NewSectionReader(EmptyReader, 0, tsz)); err != nil {
+		logErrorf("Cannot create measure file %q: %v", key, err)
+		return
+	}
+	return nil
+}
+
+// AWS Signature Version 4
+// see <https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html>
+
+const (
+	s3SignAlgorithm    = "AWS4-HMAC-SHA256"
+	s3UnsignedPayload  = "UNSIGNED-PAYLOAD"
+	s3DateFormat       = "20060102"
+	s3DateTimeFormat   = "20060102T150405Z"
+	s3MaxPresignExpire = time.Hour * 24 * 7
+)
+
+func s3ShouldEscape(c byte) bool {
+	if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' {
+		return false
+	}
+	switch c {
+	case '-', '_', '.', '~':
+		return false
+	}
+	return true
+}
+
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !s3ShouldEscape(c) || keepSlash && c == '/' {
+			b.WriteByte(c)
+		} else {
+			b.WriteByte('%')
+			b.WriteByte("0123456789ABCDEF"[c>>4])
+			b.WriteByte("0123456789ABCDEF"[c&0xf])
+		}
+	}
+	return b.String()
+}
+
+func s3EscapePath(p string) string {
+	return s3Escape(p, true)
+}
+
+// s3EncodeQuery encodes the query in the canonical form, which is sorted by key
+func s3EncodeQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		vs := append([]string(nil), query[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			if b.Len() > 0 {
+				b.WriteByte('&')
+			}
+			b.WriteString(s3Escape(k, false))
+			b.WriteByte('=')
+			b.WriteString(s3Escape(v, false))
+		}
+	}
+	return b.String()
+}
+
+func s3HmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(([]byte)(data))
+	return h.Sum(nil)
+}
+
+func s3Scope(now time.Time, region string) string {
+	return now.Format(s3DateFormat) + "/" + region + "/s3/aws4_request"
+}
+
+func s3Signature(secretKey string, region string, now time.Time, canonicalRequest string) string {
+	hs := sha256.Sum256(([]byte)(canonicalRequest))
+	stringToSign := s3SignAlgorithm + "\n" +
+		now.Format(s3DateTimeFormat) + "\n" +
+		s3Scope(now, region) + "\n" +
+		hex.EncodeToString(hs[:])
+	key := s3HmacSHA256(([]byte)("AWS4"+secretKey), now.Format(s3DateFormat))
+	key = s3HmacSHA256(key, region)
+	key = s3HmacSHA256(key, "s3")
+	key = s3HmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(s3HmacSHA256(key, stringToSign))
+}
+
+// s3SignRequest adds the Authorization header to the request.
+// The payload will not be signed.
+func s3SignRequest(req *http.Request, accessKey, secretKey string, region string, now time.Time) {
+	now = now.UTC()
+	req.Header.Set("X-Amz-Date", now.Format(s3DateTimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	headerValues := []string{req.URL.Host, s3UnsignedPayload, now.Format(s3DateTimeFormat)}
+
+	var canonicalHeaders strings.Builder
+	for i, h := range signedHeaders {
+		canonicalHeaders.WriteString(h)
+		canonicalHeaders.WriteByte(':')
+		canonicalHeaders.WriteString(headerValues[i])
+		canonicalHeaders.WriteByte('\n')
+	}
+	signedHeadersStr := strings.Join(signedHeaders, ";")
+
+	canonicalRequest := req.Method + "\n" +
+		req.URL.EscapedPath() + "\n" +
+		req.URL.RawQuery + "\n" +
+		canonicalHeaders.String() + "\n" +
+		signedHeadersStr + "\n" +
+		s3UnsignedPayload
+
+	signature := s3Signature(secretKey, region, now, canonicalRequest)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3SignAlgorithm, accessKey, s3Scope(now, region), signedHeadersStr, signature))
+}
+
+// s3PresignURL sets the query of the URL to a presigned GET request
+func s3PresignURL(u *url.URL, accessKey, secretKey string, region string, now time.Time, expires time.Duration) {
+	now = now.UTC()
+	if expires <= 0 {
+		expires = time.Minute * 10
+	} else if expires > s3MaxPresignExpire {
+		expires = s3MaxPresignExpire
+	}
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", s3SignAlgorithm)
+	query.Set("X-Amz-Credential", accessKey+"/"+s3Scope(now, region))
+	query.Set("X-Amz-Date", now.Format(s3DateTimeFormat))
+	query.Set("X-Amz-Expires", strconv.FormatInt((int64)(expires.Seconds()), 10))
+	query.Set("X-Amz-SignedHeaders", "host")
+	rawQuery := s3EncodeQuery(query)
+
+	canonicalRequest := http.MethodGet + "\n" +
+		u.EscapedPath() + "\n" +
+		rawQuery + "\n" +
+		"host:" + u.Host + "\n" +
+		"\n" +
+		"host\n" +
+		s3UnsignedPayload
+
+	signature := s3Signature(secretKey, region, now, canonicalRequest)
+	u.RawQuery = rawQuery + "&X-Amz-Signature=" + signature
+}
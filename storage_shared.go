@@ -0,0 +1,204 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// SharedStorages holds the storages and their states,
+// which can be shared by multiple clusters running in the same process
+type SharedStorages struct {
+	dataDir            string
+	storageOpts        []StorageOption
+	storages           []Storage
+	storageWeightMux   sync.RWMutex
+	storageWeights     []uint
+	storageTotalWeight uint
+	storageHealth      []*StorageHealth
+	fileIndexes        map[Storage]*FileIndex
+	clientLimiter      *ClientLimiter
+
+	initOnce sync.Once
+	// syncMux makes sure only one cluster is writing the storages
+	syncMux sync.Mutex
+	isgc    atomic.Bool
+
+	clusterMux sync.RWMutex
+	clusters   []*Cluster
+}
+
+func NewSharedStorages(dataDir string, storageOpts []StorageOption) (ss *SharedStorages) {
+	var (
+		n   uint = 0
+		wgs      = make([]uint, len(storageOpts))
+		sts      = make([]Storage, len(storageOpts))
+	)
+	for i, s := range storageOpts {
+		sts[i] = NewStorage(s)
+		wgs[i] = s.Weight
+		n += s.Weight
+	}
+	ss = &SharedStorages{
+		dataDir:            dataDir,
+		storageOpts:        storageOpts,
+		storages:           sts,
+		storageWeights:     wgs,
+		storageTotalWeight: n,
+		storageHealth:      make([]*StorageHealth, len(sts)),
+		clientLimiter:      NewClientLimiter(),
+	}
+	for i := range sts {
+		h := NewStorageHealth()
+		ss.storageHealth[i] = h
+		metricStorageAvailable.With(storageOpts[i].Id).SetFunc(func() float64 {
+			if h.Available() {
+				return 1
+			}
+			return 0
+		})
+	}
+	metricSyncRunning.With().SetFunc(func() float64 {
+		if ss.isSyncing() {
+			return 1
+		}
+		return 0
+	})
+	return
+}
+
+// init initializes the storages and loads the file indexes.
+// The health prober will use the file list of the cluster which called init first.
+func (ss *SharedStorages) init(ctx context.Context, cr *Cluster) {
+	ss.initOnce.Do(func() {
+		vctx := context.WithValue(ctx, ClusterCacheCtxKey, cr.cache)
+		for i, s := range ss.storages {
+			if err := s.Init(vctx); err != nil {
+				logErrorf("Could not initialize storage %s: %v", s.String(), err)
+				// the storage will be excluded until it passed the health check
+				ss.storageHealth[i].recordProbe(err)
+			}
+		}
+		go cr.runHealthProber(ctx)
+		// load file indexes
+		ss.fileIndexes = make(map[Storage]*FileIndex, len(ss.storages))
+		for i, s := range ss.storages {
+			idx, err := OpenFileIndex(ss.fileIndexPath(ss.storageOpts[i].Id))
+			if err != nil {
+				logErrorf("Could not load file index for %s: %v", s.String(), err)
+				continue
+			}
+			ss.fileIndexes[s] = idx
+		}
+	})
+}
+
+func (ss *SharedStorages) addCluster(cr *Cluster) {
+	ss.clusterMux.Lock()
+	defer ss.clusterMux.Unlock()
+	ss.clusters = append(ss.clusters, cr)
+}
+
+func (ss *SharedStorages) fileIndexPath(storageId string) string {
+	return filepath.Join(ss.dataDir, "index", url.PathEscape(storageId)+".idx")
+}
+
+// CloseFileIndexes flushes and closes the file indexes of all storages
+func (ss *SharedStorages) CloseFileIndexes() {
+	for s, idx := range ss.fileIndexes {
+		if err := idx.Close(); err != nil {
+			logErrorf("Could not close file index for %s: %v", s.String(), err)
+		}
+	}
+}
+
+// isSyncing reports whether any cluster is synchronizing files
+func (ss *SharedStorages) isSyncing() bool {
+	ss.clusterMux.RLock()
+	defer ss.clusterMux.RUnlock()
+	for _, cr := range ss.clusters {
+		if cr.issync.Load() {
+			return true
+		}
+	}
+	return false
+}
+
+// filesetsReady reports whether all clusters have got their file lists
+func (ss *SharedStorages) filesetsReady() bool {
+	ss.clusterMux.RLock()
+	defer ss.clusterMux.RUnlock()
+	for _, cr := range ss.clusters {
+		cr.fileMux.RLock()
+		ready := cr.fileset != nil
+		cr.fileMux.RUnlock()
+		if !ready {
+			return false
+		}
+	}
+	return true
+}
+
+// hasFile reports whether the file is required by any cluster
+func (ss *SharedStorages) hasFile(hash string) bool {
+	ss.clusterMux.RLock()
+	defer ss.clusterMux.RUnlock()
+	for _, cr := range ss.clusters {
+		if _, ok := cr.CachedFileSize(hash); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// SetStorageWeights changes the possibility of choosing each storage when serving downloads
+func (ss *SharedStorages) SetStorageWeights(weights []uint) {
+	var total uint = 0
+	for _, w := range weights {
+		total += w
+	}
+	ss.storageWeightMux.Lock()
+	defer ss.storageWeightMux.Unlock()
+	ss.storageWeights = weights
+	ss.storageTotalWeight = total
+}
+
+// getStorageId returns the id of the storage, or an empty string if the storage is not in the cluster
+func (ss *SharedStorages) getStorageId(s Storage) string {
+	for i, s0 := range ss.storages {
+		if s0 == s {
+			return ss.storageOpts[i].Id
+		}
+	}
+	return ""
+}
+
+func (ss *SharedStorages) getStorageById(id string) Storage {
+	for i, opt := range ss.storageOpts {
+		if opt.Id == id {
+			return ss.storages[i]
+		}
+	}
+	return nil
+}
@@ -145,7 +145,7 @@ const ClusterCacheCtxKey = "go-openbmclapi.cluster.cache"
 
 func (s *WebDavStorage) Init(ctx context.Context) (err error) {
 	if alias := s.opt.Alias; alias != "" {
-		user, ok := config.WebdavUsers[alias]
+		user, ok := config().WebdavUsers[alias]
 		if !ok {
 			logErrorf("Web dav user %q does not exists", alias)
 			os.Exit(1)
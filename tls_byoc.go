@@ -0,0 +1,173 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+type getCertificateFunc = func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+// newByocCertificate returns the function to get the certificates for the clusters which bring their own certificates.
+// The ACME manager is returned if the certificates are issued by ACME, it's nil if the certificate files are used.
+func newByocCertificate(cfg ByocTLSConfig, hosts []string, dataDir string) (getCert getCertificateFunc, manager *autocert.Manager, err error) {
+	if !cfg.Acme.Enable {
+		loader := &certFileLoader{
+			certFile: cfg.CertFile,
+			keyFile:  cfg.KeyFile,
+		}
+		if err = loader.reload(); err != nil {
+			return
+		}
+		return loader.GetCertificate, nil, nil
+	}
+	if manager, err = newAcmeManager(cfg.Acme, hosts, filepath.Join(dataDir, "acme")); err != nil {
+		return
+	}
+	return manager.GetCertificate, manager, nil
+}
+
+func newAcmeManager(cfg AcmeConfig, hosts []string, cacheDir string) (*autocert.Manager, error) {
+	domains := make([]string, 0, len(hosts)+len(cfg.Domains))
+	for _, list := range [][]string{hosts, cfg.Domains} {
+		for _, h := range list {
+			if h != "" {
+				domains = append(domains, h)
+			}
+		}
+	}
+	if len(domains) == 0 {
+		return nil, errors.New("No domain for ACME, please set public-host or byoc-tls.acme.domains")
+	}
+	client := &acme.Client{
+		DirectoryURL: cfg.DirectoryURL,
+		UserAgent:    ClusterUserAgent,
+	}
+	if cfg.DirectoryCA != "" {
+		data, err := os.ReadFile(cfg.DirectoryCA)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read ACME directory CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("No certificate found in %q", cfg.DirectoryCA)
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					RootCAs: pool,
+				},
+			},
+		}
+	}
+	whitelist := autocert.HostWhitelist(domains...)
+	return &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		Cache:  autocert.DirCache(cacheDir),
+		HostPolicy: func(ctx context.Context, host string) error {
+			// the Host header of HTTP-01 challenges contains the port if it's not 80
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			return whitelist(ctx, host)
+		},
+		RenewBefore: (time.Duration)(cfg.RenewBefore),
+		Client:      client,
+		Email:       cfg.Email,
+	}, nil
+}
+
+const certFileCheckInterval = time.Second * 30
+
+// certFileLoader loads the certificate from files, and reloads it when the files are changed
+type certFileLoader struct {
+	certFile, keyFile string
+
+	mux     sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checkAt time.Time
+}
+
+func (l *certFileLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	now := time.Now()
+	if l.cert != nil && now.Before(l.checkAt) {
+		return l.cert, nil
+	}
+	l.checkAt = now.Add(certFileCheckInterval)
+	if err := l.reloadLocked(); err != nil {
+		if l.cert == nil {
+			return nil, err
+		}
+		logErrorf("Could not reload certificate, keeping the old one: %v", err)
+	}
+	return l.cert, nil
+}
+
+func (l *certFileLoader) reload() error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.reloadLocked()
+}
+
+func (l *certFileLoader) reloadLocked() error {
+	var modTime time.Time
+	for _, name := range []string{l.certFile, l.keyFile} {
+		stat, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		if t := stat.ModTime(); t.After(modTime) {
+			modTime = t
+		}
+	}
+	if l.cert != nil && modTime.Equal(l.modTime) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+	if l.cert != nil {
+		logInfof("Certificate %q reloaded, expires at %s", l.certFile, cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	l.cert = &cert
+	l.modTime = modTime
+	return nil
+}
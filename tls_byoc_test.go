@@ -0,0 +1,101 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func writeTestCertificate(t *testing.T, cert *tls.Certificate, certFile, keyFile string, modTime time.Time) {
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(certFile, modTime, modTime)
+	os.Chtimes(keyFile, modTime, modTime)
+}
+
+func TestCertFileLoader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	now := time.Now()
+	writeTestCertificate(t, newTestCertificate(t, "a.example.com"), certFile, keyFile, now.Add(-time.Hour))
+
+	l := &certFileLoader{certFile: certFile, keyFile: keyFile}
+	if err := l.reload(); err != nil {
+		t.Fatalf("Cannot load certificate: %v", err)
+	}
+	cert, err := l.GetCertificate(nil)
+	if err != nil || cert.Leaf.Subject.CommonName != "a.example.com" {
+		t.Fatalf("Unexpected certificate %v, %v", cert, err)
+	}
+
+	writeTestCertificate(t, newTestCertificate(t, "b.example.com"), certFile, keyFile, now)
+	if cert, _ = l.GetCertificate(nil); cert.Leaf.Subject.CommonName != "a.example.com" {
+		t.Errorf("Certificate should not be reloaded before the check interval")
+	}
+	l.checkAt = time.Time{}
+	if cert, _ = l.GetCertificate(nil); cert.Leaf.Subject.CommonName != "b.example.com" {
+		t.Errorf("Certificate should be reloaded, got %s", cert.Leaf.Subject.CommonName)
+	}
+
+	// broken files should not replace the working certificate
+	os.WriteFile(certFile, []byte("broken"), 0600)
+	os.Chtimes(certFile, now.Add(time.Hour), now.Add(time.Hour))
+	l.checkAt = time.Time{}
+	if cert, err = l.GetCertificate(nil); err != nil || cert.Leaf.Subject.CommonName != "b.example.com" {
+		t.Errorf("Should keep the old certificate, got %v, %v", cert, err)
+	}
+}
+
+func TestAcmeHostPolicy(t *testing.T) {
+	manager, err := newAcmeManager(AcmeConfig{
+		Domains:      []string{"extra.example.com", ""},
+		DirectoryURL: "https://acme.invalid/directory",
+	}, []string{"a.example.com", ""}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, host := range []string{"a.example.com", "a.example.com:5002", "extra.example.com"} {
+		if err := manager.HostPolicy(ctx, host); err != nil {
+			t.Errorf("Host %q should be allowed, got %v", host, err)
+		}
+	}
+	for _, host := range []string{"other.example.com", ""} {
+		if err := manager.HostPolicy(ctx, host); err == nil {
+			t.Errorf("Host %q should not be allowed", host)
+		}
+	}
+}
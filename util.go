@@ -22,9 +22,7 @@ package main
 import (
 	"context"
 	"crypto"
-	"crypto/x509"
 	"encoding/base64"
-	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
@@ -163,25 +161,6 @@ func getHashMethod(l int) (hashMethod crypto.Hash, err error) {
 	return
 }
 
-func parseCertCommonName(cert []byte) (string, error) {
-	rest := cert
-	for {
-		var block *pem.Block
-		block, rest = pem.Decode(rest)
-		if block == nil {
-			return "", nil
-		}
-		if block.Type != "CERTIFICATE" {
-			continue
-		}
-		cert, err := x509.ParseCertificate(block.Bytes)
-		if err != nil {
-			return "", err
-		}
-		return cert.Subject.CommonName, nil
-	}
-}
-
 var rd = func() chan int {
 	ch := make(chan int, 64)
 	r := rand.New(rand.NewSource(time.Now().Unix()))